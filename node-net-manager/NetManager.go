@@ -1,6 +1,7 @@
 package main
 
 import (
+	"NetManager/dns"
 	"NetManager/env"
 	"NetManager/handlers"
 	"NetManager/logger"
@@ -14,6 +15,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/gorilla/mux"
 	"github.com/tkanos/gonfig"
@@ -51,6 +53,8 @@ func handleRequests(port int) {
 
 var Env env.Environment
 var Proxy proxy.GoProxyTunnel
+var DNS *dns.Server
+var MDNS *dns.MdnsResponder
 var WorkerID string
 var Configuration netConfiguration
 
@@ -123,6 +127,15 @@ func register(writer http.ResponseWriter, request *http.Request) {
 
 	//initialize the proxy tunnel
 	Proxy = proxy.New()
+
+	//exchange the tunnel keys with the other nodes before accepting any packet
+	publicKey, err := Proxy.EnableEncryption()
+	if err == nil {
+		mqtt.SubscribeTunnelKeys(Proxy.AddPeerKey)
+		_ = mqtt.AnnounceTunnelKey(Configuration.NodePublicAddress, Configuration.NodePublicPort, publicKey)
+	} else {
+		log.Printf("WARNING - Unencrypted tunnel: %v", err)
+	}
 	Proxy.Listen()
 
 	//initialize the Env Manager
@@ -130,6 +143,23 @@ func register(writer http.ResponseWriter, request *http.Request) {
 
 	Proxy.SetEnvironment(&Env)
 
+	//resolve the service names for the deployed services, unless disabled with DNS_ENABLED=false
+	if os.Getenv("DNS_ENABLED") != "false" {
+		DNS = dns.NewServer(&Env, dns.UpstreamsFromResolvConf(dns.RESOLV_CONF))
+		if err := DNS.Listen(Env.BridgeAddresses()); err != nil {
+			log.Printf("WARNING - Service name resolution not available on every bridge address: %v", err)
+		}
+		Env.SetNameservers(Env.BridgeAddresses())
+	}
+
+	//answer the .local queries for the services deployed on this node, unless disabled with MDNS_ENABLED=false
+	if os.Getenv("MDNS_ENABLED") != "false" {
+		MDNS = dns.NewMdnsResponder(&Env)
+		if err := MDNS.Listen(Env.BridgeName()); err != nil {
+			log.Printf("WARNING - mDNS not available on every address family: %v", err)
+		}
+	}
+
 	writer.WriteHeader(http.StatusOK)
 }
 
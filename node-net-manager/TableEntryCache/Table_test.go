@@ -1,9 +1,12 @@
 package TableEntryCache
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestTableInsertSuccessfull(t *testing.T) {
@@ -366,3 +369,450 @@ func TestTableDeleteManyInstances_2(t *testing.T) {
 		t.Errorf("a1 should not be there: %v", table.SearchByJobName("a1.a1.a2.a2"))
 	}
 }
+
+func getFakeTableEntry(i int) TableEntry {
+	return TableEntry{
+		Appname:          "a1",
+		Appns:            "a1",
+		Servicename:      fmt.Sprintf("s%d", i/10),
+		Servicenamespace: "a2",
+		JobName:          fmt.Sprintf("a1.a1.s%d.a2", i/10),
+		Instancenumber:   i % 10,
+		Cluster:          0,
+		Nodeip:           net.ParseIP("10.30.0.1"),
+		Nodeport:         1003,
+		Nsip:             net.IPv4(10, 18, byte(i>>8), byte(i)),
+		Nsipv6:           net.ParseIP(fmt.Sprintf("fc00::%x", i)),
+		ServiceIP: []ServiceIP{{
+			IpType:     RoundRobin,
+			Address:    net.IPv4(10, 30, byte(i/10>>8), byte(i/10)),
+			Address_v6: net.ParseIP(fmt.Sprintf("fdff:2000::%x", i/10)),
+		}, {
+			IpType:     InstanceNumber,
+			Address:    net.IPv4(10, 31, byte(i>>8), byte(i)),
+			Address_v6: net.ParseIP(fmt.Sprintf("fdff:3000::%x", i)),
+		}},
+	}
+}
+
+func getFakeTable(size int) *TableManager {
+	table := NewTableManager()
+	for i := 0; i < size; i++ {
+		_ = table.Add(getFakeTableEntry(i))
+	}
+	return &table
+}
+
+func TestTableIndexesAfterRemoval(t *testing.T) {
+	table := getFakeTable(100)
+
+	// removing from the middle moves the last entry, its indexes must follow it
+	_ = table.RemoveByNsip(net.ParseIP("fc00::5"))
+	_ = table.RemoveByJobName("a1.a1.s3.a2")
+
+	if len(table.translationTable) != 89 {
+		t.Error("Table size = ", len(table.translationTable), "; want = 89")
+	}
+	if _, exist := table.SearchByNsIP(net.IPv4(10, 18, 0, 5)); exist {
+		t.Error("Removed entry still indexed by NsIP")
+	}
+	if len(table.SearchByJobName("a1.a1.s3.a2")) != 0 || len(table.SearchByServiceIP(net.IPv4(10, 30, 0, 3))) != 0 {
+		t.Error("Removed job still indexed")
+	}
+	for i := 0; i < 100; i++ {
+		if i == 5 || i/10 == 3 {
+			continue
+		}
+		entry, exist := table.SearchByNsIP(net.ParseIP(fmt.Sprintf("fc00::%x", i)))
+		if !exist || !entry.Nsip.Equal(net.IPv4(10, 18, byte(i>>8), byte(i))) {
+			t.Fatal("Entry ", i, " not found by NsIP")
+		}
+		instance := table.SearchByServiceIP(net.ParseIP(fmt.Sprintf("fdff:3000::%x", i)))
+		if len(instance) != 1 || instance[0].Instancenumber != i%10 {
+			t.Fatal("Entry ", i, " not found by instance ServiceIP")
+		}
+	}
+	if len(table.SearchByServiceIP(net.IPv4(10, 30, 0, 0))) != 9 || len(table.SearchByJobName("a1.a1.s0.a2")) != 9 {
+		t.Error("Wrong number of instances of s0")
+	}
+	if len(table.SearchByServiceIP(nil)) != 0 {
+		t.Error("nil ServiceIP matched an entry")
+	}
+}
+
+func BenchmarkSearchByServiceIP(b *testing.B) {
+	table := getFakeTable(50000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.SearchByServiceIP(net.ParseIP(fmt.Sprintf("fdff:2000::%x", i%5000)))
+	}
+}
+
+func BenchmarkSearchByNsIP(b *testing.B) {
+	table := getFakeTable(50000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.SearchByNsIP(net.IPv4(10, 18, byte(i%50000>>8), byte(i%50000)))
+	}
+}
+
+func BenchmarkSearchByJobName(b *testing.B) {
+	table := getFakeTable(50000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.SearchByJobName(fmt.Sprintf("a1.a1.s%d.a2", i%5000))
+	}
+}
+
+func BenchmarkAddRemove(b *testing.B) {
+	table := getFakeTable(50000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		entry := getFakeTableEntry(i % 50000)
+		_ = table.RemoveByNsip(entry.Nsip)
+		_ = table.Add(entry)
+	}
+}
+
+func TestTableExpireIdle(t *testing.T) {
+	table := getFakeTable(30)
+	// entries 0-19 unused for an hour, entries 20-29 just used
+	for i := 0; i < 20; i++ {
+		table.lastUsed[i] = time.Now().Add(-time.Hour).UnixNano()
+	}
+	table.SearchByNsIP(net.IPv4(10, 18, 0, 25))
+
+	// instances 0-4 are deployed locally
+	protect := func(entry TableEntry) bool {
+		return entry.Servicename == "s0" && entry.Instancenumber < 5
+	}
+	expired := table.ExpireIdle(time.Minute, protect)
+	if len(expired) != 15 {
+		t.Error("Expired ", len(expired), " entries; want = 15")
+	}
+	if len(table.translationTable) != 15 || len(table.lastUsed) != 15 {
+		t.Error("Table size = ", len(table.translationTable), "; want = 15")
+	}
+	if len(table.SearchByJobName("a1.a1.s0.a2")) != 5 || len(table.SearchByJobName("a1.a1.s1.a2")) != 0 {
+		t.Error("Protected entries expired")
+	}
+	if len(table.SearchByServiceIP(net.IPv4(10, 30, 0, 2))) != 10 {
+		t.Error("Used entries expired")
+	}
+
+	// lookups keep the entries alive
+	table.SearchByServiceIP(net.IPv4(10, 30, 0, 0))
+	if len(table.ExpireIdle(time.Minute, nil)) != 0 {
+		t.Error("Recently used entries expired")
+	}
+}
+
+func TestTableApplyDiff(t *testing.T) {
+	table := getFakeTable(10)
+	job := "a1.a1.s0.a2"
+
+	diff := TableDiff{JobName: job, Version: 2, Removed: []int{3}}
+	if err := table.ApplyDiff(diff); err != ErrVersionGap {
+		t.Error("Diff applied on an unversioned job")
+	}
+	table.SetJobVersion(job, 1)
+
+	changed := getFakeTableEntry(4)
+	changed.Nodeip = net.ParseIP("10.30.0.2")
+	added := getFakeTableEntry(20)
+	added.JobName, added.Servicename, added.Instancenumber = job, "s0", 10
+	diff.Changed = []TableEntry{changed}
+	diff.Added = []TableEntry{added}
+	if err := table.ApplyDiff(diff); err != nil {
+		t.Error(err)
+	}
+	if len(table.SearchByJobName(job)) != 10 {
+		t.Error("Job size = ", len(table.SearchByJobName(job)), "; want = 10")
+	}
+	if _, exist := table.SearchByNsIP(net.IPv4(10, 18, 0, 3)); exist {
+		t.Error("Removed instance still present")
+	}
+	if entry, _ := table.SearchByNsIP(net.IPv4(10, 18, 0, 4)); !entry.Nodeip.Equal(net.ParseIP("10.30.0.2")) {
+		t.Error("Changed instance not updated")
+	}
+	if version, _ := table.JobVersion(job); version != 2 {
+		t.Error("Version = ", version, "; want = 2")
+	}
+
+	// duplicated diffs are ignored, missing versions require a resync
+	diff.Removed = []int{5}
+	if err := table.ApplyDiff(diff); err != nil || len(table.SearchByJobName(job)) != 10 {
+		t.Error("Stale diff applied")
+	}
+	diff.Version = 4
+	if err := table.ApplyDiff(diff); err != ErrVersionGap {
+		t.Error("Version gap not detected")
+	}
+
+	// a single invalid entry rejects the whole diff
+	invalid := getFakeTableEntry(6)
+	invalid.ServiceIP = nil
+	diff = TableDiff{JobName: job, Version: 3, Removed: []int{5}, Changed: []TableEntry{invalid}}
+	if err := table.ApplyDiff(diff); err == nil {
+		t.Error("Invalid diff applied")
+	}
+	if _, exist := table.SearchByNsIP(net.IPv4(10, 18, 0, 5)); !exist {
+		t.Error("Invalid diff partially applied")
+	}
+}
+
+func TestTableReplaceJob(t *testing.T) {
+	table := getFakeTable(20)
+	job := "a1.a1.s0.a2"
+	serviceIP := net.IPv4(10, 30, 0, 0)
+
+	replacement := make([]TableEntry, 0)
+	for i := 0; i < 5; i++ {
+		entry := getFakeTableEntry(i)
+		entry.Nodeport = 2000
+		replacement = append(replacement, entry)
+	}
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			if len(table.SearchByServiceIP(serviceIP)) == 0 {
+				t.Error("Lookup observed the job without instances")
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if err := table.ReplaceJob(job, replacement); err != nil {
+			t.Error(err)
+		}
+	}
+	<-done
+
+	entries := table.SearchByJobName(job)
+	if len(entries) != 5 || entries[0].Nodeport != 2000 {
+		t.Error("Job not replaced, size = ", len(entries))
+	}
+	if len(table.SearchByJobName("a1.a1.s1.a2")) != 10 {
+		t.Error("Other jobs changed")
+	}
+
+	invalid := append([]TableEntry{}, getFakeTableEntry(0), getFakeTableEntry(1))
+	invalid[1].Nsip = nil
+	if err := table.ReplaceJob(job, invalid); err == nil {
+		t.Error("Invalid batch accepted")
+	}
+	if len(table.SearchByJobName(job)) != 5 {
+		t.Error("Invalid batch partially applied")
+	}
+}
+
+func TestTableReplaceJobVersion(t *testing.T) {
+	table := getFakeTable(10)
+	job := "a1.a1.s0.a2"
+
+	if err := table.ReplaceJob(job, []TableEntry{getFakeTableEntry(0), getFakeTableEntry(1)}, 3); err != nil {
+		t.Fatal(err)
+	}
+	if version, known := table.JobVersion(job); !known || version != 3 {
+		t.Error("version = ", version, "; want = 3")
+	}
+	// a newer diff applied before an older resync answer
+	if err := table.ApplyDiff(TableDiff{JobName: job, Version: 4, Removed: []int{1}}); err != nil {
+		t.Fatal(err)
+	}
+	err := table.ReplaceJob(job, []TableEntry{getFakeTableEntry(0), getFakeTableEntry(1)}, 3)
+	if !errors.Is(err, ErrStaleVersion) {
+		t.Error("err = ", err, "; want = ", ErrStaleVersion)
+	}
+	if version, _ := table.JobVersion(job); version != 4 || len(table.SearchByJobName(job)) != 1 {
+		t.Error("Stale resync applied, version = ", version)
+	}
+
+	// an unversioned answer leaves the job unversioned
+	if err := table.ReplaceJob(job, []TableEntry{getFakeTableEntry(0)}); err != nil {
+		t.Error(err)
+	}
+	if _, known := table.JobVersion(job); known {
+		t.Error("Unversioned job has a version")
+	}
+}
+
+func TestTableValidationPolicy(t *testing.T) {
+	entry := getFakeTableEntry(1)
+	entry.Appname = "averylongappname"
+	entry.Nsipv6 = nil
+
+	err := getFakeTable(0).Add(entry)
+	if !errors.Is(err, ErrInvalidEntry) || !strings.Contains(err.Error(), "appname") {
+		t.Error("Long appname accepted by the default policy, err = ", err)
+	}
+
+	policy := DefaultValidationPolicy()
+	policy.MaxNameLength = 30
+	policy.AddressFamily = IPv4Only
+	policy.Validators = append(policy.Validators, func(entry TableEntry) error {
+		if entry.Nodeport == 0 {
+			return errors.New("missing nodeport")
+		}
+		return nil
+	})
+	table := NewTableManager(policy)
+	if err := table.Add(entry); err != nil {
+		t.Error(err)
+	}
+
+	entry.Nsip = nil
+	if err := table.Add(entry); err == nil || !strings.Contains(err.Error(), "nsip") {
+		t.Error("Entry without IPv4 address accepted, err = ", err)
+	}
+
+	entry = getFakeTableEntry(2)
+	entry.Nodeport = 0
+	if err := table.Add(entry); !errors.Is(err, ErrInvalidEntry) || !strings.Contains(err.Error(), "missing nodeport") {
+		t.Error("Custom validator not applied, err = ", err)
+	}
+}
+
+func TestTableWatch(t *testing.T) {
+	table := getFakeTable(0)
+	changes, stop := table.Watch()
+	job := "a1.a1.s0.a2"
+
+	_ = table.Add(getFakeTableEntry(1))
+	_ = table.Add(getFakeTableEntry(2))
+	table.SetJobVersion(job, 1)
+	changed := getFakeTableEntry(1)
+	changed.Nodeport = 2000
+	_ = table.ApplyDiff(TableDiff{JobName: job, Version: 2, Changed: []TableEntry{changed}, Removed: []int{2}})
+
+	expected := []struct {
+		changeType ChangeType
+		instance   int
+	}{{EntryAdded, 1}, {EntryAdded, 2}, {EntryRemoved, 2}, {EntryUpdated, 1}}
+	for _, want := range expected {
+		change := <-changes
+		if change.Type != want.changeType || change.Entry.Instancenumber != want.instance {
+			t.Error("Change = ", change.Type, change.Entry.Instancenumber, "; want = ", want.changeType, want.instance)
+		}
+	}
+	stop()
+	stop()
+	_ = table.Add(getFakeTableEntry(3))
+	if _, open := <-changes; open {
+		t.Error("Change received after stop")
+	}
+}
+
+func TestTableWatchSlowConsumer(t *testing.T) {
+	WATCH_BUFFER_SIZE = 2
+	defer func() { WATCH_BUFFER_SIZE = 256 }()
+	table := getFakeTable(0)
+	changes, stop := table.Watch()
+	defer stop()
+
+	// writers never wait for the watcher
+	for i := 0; i < 5; i++ {
+		_ = table.Add(getFakeTableEntry(i))
+	}
+	<-changes
+	<-changes
+	_ = table.RemoveByNsip(net.IPv4(10, 18, 0, 0))
+	if change := <-changes; change.Type != ChangesLost {
+		t.Error("Lost changes not notified")
+	}
+	if change := <-changes; change.Type != EntryRemoved {
+		t.Error("Change = ", change.Type, "; want = ", EntryRemoved)
+	}
+}
+
+func TestTableStaticEntries(t *testing.T) {
+	table := getFakeTable(10)
+	static := getFakeTableEntry(20)
+	if err := table.AddStatic(static); err != nil {
+		t.Error(err)
+	}
+	// replaces the entry with the same namespace IP
+	static.Nodeport = 2000
+	_ = table.AddStatic(static)
+	if len(table.StaticEntries()) != 1 || table.StaticEntries()[0].Nodeport != 2000 {
+		t.Error("Static entry not replaced")
+	}
+	if !table.IsStaticJob("a1.a1.s2.a2") || table.IsStaticJob("a1.a1.s0.a2") {
+		t.Error("Wrong static jobs")
+	}
+
+	for i := range table.lastUsed {
+		table.lastUsed[i] = 0
+	}
+	if expired := table.ExpireIdle(time.Minute, nil); len(expired) != 10 {
+		t.Error("Expired ", len(expired), " entries; want = 10")
+	}
+	if len(table.SearchByJobName("a1.a1.s2.a2")) != 1 {
+		t.Error("Static entry expired")
+	}
+
+	if table.RemoveStatic(getFakeTableEntry(1).Nsip) == nil {
+		t.Error("Removed a non static entry")
+	}
+	if err := table.RemoveStatic(static.Nsip); err != nil {
+		t.Error(err)
+	}
+	if len(table.StaticEntries()) != 0 || table.IsStatic(static) {
+		t.Error("Static entry not removed")
+	}
+}
+
+func TestStaticEntriesFile(t *testing.T) {
+	path := t.TempDir() + "/static.json"
+	entries := []TableEntry{getFakeTableEntry(1), getFakeTableEntry(2)}
+	if err := SaveStaticEntries(path, entries); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadStaticEntries(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 2 || !loaded[1].Nsip.Equal(entries[1].Nsip) || loaded[1].ServiceIP[0].IpType != RoundRobin {
+		t.Error("Loaded entries = ", loaded)
+	}
+	table := getFakeTable(0)
+	for _, entry := range loaded {
+		if err := table.AddStatic(entry); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestTableStaticEntriesNotReplaced(t *testing.T) {
+	table := getFakeTable(10)
+	static := getFakeTableEntry(20)
+	if err := table.AddStatic(static); err != nil {
+		t.Fatal(err)
+	}
+
+	// an entry of another job reusing the namespace IP of the static one, by IPv4 or by IPv6
+	byIPv4 := getFakeTableEntry(0)
+	byIPv4.Nsip = static.Nsip
+	if err := table.ReplaceJob("a1.a1.s0.a2", []TableEntry{byIPv4}); err != nil {
+		t.Fatal(err)
+	}
+	table.SetJobVersion("a1.a1.s0.a2", 1)
+	byIPv6 := getFakeTableEntry(1)
+	byIPv6.Nsipv6 = static.Nsipv6
+	if err := table.ApplyDiff(TableDiff{JobName: "a1.a1.s0.a2", Version: 2, Added: []TableEntry{byIPv6}}); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, exist := table.SearchByNsIP(static.Nsip)
+	if !exist || entry.JobName != static.JobName || !table.IsStatic(entry) {
+		t.Error("Static entry replaced by ", entry)
+	}
+	if entry, exist := table.SearchByNsIP(static.Nsipv6); !exist || entry.JobName != static.JobName {
+		t.Error("Static entry replaced by ", entry)
+	}
+	if len(table.SearchByJobName("a1.a1.s0.a2")) != 0 {
+		t.Error("Clashing entries must be ignored")
+	}
+}
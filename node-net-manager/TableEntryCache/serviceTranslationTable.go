@@ -2,9 +2,12 @@ package TableEntryCache
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type TableEntry struct {
@@ -20,6 +23,9 @@ type TableEntry struct {
 	Nsip             net.IP      `json:"nsip"`
 	Nsipv6           net.IP      `json:"nsipv6"`
 	ServiceIP        []ServiceIP `json:"serviceIP"`
+	Weight           int         `json:"weight"`
+	// ports exposed by the instance on its service IPs, empty if not announced by the cluster
+	Ports []ServicePort `json:"ports,omitempty"`
 }
 
 type ServiceIpType int
@@ -36,27 +42,122 @@ type ServiceIP struct {
 	Address_v6 net.IP        `json:"address_v6"`
 }
 
+type ServicePort struct {
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
 type TableManager struct {
 	translationTable []TableEntry
-	rwlock           sync.RWMutex
+	// last time each entry has been used by a lookup, in unix nanoseconds
+	lastUsed []int64
+	// secondary indexes, positions of the entries in the translationTable
+	byServiceIP map[[16]byte][]int
+	byNsIP      map[[16]byte][]int
+	byJobName   map[string][]int
+	// version of the entries of each job, as announced by the cluster
+	versions map[string]uint64
+	// namespace IPs of the entries added with AddStatic
+	static   map[[16]byte]bool
+	policy   ValidationPolicy
+	watchers *watchers
+	rwlock   sync.RWMutex
+}
+
+// TableDiff is an incremental update of the instances of a job. Removed contains instance numbers.
+type TableDiff struct {
+	JobName string
+	Version uint64
+	Added   []TableEntry
+	Changed []TableEntry
+	Removed []int
 }
 
-func NewTableManager() TableManager {
+// ErrVersionGap is returned when a diff doesn't follow the known version of the job, a full resync is needed
+var ErrVersionGap = errors.New("table version gap")
+
+// ErrStaleVersion is returned when the entries of a job are older than its known version
+var ErrStaleVersion = errors.New("table version older than the known one")
+
+// NewTableManager creates an empty table, entries are validated with the DefaultValidationPolicy unless a policy is given
+func NewTableManager(policy_optional ...ValidationPolicy) TableManager {
+	policy := DefaultValidationPolicy()
+	if len(policy_optional) > 0 {
+		policy = policy_optional[0]
+	}
 	return TableManager{
 		translationTable: make([]TableEntry, 0),
+		lastUsed:         make([]int64, 0),
+		byServiceIP:      make(map[[16]byte][]int),
+		byNsIP:           make(map[[16]byte][]int),
+		byJobName:        make(map[string][]int),
+		versions:         make(map[string]uint64),
+		static:           make(map[[16]byte]bool),
+		policy:           policy,
+		watchers:         newWatchers(),
 		rwlock:           sync.RWMutex{},
 	}
-	//TODO cleanup of old entry every X seconds
 }
 
 func (t *TableManager) Add(entry TableEntry) error {
-	if t.isValid(entry) {
-		t.rwlock.Lock()
-		defer t.rwlock.Unlock()
-		t.translationTable = append(t.translationTable, entry)
-		return nil
+	if err := t.validate(entry); err != nil {
+		return err
+	}
+	t.rwlock.Lock()
+	defer t.rwlock.Unlock()
+	t.add(entry)
+	return nil
+}
+
+func (t *TableManager) add(entry TableEntry) {
+	t.translationTable = append(t.translationTable, entry)
+	t.lastUsed = append(t.lastUsed, time.Now().UnixNano())
+	t.index(len(t.translationTable) - 1)
+	t.notify(EntryAdded, entry)
+}
+
+// upsert replaces the entry of the same instance, or adds it. An entry of another instance using the same
+// namespace IP is removed first, the address may have been reused. Entries clashing with a static entry are
+// ignored and the previous entry of the instance removed, the static entries are never replaced by the cluster.
+func (t *TableManager) upsert(entry TableEntry) {
+	position := t.findPosition(entry.JobName, func(current TableEntry) bool {
+		return current.Instancenumber == entry.Instancenumber
+	})
+	if t.clashesWithStatic(entry) {
+		log.Printf("TranslationTable: ignoring %s.%d, its namespace IP belongs to a static entry", entry.JobName, entry.Instancenumber)
+		if position > -1 && !t.isStatic(t.translationTable[position]) {
+			_ = t.removeByIndex(position)
+		}
+		return
+	}
+	if key, ok := ipIndexKey(entry.Nsip); ok && len(t.byNsIP[key]) > 0 {
+		current := t.translationTable[t.byNsIP[key][0]]
+		if current.JobName != entry.JobName || current.Instancenumber != entry.Instancenumber {
+			_ = t.removeByIndex(t.byNsIP[key][0])
+		}
+	}
+	// the removal may have moved the entry of the instance
+	position = t.findPosition(entry.JobName, func(current TableEntry) bool {
+		return current.Instancenumber == entry.Instancenumber
+	})
+	if position < 0 {
+		t.add(entry)
+		return
+	}
+	t.unindex(position)
+	t.translationTable[position] = entry
+	t.index(position)
+	t.notify(EntryUpdated, entry)
+}
+
+// findPosition returns the position of the first entry of the job matching the predicate, -1 if none
+func (t *TableManager) findPosition(jobname string, match func(entry TableEntry) bool) int {
+	for _, position := range t.byJobName[jobname] {
+		if match(t.translationTable[position]) {
+			return position
+		}
 	}
-	return errors.New("InvalidEntry")
+	return -1
 }
 
 // remove by Namespace IP, which can be either in IPv4 or IPv6 format
@@ -66,12 +167,8 @@ func (t *TableManager) RemoveByNsip(nsip net.IP) error {
 	defer t.rwlock.Unlock()
 
 	found := -1
-	// this will need to be optimised for IPv6, since that will be hell performance wise
-	for i, tableElement := range t.translationTable {
-		if tableElement.Nsip.Equal(nsip) || tableElement.Nsipv6.Equal(nsip) {
-			found = i
-			break
-		}
+	if key, ok := ipIndexKey(nsip); ok && len(t.byNsIP[key]) > 0 {
+		found = t.byNsIP[key][0]
 	}
 
 	return t.removeByIndex(found)
@@ -81,123 +178,282 @@ func (t *TableManager) RemoveByJobName(jobname string) error {
 	t.rwlock.Lock()
 	defer t.rwlock.Unlock()
 
-	elems := len(t.translationTable)
-	for i := 0; i < elems; i++ {
-		if t.translationTable[i].JobName == jobname {
-			err := t.removeByIndex(i)
-			if err != nil {
-				return err
-			}
-			elems = elems - 1
-			i = i - 1
+	delete(t.versions, jobname)
+	for len(t.byJobName[jobname]) > 0 {
+		err := t.removeByIndex(t.byJobName[jobname][0])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplaceJob swaps all the entries of a job in a single critical section, lookups never see the job empty.
+// The whole batch is rejected if any entry is invalid. The optional version is recorded with the entries,
+// ErrStaleVersion is returned if the job is already at a newer version. Without a version the job is unversioned.
+func (t *TableManager) ReplaceJob(jobname string, entries []TableEntry, version_optional ...uint64) error {
+	version := uint64(0)
+	if len(version_optional) > 0 {
+		version = version_optional[0]
+	}
+	for _, entry := range entries {
+		if entry.JobName != jobname {
+			return fmt.Errorf("%w: entry of %s in the batch of %s", ErrInvalidEntry, entry.JobName, jobname)
+		}
+		if err := t.validate(entry); err != nil {
+			return err
+		}
+	}
+
+	t.rwlock.Lock()
+	defer t.rwlock.Unlock()
+
+	if current, known := t.versions[jobname]; known && version > 0 && version < current {
+		return ErrStaleVersion
+	}
+	delete(t.versions, jobname)
+	if version > 0 {
+		t.versions[jobname] = version
+	}
+	instances := make(map[int]bool)
+	for _, entry := range entries {
+		instances[entry.Instancenumber] = true
+	}
+	stale := func(entry TableEntry) bool {
+		return !instances[entry.Instancenumber] && !t.isStatic(entry)
+	}
+	for position := t.findPosition(jobname, stale); position > -1; position = t.findPosition(jobname, stale) {
+		_ = t.removeByIndex(position)
+	}
+	for _, entry := range entries {
+		t.upsert(entry)
+	}
+	return nil
+}
+
+// SetJobVersion records the version of the entries of a job after a full table query
+func (t *TableManager) SetJobVersion(jobname string, version uint64) {
+	t.rwlock.Lock()
+	defer t.rwlock.Unlock()
+	t.versions[jobname] = version
+}
+
+// JobVersion returns the version of the entries of a job, false if unknown
+func (t *TableManager) JobVersion(jobname string) (uint64, bool) {
+	t.rwlock.RLock()
+	defer t.rwlock.RUnlock()
+	version, known := t.versions[jobname]
+	return version, known
+}
+
+// ApplyDiff applies the diff at once, lookups never see a partially updated job.
+// Diffs older than the known version are ignored, ErrVersionGap is returned if the diff doesn't follow it.
+func (t *TableManager) ApplyDiff(diff TableDiff) error {
+	updated := make([]TableEntry, 0, len(diff.Changed)+len(diff.Added))
+	updated = append(append(updated, diff.Changed...), diff.Added...)
+	for _, entry := range updated {
+		if entry.JobName != diff.JobName {
+			return fmt.Errorf("%w: entry of %s in the batch of %s", ErrInvalidEntry, entry.JobName, diff.JobName)
+		}
+		if err := t.validate(entry); err != nil {
+			return err
 		}
 	}
+
+	t.rwlock.Lock()
+	defer t.rwlock.Unlock()
+
+	current, known := t.versions[diff.JobName]
+	if !known || diff.Version > current+1 {
+		return ErrVersionGap
+	}
+	if diff.Version <= current {
+		return nil
+	}
+
+	for _, instance := range diff.Removed {
+		position := t.findPosition(diff.JobName, func(entry TableEntry) bool {
+			return entry.Instancenumber == instance
+		})
+		_ = t.removeByIndex(position)
+	}
+	for _, entry := range updated {
+		t.upsert(entry)
+	}
+	t.versions[diff.JobName] = diff.Version
 	return nil
 }
 
+// the last entry takes the place of the removed one, its positions in the indexes are updated accordingly
 func (t *TableManager) removeByIndex(index int) error {
 	if index > -1 {
-		t.translationTable[index] = t.translationTable[len(t.translationTable)-1]
-		t.translationTable = t.translationTable[:len(t.translationTable)-1]
+		removed := t.translationTable[index]
+		last := len(t.translationTable) - 1
+		t.unindex(index)
+		if index != last {
+			t.unindex(last)
+			t.translationTable[index] = t.translationTable[last]
+			t.lastUsed[index] = t.lastUsed[last]
+			t.index(index)
+		}
+		t.translationTable = t.translationTable[:last]
+		t.lastUsed = t.lastUsed[:last]
+		if key, ok := staticKey(removed); ok {
+			delete(t.static, key)
+		}
+		t.notify(EntryRemoved, removed)
 		return nil
 	}
 	return errors.New("Entry not found")
 }
 
 func (t *TableManager) SearchByServiceIP(ip net.IP) []TableEntry {
-	//log.Println("Table research, table length: ", len(t.translationTable))
-	//log.Println(t.translationTable)
+	t.rwlock.RLock()
+	defer t.rwlock.RUnlock()
 	result := make([]TableEntry, 0)
-	t.rwlock.Lock()
-	defer t.rwlock.Unlock()
-	for _, tableElement := range t.translationTable {
-		for _, elemip := range tableElement.ServiceIP {
-			if elemip.Address.Equal(ip) || elemip.Address_v6.Equal(ip) {
-				returnEntry := tableElement
-				result = append(result, returnEntry)
-			}
-		}
+	key, ok := ipIndexKey(ip)
+	if !ok {
+		return result
+	}
+	for _, position := range t.byServiceIP[key] {
+		t.touch(position)
+		result = append(result, t.translationTable[position])
 	}
 	return result
 }
 
 func (t *TableManager) SearchByNsIP(ip net.IP) (TableEntry, bool) {
-	t.rwlock.Lock()
-	defer t.rwlock.Unlock()
-	for _, tableElement := range t.translationTable {
-		if tableElement.Nsip.Equal(ip) || tableElement.Nsipv6.Equal(ip) {
-			returnEntry := tableElement
-			return returnEntry, true
-		}
+	t.rwlock.RLock()
+	defer t.rwlock.RUnlock()
+	key, ok := ipIndexKey(ip)
+	if !ok || len(t.byNsIP[key]) == 0 {
+		return TableEntry{}, false
 	}
-	return TableEntry{}, false
+	t.touch(t.byNsIP[key][0])
+	return t.translationTable[t.byNsIP[key][0]], true
 }
 
 func (t *TableManager) SearchByJobName(jobname string) []TableEntry {
-	t.rwlock.Lock()
-	defer t.rwlock.Unlock()
+	t.rwlock.RLock()
+	defer t.rwlock.RUnlock()
 	results := make([]TableEntry, 0)
-	for _, tableElement := range t.translationTable {
-		if tableElement.JobName == jobname {
-			results = append(results, tableElement)
-		}
+	for _, position := range t.byJobName[jobname] {
+		results = append(results, t.translationTable[position])
 	}
 	return results
 }
 
-// Sanity check for Appname and namespace
-// 0<len(Appname)<11
-// 0<len(Appns)<11
-// 0<len(Servicename)<11
-// 0<len(Servicenamespace)<11
-// Instancenumber>0
-// Cluster>0
-// Nodeip != nil
-// Nsip != nil
-// Nsipv6 != nil
-// len(entry.ServiceIP)>0
-func (t *TableManager) isValid(entry TableEntry) bool {
-	if l := len(entry.Appname); l < 1 || l > 10 {
-		log.Println("TranslationTable: Invalid Entry, wrong appname:", entry.Appname)
-		return false
+// Entries returns a copy of all the entries of the table
+func (t *TableManager) Entries() []TableEntry {
+	t.rwlock.RLock()
+	defer t.rwlock.RUnlock()
+	result := make([]TableEntry, len(t.translationTable))
+	copy(result, t.translationTable)
+	return result
+}
+
+// ExpireIdle removes the entries not used for longer than ttl, except the static ones and the ones protected by the
+// predicate.
+// Returns the removed entries.
+func (t *TableManager) ExpireIdle(ttl time.Duration, protect func(entry TableEntry) bool) []TableEntry {
+	t.rwlock.Lock()
+	defer t.rwlock.Unlock()
+	expired := make([]TableEntry, 0)
+	deadline := time.Now().Add(-ttl).UnixNano()
+	for i := len(t.translationTable) - 1; i >= 0; i-- {
+		if atomic.LoadInt64(&t.lastUsed[i]) >= deadline || t.isStatic(t.translationTable[i]) ||
+			protect != nil && protect(t.translationTable[i]) {
+			continue
+		}
+		expired = append(expired, t.translationTable[i])
+		// the entry moved in place of the removed one has already been checked
+		_ = t.removeByIndex(i)
 	}
-	if l := len(entry.Appns); l < 1 || l > 10 {
-		log.Println("TranslationTable: Invalid Entry, wrong appns:", entry.Appns)
-		return false
+	return expired
+}
+
+// touch marks the entry as used, lookups only hold the read lock
+func (t *TableManager) touch(position int) {
+	atomic.StoreInt64(&t.lastUsed[position], time.Now().UnixNano())
+}
+
+// IPv4 and IPv6 addresses are indexed in their 16 bytes form, nil addresses are not indexed
+func ipIndexKey(ip net.IP) ([16]byte, bool) {
+	var key [16]byte
+	if ip16 := ip.To16(); ip16 != nil {
+		copy(key[:], ip16)
+		return key, true
 	}
-	if l := len(entry.Servicename); l < 1 || l > 10 {
-		log.Println("TranslationTable: Invalid Entry, wrong servicename:", entry.Servicename)
-		return false
+	return key, false
+}
+
+// index adds the entry at the given position to the secondary indexes
+func (t *TableManager) index(position int) {
+	if t.byServiceIP == nil {
+		t.byServiceIP = make(map[[16]byte][]int)
+		t.byNsIP = make(map[[16]byte][]int)
+		t.byJobName = make(map[string][]int)
 	}
-	if l := len(entry.Servicenamespace); l < 1 || l > 10 {
-		log.Println("TranslationTable: Invalid Entry, wrong servicens:", entry.Servicenamespace)
-		return false
+	entry := t.translationTable[position]
+	for _, sip := range entry.ServiceIP {
+		for _, ip := range []net.IP{sip.Address, sip.Address_v6} {
+			if key, ok := ipIndexKey(ip); ok {
+				t.byServiceIP[key] = append(t.byServiceIP[key], position)
+			}
+		}
 	}
-	if entry.Instancenumber < 0 {
-		log.Println("TranslationTable: Invalid Entry, wrong instancenumber")
-		return false
+	for _, ip := range []net.IP{entry.Nsip, entry.Nsipv6} {
+		if key, ok := ipIndexKey(ip); ok {
+			t.byNsIP[key] = append(t.byNsIP[key], position)
+		}
 	}
-	if entry.Cluster < 0 {
-		log.Println("TranslationTable: Invalid Entry, wrong cluster")
-		return false
+	t.byJobName[entry.JobName] = append(t.byJobName[entry.JobName], position)
+}
+
+// unindex removes the entry at the given position from the secondary indexes
+func (t *TableManager) unindex(position int) {
+	entry := t.translationTable[position]
+	for _, sip := range entry.ServiceIP {
+		for _, ip := range []net.IP{sip.Address, sip.Address_v6} {
+			if key, ok := ipIndexKey(ip); ok {
+				t.byServiceIP[key] = removePosition(t.byServiceIP[key], position)
+				if len(t.byServiceIP[key]) == 0 {
+					delete(t.byServiceIP, key)
+				}
+			}
+		}
 	}
-	if entry.Nodeip == nil {
-		log.Println("TranslationTable: Invalid Entry, wrong nodeip")
-		return false
+	for _, ip := range []net.IP{entry.Nsip, entry.Nsipv6} {
+		if key, ok := ipIndexKey(ip); ok {
+			t.byNsIP[key] = removePosition(t.byNsIP[key], position)
+			if len(t.byNsIP[key]) == 0 {
+				delete(t.byNsIP, key)
+			}
+		}
 	}
-	if entry.Nsip == nil {
-		log.Println("TranslationTable: Invalid Entry, wrong nsip")
-		return false
+	t.byJobName[entry.JobName] = removePosition(t.byJobName[entry.JobName], position)
+	if len(t.byJobName[entry.JobName]) == 0 {
+		delete(t.byJobName, entry.JobName)
 	}
-	if entry.Nsipv6 == nil {
-		log.Println("TranslationTable: Invalid Entry, wrong nsipv6")
-		return false
+}
+
+// removes the first occurrence of the position, keeping the order of the others
+func removePosition(positions []int, position int) []int {
+	for i, current := range positions {
+		if current == position {
+			return append(positions[:i], positions[i+1:]...)
+		}
 	}
-	if len(entry.ServiceIP) < 1 {
-		log.Println("TranslationTable: Invalid Entry, wrong serviceip")
-		return false
+	return positions
+}
+
+// validate checks the entry against the validation policy of the table
+func (t *TableManager) validate(entry TableEntry) error {
+	err := t.policy.Validate(entry)
+	if err != nil {
+		log.Println("TranslationTable:", err)
 	}
-	return true
+	return err
 }
 
 func IsNamespaceStillValid(nsip net.IP, table *[]TableEntry) bool {
@@ -208,3 +464,15 @@ func IsNamespaceStillValid(nsip net.IP, table *[]TableEntry) bool {
 	}
 	return false
 }
+
+// GetServiceIpType returns the balancing policy of the given ServiceIP, false if no entry exposes that address
+func GetServiceIpType(ip net.IP, table *[]TableEntry) (ServiceIpType, bool) {
+	for _, entry := range *table {
+		for _, sip := range entry.ServiceIP {
+			if sip.Address.Equal(ip) || sip.Address_v6.Equal(ip) {
+				return sip.IpType, true
+			}
+		}
+	}
+	return InstanceNumber, false
+}
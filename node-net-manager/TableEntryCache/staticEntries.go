@@ -0,0 +1,118 @@
+package TableEntryCache
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+)
+
+// LoadStaticEntries reads a JSON list of entries, e.g. the infrastructure services of the node
+func LoadStaticEntries(path string) ([]TableEntry, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]TableEntry, 0)
+	err = json.Unmarshal(content, &entries)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// SaveStaticEntries writes the entries as a JSON list, readable by LoadStaticEntries
+func SaveStaticEntries(path string, entries []TableEntry) error {
+	content, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, content, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// AddStatic adds an entry that never expires, it replaces the entry with the same namespace IP
+func (t *TableManager) AddStatic(entry TableEntry) error {
+	if err := t.validate(entry); err != nil {
+		return err
+	}
+	t.rwlock.Lock()
+	defer t.rwlock.Unlock()
+	key, _ := staticKey(entry)
+	if len(t.byNsIP[key]) > 0 {
+		_ = t.removeByIndex(t.byNsIP[key][0])
+	}
+	t.add(entry)
+	t.static[key] = true
+	return nil
+}
+
+// RemoveStatic removes the static entry with the given namespace IP
+func (t *TableManager) RemoveStatic(nsip net.IP) error {
+	t.rwlock.Lock()
+	defer t.rwlock.Unlock()
+	key, ok := ipIndexKey(nsip)
+	if !ok || !t.static[key] || len(t.byNsIP[key]) == 0 {
+		return errors.New("Entry not found")
+	}
+	return t.removeByIndex(t.byNsIP[key][0])
+}
+
+// StaticEntries returns a copy of the static entries
+func (t *TableManager) StaticEntries() []TableEntry {
+	t.rwlock.RLock()
+	defer t.rwlock.RUnlock()
+	result := make([]TableEntry, 0, len(t.static))
+	for key := range t.static {
+		if positions := t.byNsIP[key]; len(positions) > 0 {
+			result = append(result, t.translationTable[positions[0]])
+		}
+	}
+	return result
+}
+
+// IsStatic returns true if the entry has been added with AddStatic
+func (t *TableManager) IsStatic(entry TableEntry) bool {
+	t.rwlock.RLock()
+	defer t.rwlock.RUnlock()
+	return t.isStatic(entry)
+}
+
+// IsStaticJob returns true if the job has static entries, those jobs are not managed by the cluster
+func (t *TableManager) IsStaticJob(jobname string) bool {
+	t.rwlock.RLock()
+	defer t.rwlock.RUnlock()
+	for _, position := range t.byJobName[jobname] {
+		if t.isStatic(t.translationTable[position]) {
+			return true
+		}
+	}
+	return false
+}
+
+// clashesWithStatic returns true if one of the namespace IPs of the entry belongs to a static entry
+func (t *TableManager) clashesWithStatic(entry TableEntry) bool {
+	for _, ip := range []net.IP{entry.Nsip, entry.Nsipv6} {
+		if key, ok := ipIndexKey(ip); ok && len(t.byNsIP[key]) > 0 && t.isStatic(t.translationTable[t.byNsIP[key][0]]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TableManager) isStatic(entry TableEntry) bool {
+	key, ok := staticKey(entry)
+	return ok && t.static[key]
+}
+
+// staticKey identifies a static entry by its namespace IP, the IPv6 one if the entry is IPv6 only
+func staticKey(entry TableEntry) ([16]byte, bool) {
+	if entry.Nsip != nil {
+		return ipIndexKey(entry.Nsip)
+	}
+	return ipIndexKey(entry.Nsipv6)
+}
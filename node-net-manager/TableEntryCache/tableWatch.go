@@ -0,0 +1,83 @@
+package TableEntryCache
+
+import "sync"
+
+// WATCH_BUFFER_SIZE is the number of changes kept for each watcher, further changes are dropped
+var WATCH_BUFFER_SIZE = 256
+
+type ChangeType int
+
+const (
+	EntryAdded   ChangeType = iota
+	EntryUpdated ChangeType = iota
+	EntryRemoved ChangeType = iota
+	// ChangesLost tells a slow watcher that some changes have been dropped, it must read the table again with Entries
+	ChangesLost ChangeType = iota
+)
+
+type TableChange struct {
+	Type  ChangeType
+	Entry TableEntry
+}
+
+type tableWatcher struct {
+	changes chan TableChange
+	// set when a change has been dropped, cleared once ChangesLost has been delivered
+	lost bool
+}
+
+// watchers is shared by the copies of a TableManager, notify is called with the table write lock held
+type watchers struct {
+	list map[*tableWatcher]bool
+	lock sync.Mutex
+}
+
+func newWatchers() *watchers {
+	return &watchers{
+		list: make(map[*tableWatcher]bool),
+	}
+}
+
+// Watch returns a channel receiving every change of the table, and a function to stop watching.
+// Writers never wait for the watchers: if the channel is full the changes are dropped and ChangesLost is sent
+// as soon as there is room again.
+func (t *TableManager) Watch() (<-chan TableChange, func()) {
+	watcher := &tableWatcher{
+		changes: make(chan TableChange, WATCH_BUFFER_SIZE),
+	}
+	t.watchers.lock.Lock()
+	t.watchers.list[watcher] = true
+	t.watchers.lock.Unlock()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			t.watchers.lock.Lock()
+			delete(t.watchers.list, watcher)
+			t.watchers.lock.Unlock()
+			close(watcher.changes)
+		})
+	}
+	return watcher.changes, stop
+}
+
+func (t *TableManager) notify(changeType ChangeType, entry TableEntry) {
+	t.watchers.lock.Lock()
+	defer t.watchers.lock.Unlock()
+	for watcher := range t.watchers.list {
+		if watcher.lost && !watcher.send(TableChange{Type: ChangesLost}) {
+			continue
+		}
+		watcher.lost = !watcher.send(TableChange{Type: changeType, Entry: entry})
+	}
+}
+
+// send delivers the change without waiting, returns false if the watcher is full
+func (watcher *tableWatcher) send(change TableChange) bool {
+	select {
+	case watcher.changes <- change:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,110 @@
+package TableEntryCache
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidEntry is wrapped by all the errors returned for entries rejected by the ValidationPolicy
+var ErrInvalidEntry = errors.New("InvalidEntry")
+
+type AddressFamily int
+
+const (
+	// DualStack requires both the IPv4 and the IPv6 namespace address
+	DualStack AddressFamily = iota
+	IPv4Only  AddressFamily = iota
+	IPv6Only  AddressFamily = iota
+	// AnyFamily requires at least one namespace address
+	AnyFamily AddressFamily = iota
+)
+
+// ValidationPolicy defines the sanity checks performed on every entry added to the table
+type ValidationPolicy struct {
+	// length limits of Appname, Appns, Servicename and Servicenamespace
+	MinNameLength int
+	MaxNameLength int
+	// namespace addresses that must be present
+	AddressFamily AddressFamily
+	// additional checks, run after the built-in ones
+	Validators []func(entry TableEntry) error
+}
+
+// DefaultValidationPolicy accepts names of 1 to 10 characters and requires both namespace addresses
+func DefaultValidationPolicy() ValidationPolicy {
+	return ValidationPolicy{
+		MinNameLength: 1,
+		MaxNameLength: 10,
+		AddressFamily: DualStack,
+		Validators:    make([]func(entry TableEntry) error, 0),
+	}
+}
+
+// Validate returns an error describing the first check failed by the entry
+// Instancenumber>=0
+// Cluster>=0
+// Nodeip != nil
+// Nsip and Nsipv6 as required by the AddressFamily
+// len(entry.ServiceIP)>0
+func (policy ValidationPolicy) Validate(entry TableEntry) error {
+	names := []struct {
+		field string
+		value string
+	}{
+		{"appname", entry.Appname},
+		{"appns", entry.Appns},
+		{"servicename", entry.Servicename},
+		{"servicenamespace", entry.Servicenamespace},
+	}
+	for _, name := range names {
+		if l := len(name.value); l < policy.MinNameLength || l > policy.MaxNameLength {
+			return fmt.Errorf("%w: %s %q must be %d to %d characters long", ErrInvalidEntry, name.field, name.value, policy.MinNameLength, policy.MaxNameLength)
+		}
+	}
+	if entry.Instancenumber < 0 {
+		return fmt.Errorf("%w: negative instancenumber %d", ErrInvalidEntry, entry.Instancenumber)
+	}
+	if entry.Cluster < 0 {
+		return fmt.Errorf("%w: negative cluster %d", ErrInvalidEntry, entry.Cluster)
+	}
+	if entry.Nodeip == nil {
+		return fmt.Errorf("%w: missing nodeip", ErrInvalidEntry)
+	}
+	if err := policy.validateAddresses(entry); err != nil {
+		return err
+	}
+	if len(entry.ServiceIP) < 1 {
+		return fmt.Errorf("%w: missing serviceip", ErrInvalidEntry)
+	}
+	for _, validator := range policy.Validators {
+		if err := validator(entry); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidEntry, err)
+		}
+	}
+	return nil
+}
+
+func (policy ValidationPolicy) validateAddresses(entry TableEntry) error {
+	switch policy.AddressFamily {
+	case IPv4Only:
+		if entry.Nsip == nil {
+			return fmt.Errorf("%w: missing nsip", ErrInvalidEntry)
+		}
+	case IPv6Only:
+		if entry.Nsipv6 == nil {
+			return fmt.Errorf("%w: missing nsipv6", ErrInvalidEntry)
+		}
+	case AnyFamily:
+		if entry.Nsip == nil && entry.Nsipv6 == nil {
+			return fmt.Errorf("%w: missing both nsip and nsipv6", ErrInvalidEntry)
+		}
+	default:
+		if entry.Nsip == nil {
+			return fmt.Errorf("%w: missing nsip", ErrInvalidEntry)
+		}
+		if entry.Nsipv6 == nil {
+			return fmt.Errorf("%w: missing nsipv6", ErrInvalidEntry)
+		}
+	}
+	return nil
+}
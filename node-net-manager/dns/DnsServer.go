@@ -0,0 +1,511 @@
+package dns
+
+import (
+	"NetManager/TableEntryCache"
+	"NetManager/logger"
+	"NetManager/mqtt"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// DNS_PORT is the port the server listens to on each address
+var DNS_PORT = 53
+
+// DNS_TTL is the TTL of the service records, in seconds. Kept short, the instances of a service change often.
+var DNS_TTL uint32 = 30
+
+// UPSTREAM_TIMEOUT is the time waited for each upstream server before trying the next one
+var UPSTREAM_TIMEOUT = 2 * time.Second
+
+// RESOLV_CONF is read to find the upstream servers of the node
+var RESOLV_CONF = "/etc/resolv.conf"
+
+const maxMessageSize = 4096
+
+// largest response to a client without EDNS
+const udpMessageSize = 512
+
+// Resolver returns the table entries known by the node. The lookups only search the local table, an unknown job is
+// resolved with the cluster and answered once resolved.
+type Resolver interface {
+	LookupTableEntryByJobName(jobname string) []TableEntryCache.TableEntry
+	ResolveJobName(jobname string, callback func([]TableEntryCache.TableEntry))
+	GetTableEntryByNsIP(ip net.IP) (TableEntryCache.TableEntry, bool)
+	LookupTableEntryByServiceIP(ip net.IP) []TableEntryCache.TableEntry
+}
+
+// Server answers the queries for the service names, servicename.servicenamespace.appname.appns:
+//   - A/AAAA with the RoundRobin and Closest service IPs of the service
+//   - A/AAAA of instancenumber.servicename.servicenamespace.appname.appns with the InstanceNumber service IP
+//   - SRV with the exposed ports of each instance, targeting the instance names
+//   - PTR of the namespace and service IPs
+//
+// The other names are forwarded to the upstream servers.
+type Server struct {
+	resolver  Resolver
+	upstreams []string
+	conns     []*net.UDPConn
+	lock      sync.Mutex
+}
+
+func NewServer(resolver Resolver, upstreams []string) *Server {
+	return &Server{
+		resolver:  resolver,
+		upstreams: upstreams,
+		conns:     make([]*net.UDPConn, 0),
+	}
+}
+
+// Listen serves the queries received on each given address, nil addresses are skipped.
+// The addresses are bound even if not yet usable, e.g. a bridge IPv6 address still tentative.
+func (server *Server) Listen(addresses ...net.IP) error {
+	listenConfig := net.ListenConfig{Control: freebind}
+	var result error
+	for _, address := range addresses {
+		if address == nil {
+			continue
+		}
+		packetConn, err := listenConfig.ListenPacket(context.Background(), "udp", net.JoinHostPort(address.String(), strconv.Itoa(DNS_PORT)))
+		if err != nil {
+			logger.ErrorLogger().Printf("DNS: unable to listen on %s: %v", address, err)
+			result = err
+			continue
+		}
+		conn := packetConn.(*net.UDPConn)
+		server.lock.Lock()
+		server.conns = append(server.conns, conn)
+		server.lock.Unlock()
+		logger.InfoLogger().Printf("DNS: listening on %s", conn.LocalAddr())
+		go server.serve(conn)
+	}
+	return result
+}
+
+// Close stops serving on every address
+func (server *Server) Close() {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	for _, conn := range server.conns {
+		_ = conn.Close()
+	}
+	server.conns = server.conns[:0]
+}
+
+func (server *Server) serve(conn *net.UDPConn) {
+	buffer := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logger.DebugLogger().Printf("DNS: read error: %v", err)
+			continue
+		}
+		query := append(make([]byte, 0, n), buffer[:n]...)
+		// a miss may wait for the cluster or the upstream servers
+		go func() {
+			if response := server.Handle(query); response != nil {
+				_, _ = conn.WriteToUDP(response, addr)
+			}
+		}()
+	}
+}
+
+// Handle returns the response to a DNS query, nil if the message must be ignored
+func (server *Server) Handle(query []byte) []byte {
+	request := &layers.DNS{}
+	if err := request.DecodeFromBytes(query, gopacket.NilDecodeFeedback); err != nil || request.QR {
+		return nil
+	}
+	if request.OpCode != layers.DNSOpCodeQuery || len(request.Questions) != 1 {
+		return server.reply(request, layers.DNSResponseCodeNotImp, nil)
+	}
+	answers, additionals, found := server.resolve(request.Questions[0])
+	if found {
+		return server.reply(request, layers.DNSResponseCodeNoErr, answers, additionals...)
+	}
+	return server.forward(query, request)
+}
+
+// resolve returns the records answering a question, false if the name is not known
+func (server *Server) resolve(question layers.DNSQuestion) ([]layers.DNSResourceRecord, []layers.DNSResourceRecord, bool) {
+	if question.Class != layers.DNSClassIN {
+		return nil, nil, false
+	}
+	if question.Type == layers.DNSTypePTR {
+		answers := server.pointerRecords(question)
+		return answers, nil, len(answers) > 0
+	}
+	jobname, instancenumber, ok := ServiceName(string(question.Name))
+	if !ok {
+		return nil, nil, false
+	}
+	entries := server.resolver.LookupTableEntryByJobName(jobname)
+	if len(entries) == 0 {
+		// a service not yet known by the node, or a name forwarded after the query, e.g. www.example.co.uk
+		entries = server.resolveJobName(jobname)
+	}
+	if len(entries) == 0 {
+		return nil, nil, false
+	}
+	if instancenumber >= 0 {
+		entries = instanceEntries(entries, instancenumber)
+	}
+	if len(entries) == 0 {
+		return nil, nil, false
+	}
+	switch {
+	case question.Type == layers.DNSTypeSRV:
+		answers, additionals := SRVRecords(question, entries)
+		return answers, additionals, true
+	case instancenumber >= 0:
+		return InstanceRecords(question, entries), nil, true
+	default:
+		return ServiceRecords(question, entries), nil, true
+	}
+}
+
+// resolveJobName queries the cluster for a job not yet known by the node, waiting at most TABLE_QUERY_TIMEOUT
+func (server *Server) resolveJobName(jobname string) []TableEntryCache.TableEntry {
+	// buffered, a late answer must not block the resolver
+	result := make(chan []TableEntryCache.TableEntry, 1)
+	server.resolver.ResolveJobName(jobname, func(entries []TableEntryCache.TableEntry) {
+		result <- entries
+	})
+	select {
+	case entries := <-result:
+		if len(entries) > 0 {
+			logger.DebugLogger().Printf("DNS: resolved job %s", jobname)
+		}
+		return entries
+	case <-time.After(mqtt.TABLE_QUERY_TIMEOUT):
+		return nil
+	}
+}
+
+// pointerRecords returns the names of a namespace IP or service IP, an in-addr.arpa or ip6.arpa name
+func (server *Server) pointerRecords(question layers.DNSQuestion) []layers.DNSResourceRecord {
+	ip := reverseAddress(string(question.Name))
+	if ip == nil {
+		return nil
+	}
+	names := make([]string, 0)
+	if entry, ok := server.resolver.GetTableEntryByNsIP(ip); ok {
+		names = append(names, InstanceName(entry))
+	}
+	for _, entry := range server.resolver.LookupTableEntryByServiceIP(ip) {
+		for _, sip := range entry.ServiceIP {
+			if !sip.Address.Equal(ip) && !sip.Address_v6.Equal(ip) {
+				continue
+			}
+			if sip.IpType == TableEntryCache.InstanceNumber {
+				names = append(names, InstanceName(entry))
+			} else {
+				names = append(names, ServiceNameOf(entry))
+			}
+		}
+	}
+	records := make([]layers.DNSResourceRecord, 0)
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		records = append(records, layers.DNSResourceRecord{
+			Name:  question.Name,
+			Type:  layers.DNSTypePTR,
+			Class: layers.DNSClassIN,
+			TTL:   DNS_TTL,
+			PTR:   []byte(name),
+		})
+	}
+	return records
+}
+
+// forward relays the query to the upstream servers, in order
+func (server *Server) forward(query []byte, request *layers.DNS) []byte {
+	if len(server.upstreams) == 0 {
+		return server.reply(request, layers.DNSResponseCodeNXDomain, nil)
+	}
+	buffer := make([]byte, maxMessageSize)
+	for _, upstream := range server.upstreams {
+		conn, err := net.DialTimeout("udp", upstream, UPSTREAM_TIMEOUT)
+		if err != nil {
+			continue
+		}
+		_ = conn.SetDeadline(time.Now().Add(UPSTREAM_TIMEOUT))
+		n := 0
+		if _, err = conn.Write(query); err == nil {
+			n, err = conn.Read(buffer)
+		}
+		_ = conn.Close()
+		// the response must match the query ID
+		if err == nil && n >= 12 && buffer[0] == query[0] && buffer[1] == query[1] {
+			return append(make([]byte, 0, n), buffer[:n]...)
+		}
+		logger.DebugLogger().Printf("DNS: upstream %s failed: %v", upstream, err)
+	}
+	return server.reply(request, layers.DNSResponseCodeServFail, nil)
+}
+
+func (server *Server) reply(request *layers.DNS, code layers.DNSResponseCode, answers []layers.DNSResourceRecord, additionals ...layers.DNSResourceRecord) []byte {
+	response := &layers.DNS{
+		ID:           request.ID,
+		QR:           true,
+		OpCode:       request.OpCode,
+		AA:           code == layers.DNSResponseCodeNoErr,
+		RD:           request.RD,
+		RA:           len(server.upstreams) > 0,
+		ResponseCode: code,
+		Questions:    request.Questions,
+		Answers:      answers,
+		Additionals:  additionals,
+	}
+	// the server only listens on UDP, a truncated response could not be retried over TCP: the additional records
+	// are dropped, then the last answers until the response fits
+	for {
+		buffer := gopacket.NewSerializeBuffer()
+		if err := response.SerializeTo(buffer, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+			logger.ErrorLogger().Printf("DNS: unable to serialize the response: %v", err)
+			return nil
+		}
+		if len(buffer.Bytes()) <= maxResponseSize(request) || len(response.Answers)+len(response.Additionals) == 0 {
+			return buffer.Bytes()
+		}
+		if len(response.Additionals) > 0 {
+			response.Additionals = nil
+		} else {
+			response.Answers = response.Answers[:len(response.Answers)-1]
+		}
+	}
+}
+
+// maxResponseSize returns the UDP payload size accepted by the client, 512 bytes unless announced with EDNS
+func maxResponseSize(request *layers.DNS) int {
+	for _, additional := range request.Additionals {
+		if additional.Type == layers.DNSTypeOPT && int(additional.Class) > udpMessageSize {
+			if int(additional.Class) > maxMessageSize {
+				return maxMessageSize
+			}
+			return int(additional.Class)
+		}
+	}
+	return udpMessageSize
+}
+
+// JobName converts a service name, servicename.servicenamespace.appname.appns, to the job name
+// appname.appns.servicename.servicenamespace, in lower case. Returns false if the name is not a service name.
+func JobName(name string) (string, bool) {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".")
+	if len(labels) != 4 {
+		return "", false
+	}
+	for _, label := range labels {
+		if label == "" {
+			return "", false
+		}
+	}
+	return strings.Join([]string{labels[2], labels[3], labels[0], labels[1]}, "."), true
+}
+
+// ServiceName returns the job name and the instance number of a service name or of an instance name,
+// instancenumber.servicename.servicenamespace.appname.appns. The instance number is -1 for a service name.
+func ServiceName(name string) (string, int, bool) {
+	if jobname, ok := JobName(name); ok {
+		return jobname, -1, true
+	}
+	first, rest, found := strings.Cut(name, ".")
+	instancenumber, err := strconv.Atoi(first)
+	if !found || err != nil || instancenumber < 0 {
+		return "", 0, false
+	}
+	jobname, ok := JobName(rest)
+	return jobname, instancenumber, ok
+}
+
+// ServiceNameOf returns the service name of an entry
+func ServiceNameOf(entry TableEntryCache.TableEntry) string {
+	return fmt.Sprintf("%s.%s.%s.%s", entry.Servicename, entry.Servicenamespace, entry.Appname, entry.Appns)
+}
+
+// InstanceName returns the name of the instance of an entry
+func InstanceName(entry TableEntryCache.TableEntry) string {
+	return fmt.Sprintf("%d.%s", entry.Instancenumber, ServiceNameOf(entry))
+}
+
+func instanceEntries(entries []TableEntryCache.TableEntry, instancenumber int) []TableEntryCache.TableEntry {
+	result := make([]TableEntryCache.TableEntry, 0, 1)
+	for _, entry := range entries {
+		if entry.Instancenumber == instancenumber {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// ServiceRecords returns the A/AAAA records answering the question, RoundRobin service IPs first, then Closest.
+// A question of another type has no answer.
+func ServiceRecords(question layers.DNSQuestion, entries []TableEntryCache.TableEntry) []layers.DNSResourceRecord {
+	return addressRecords(question.Name, question.Type, serviceIPs(entries, TableEntryCache.RoundRobin, TableEntryCache.Closest))
+}
+
+// InstanceRecords returns the A/AAAA records of the InstanceNumber service IPs of the entries
+func InstanceRecords(question layers.DNSQuestion, entries []TableEntryCache.TableEntry) []layers.DNSResourceRecord {
+	return addressRecords(question.Name, question.Type, serviceIPs(entries, TableEntryCache.InstanceNumber))
+}
+
+// SRVRecords returns an SRV record for each exposed port of each instance, targeting the instance name, and the
+// A/AAAA records of the targets to be sent as additional records
+func SRVRecords(question layers.DNSQuestion, entries []TableEntryCache.TableEntry) ([]layers.DNSResourceRecord, []layers.DNSResourceRecord) {
+	answers := make([]layers.DNSResourceRecord, 0)
+	additionals := make([]layers.DNSResourceRecord, 0)
+	for _, entry := range entries {
+		if len(entry.Ports) == 0 {
+			continue
+		}
+		target := []byte(InstanceName(entry))
+		weight := entry.Weight
+		if weight < 0 || weight > 0xffff {
+			weight = 0
+		}
+		for _, port := range entry.Ports {
+			answers = append(answers, layers.DNSResourceRecord{
+				Name:  question.Name,
+				Type:  layers.DNSTypeSRV,
+				Class: layers.DNSClassIN,
+				TTL:   DNS_TTL,
+				SRV: layers.DNSSRV{
+					Weight: uint16(weight),
+					Port:   uint16(port.Port),
+					Name:   target,
+				},
+			})
+		}
+		sips := serviceIPs([]TableEntryCache.TableEntry{entry}, TableEntryCache.InstanceNumber)
+		additionals = append(additionals, addressRecords(target, layers.DNSTypeA, sips)...)
+		additionals = append(additionals, addressRecords(target, layers.DNSTypeAAAA, sips)...)
+	}
+	return answers, additionals
+}
+
+// serviceIPs returns the service IPs of the given types, in the order of the types
+func serviceIPs(entries []TableEntryCache.TableEntry, ipTypes ...TableEntryCache.ServiceIpType) []TableEntryCache.ServiceIP {
+	result := make([]TableEntryCache.ServiceIP, 0)
+	for _, ipType := range ipTypes {
+		for _, entry := range entries {
+			for _, sip := range entry.ServiceIP {
+				if sip.IpType == ipType {
+					result = append(result, sip)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// addressRecords returns the A or AAAA records of the service IPs, without duplicates
+func addressRecords(name []byte, recordType layers.DNSType, sips []TableEntryCache.ServiceIP) []layers.DNSResourceRecord {
+	records := make([]layers.DNSResourceRecord, 0)
+	seen := make(map[string]bool)
+	for _, sip := range sips {
+		ip := sip.Address.To4()
+		if recordType == layers.DNSTypeAAAA {
+			ip = sip.Address_v6
+			if ip.To4() != nil {
+				ip = nil
+			}
+		} else if recordType != layers.DNSTypeA {
+			ip = nil
+		}
+		if ip == nil || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		records = append(records, record(name, recordType, ip))
+	}
+	return records
+}
+
+func record(name []byte, recordType layers.DNSType, ip net.IP) layers.DNSResourceRecord {
+	return layers.DNSResourceRecord{
+		Name:  name,
+		Type:  recordType,
+		Class: layers.DNSClassIN,
+		TTL:   DNS_TTL,
+		IP:    ip,
+	}
+}
+
+// reverseAddress returns the IP of an in-addr.arpa or ip6.arpa name, nil if the name is not a complete address
+func reverseAddress(name string) net.IP {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if strings.HasSuffix(name, ".in-addr.arpa") {
+		octets := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(octets) != 4 {
+			return nil
+		}
+		return net.ParseIP(strings.Join([]string{octets[3], octets[2], octets[1], octets[0]}, ".")).To4()
+	}
+	if strings.HasSuffix(name, ".ip6.arpa") {
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) != 32 {
+			return nil
+		}
+		var address strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			if len(nibbles[i]) != 1 {
+				return nil
+			}
+			address.WriteString(nibbles[i])
+			if i%4 == 0 && i > 0 {
+				address.WriteString(":")
+			}
+		}
+		return net.ParseIP(address.String())
+	}
+	return nil
+}
+
+// UpstreamsFromResolvConf returns the nameservers of a resolv.conf file as host:port addresses
+func UpstreamsFromResolvConf(path string) []string {
+	upstreams := make([]string, 0)
+	file, err := os.Open(path)
+	if err != nil {
+		logger.ErrorLogger().Printf("DNS: no upstream servers, unable to read %s: %v", path, err)
+		return upstreams
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+			upstreams = append(upstreams, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	return upstreams
+}
+
+func freebind(network string, address string, c syscall.RawConn) error {
+	var err error
+	controlErr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_FREEBIND, 1)
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
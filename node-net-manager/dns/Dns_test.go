@@ -0,0 +1,400 @@
+package dns
+
+import (
+	"NetManager/TableEntryCache"
+	"NetManager/env"
+	"NetManager/mqtt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+type FakeResolver struct {
+	queried  []string
+	resolved []string
+	entries  []TableEntryCache.TableEntry
+	// entries known by the cluster, the jobs missing never get an answer if silent
+	remote map[string][]TableEntryCache.TableEntry
+	silent bool
+}
+
+func (resolver *FakeResolver) LookupTableEntryByJobName(jobname string) []TableEntryCache.TableEntry {
+	resolver.queried = append(resolver.queried, jobname)
+	if jobname != "app.ns.svc.default" {
+		return nil
+	}
+	if resolver.entries != nil {
+		return resolver.entries
+	}
+	return getFakeEntries()
+}
+
+func (resolver *FakeResolver) ResolveJobName(jobname string, callback func([]TableEntryCache.TableEntry)) {
+	resolver.resolved = append(resolver.resolved, jobname)
+	if entries, exist := resolver.remote[jobname]; exist || !resolver.silent {
+		go callback(entries)
+	}
+}
+
+func (resolver *FakeResolver) GetTableEntryByNsIP(ip net.IP) (TableEntryCache.TableEntry, bool) {
+	for _, entry := range getFakeEntries() {
+		if entry.Nsip.Equal(ip) || entry.Nsipv6.Equal(ip) {
+			return entry, true
+		}
+	}
+	return TableEntryCache.TableEntry{}, false
+}
+
+func (resolver *FakeResolver) LookupTableEntryByServiceIP(ip net.IP) []TableEntryCache.TableEntry {
+	result := make([]TableEntryCache.TableEntry, 0)
+	for _, entry := range getFakeEntries() {
+		for _, sip := range entry.ServiceIP {
+			if sip.Address.Equal(ip) || sip.Address_v6.Equal(ip) {
+				result = append(result, entry)
+				break
+			}
+		}
+	}
+	return result
+}
+
+func getFakeEntries() []TableEntryCache.TableEntry {
+	return []TableEntryCache.TableEntry{
+		{
+			JobName:          "app.ns.svc.default",
+			Appname:          "app",
+			Appns:            "ns",
+			Servicename:      "svc",
+			Servicenamespace: "default",
+			Instancenumber:   0,
+			Nsip:             net.ParseIP("10.19.1.2"),
+			Nsipv6:           net.ParseIP("fc00::2"),
+			Weight:           10,
+			Ports:            []TableEntryCache.ServicePort{{Port: 80, Protocol: "tcp"}, {Port: 53, Protocol: "udp"}},
+			ServiceIP: []TableEntryCache.ServiceIP{
+				{IpType: TableEntryCache.Closest, Address: net.ParseIP("10.30.0.2"), Address_v6: net.ParseIP("fdff::2")},
+				{IpType: TableEntryCache.RoundRobin, Address: net.ParseIP("10.30.0.1"), Address_v6: net.ParseIP("fdff::1")},
+				{IpType: TableEntryCache.InstanceNumber, Address: net.ParseIP("10.30.0.3"), Address_v6: net.ParseIP("fdff::3")},
+			},
+		},
+		{
+			JobName:          "app.ns.svc.default",
+			Appname:          "app",
+			Appns:            "ns",
+			Servicename:      "svc",
+			Servicenamespace: "default",
+			Instancenumber:   1,
+			Nsip:             net.ParseIP("10.19.2.2"),
+			ServiceIP: []TableEntryCache.ServiceIP{
+				{IpType: TableEntryCache.RoundRobin, Address: net.ParseIP("10.30.0.1"), Address_v6: net.ParseIP("fdff::1")},
+				{IpType: TableEntryCache.InstanceNumber, Address: net.ParseIP("10.30.0.4")},
+			},
+		},
+	}
+}
+
+func getQuery(t *testing.T, name string, qtype layers.DNSType) []byte {
+	query := &layers.DNS{
+		ID: 42,
+		RD: true,
+		Questions: []layers.DNSQuestion{{
+			Name:  []byte(name),
+			Type:  qtype,
+			Class: layers.DNSClassIN,
+		}},
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	if err := query.SerializeTo(buffer, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func decodeResponse(t *testing.T, response []byte) *layers.DNS {
+	if response == nil {
+		t.Fatal("No response")
+	}
+	decoded := &layers.DNS{}
+	if err := decoded.DecodeFromBytes(response, gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ID != 42 || !decoded.QR {
+		t.Fatal("The response does not match the query")
+	}
+	return decoded
+}
+
+func TestJobName(t *testing.T) {
+	jobname, ok := JobName("svc.default.app.ns.")
+	if !ok || jobname != "app.ns.svc.default" {
+		t.Errorf("Unexpected job name %s", jobname)
+	}
+	for _, name := range []string{"example.com", "a.b.c.d.e", "svc..app.ns"} {
+		if _, ok := JobName(name); ok {
+			t.Errorf("%s is not a service name", name)
+		}
+	}
+}
+
+func TestHandleServiceName(t *testing.T) {
+	resolver := &FakeResolver{}
+	server := NewServer(resolver, nil)
+
+	response := decodeResponse(t, server.Handle(getQuery(t, "svc.default.app.ns", layers.DNSTypeA)))
+	if response.ResponseCode != layers.DNSResponseCodeNoErr || len(response.Answers) != 2 {
+		t.Fatalf("Expected the 2 service IPs, got %v %d answers", response.ResponseCode, len(response.Answers))
+	}
+	if !response.Answers[0].IP.Equal(net.ParseIP("10.30.0.1")) || !response.Answers[1].IP.Equal(net.ParseIP("10.30.0.2")) {
+		t.Errorf("Expected the RoundRobin IP first, got %v %v", response.Answers[0].IP, response.Answers[1].IP)
+	}
+	if response.Answers[0].TTL != DNS_TTL {
+		t.Errorf("Unexpected TTL %d", response.Answers[0].TTL)
+	}
+
+	response = decodeResponse(t, server.Handle(getQuery(t, "svc.default.app.ns", layers.DNSTypeAAAA)))
+	if len(response.Answers) != 2 || response.Answers[0].Type != layers.DNSTypeAAAA || !response.Answers[0].IP.Equal(net.ParseIP("fdff::1")) {
+		t.Errorf("Unexpected AAAA answers %v", response.Answers)
+	}
+
+	if len(resolver.queried) != 2 || resolver.queried[0] != "app.ns.svc.default" {
+		t.Errorf("Unexpected resolver queries %v", resolver.queried)
+	}
+}
+
+func TestHandleInstanceName(t *testing.T) {
+	server := NewServer(&FakeResolver{}, nil)
+
+	response := decodeResponse(t, server.Handle(getQuery(t, "1.svc.default.app.ns", layers.DNSTypeA)))
+	if len(response.Answers) != 1 || !response.Answers[0].IP.Equal(net.ParseIP("10.30.0.4")) {
+		t.Errorf("Expected the InstanceNumber IP of instance 1, got %v", response.Answers)
+	}
+
+	response = decodeResponse(t, server.Handle(getQuery(t, "1.svc.default.app.ns", layers.DNSTypeAAAA)))
+	if response.ResponseCode != layers.DNSResponseCodeNoErr || len(response.Answers) != 0 {
+		t.Errorf("Expected no AAAA record for instance 1, got %v %v", response.ResponseCode, response.Answers)
+	}
+
+	response = decodeResponse(t, server.Handle(getQuery(t, "7.svc.default.app.ns", layers.DNSTypeA)))
+	if response.ResponseCode != layers.DNSResponseCodeNXDomain {
+		t.Errorf("Expected NXDomain for an unknown instance, got %v", response.ResponseCode)
+	}
+}
+
+func TestHandleSRV(t *testing.T) {
+	server := NewServer(&FakeResolver{}, nil)
+
+	response := decodeResponse(t, server.Handle(getQuery(t, "svc.default.app.ns", layers.DNSTypeSRV)))
+	// instance 1 does not announce its ports
+	if len(response.Answers) != 2 {
+		t.Fatalf("Expected an SRV record for each port of instance 0, got %v", response.Answers)
+	}
+	srv := response.Answers[0].SRV
+	if srv.Port != 80 || srv.Weight != 10 || string(srv.Name) != "0.svc.default.app.ns" || response.Answers[1].SRV.Port != 53 {
+		t.Errorf("Unexpected SRV record %v", srv)
+	}
+	if len(response.Additionals) != 2 || !response.Additionals[0].IP.Equal(net.ParseIP("10.30.0.3")) || !response.Additionals[1].IP.Equal(net.ParseIP("fdff::3")) {
+		t.Errorf("Expected the addresses of the target, got %v", response.Additionals)
+	}
+}
+
+func TestHandlePTR(t *testing.T) {
+	server := NewServer(&FakeResolver{}, nil)
+
+	ptr := func(name string) []string {
+		response := decodeResponse(t, server.Handle(getQuery(t, name, layers.DNSTypePTR)))
+		names := make([]string, 0)
+		for _, answer := range response.Answers {
+			names = append(names, string(answer.PTR))
+		}
+		return names
+	}
+	if names := ptr("2.1.19.10.in-addr.arpa"); len(names) != 1 || names[0] != "0.svc.default.app.ns" {
+		t.Errorf("Unexpected namespace IP names %v", names)
+	}
+	if names := ptr("1.0.30.10.in-addr.arpa"); len(names) != 1 || names[0] != "svc.default.app.ns" {
+		t.Errorf("Unexpected service IP names %v", names)
+	}
+	if names := ptr("3.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.f.f.d.f.ip6.arpa"); len(names) != 1 || names[0] != "0.svc.default.app.ns" {
+		t.Errorf("Unexpected instance IPv6 names %v", names)
+	}
+	if names := ptr("4.3.2.1.in-addr.arpa"); len(names) != 0 {
+		t.Errorf("Unexpected names of an unknown IP %v", names)
+	}
+}
+
+func TestHandleUnknownName(t *testing.T) {
+	resolver := &FakeResolver{}
+	server := NewServer(resolver, nil)
+
+	response := decodeResponse(t, server.Handle(getQuery(t, "other.default.app.ns", layers.DNSTypeA)))
+	if response.ResponseCode != layers.DNSResponseCodeNXDomain {
+		t.Errorf("Expected NXDomain without upstream servers, got %v", response.ResponseCode)
+	}
+
+	if server.Handle([]byte{0, 1, 2}) != nil {
+		t.Error("A malformed query must be ignored")
+	}
+	// the cluster is queried first, the name may not be a service
+	decodeResponse(t, server.Handle(getQuery(t, "www.example.co.uk", layers.DNSTypeA)))
+	if len(resolver.resolved) != 2 || resolver.resolved[1] != "co.uk.www.example" {
+		t.Errorf("Expected the unknown jobs to be resolved, got %v", resolver.resolved)
+	}
+}
+
+func TestHandleResolvedName(t *testing.T) {
+	resolver := &FakeResolver{
+		remote: map[string][]TableEntryCache.TableEntry{"app.ns.other.default": getFakeEntries()},
+		silent: true,
+	}
+	server := NewServer(resolver, nil)
+
+	// the first query of a service not yet known by the node waits for the cluster
+	response := decodeResponse(t, server.Handle(getQuery(t, "other.default.app.ns", layers.DNSTypeA)))
+	if response.ResponseCode != layers.DNSResponseCodeNoErr || len(response.Answers) != 2 {
+		t.Errorf("Expected the service IPs of the resolved job, got %v %d answers", response.ResponseCode, len(response.Answers))
+	}
+
+	// the wait is bounded by the table query timeout
+	timeout := mqtt.TABLE_QUERY_TIMEOUT
+	mqtt.TABLE_QUERY_TIMEOUT = 10 * time.Millisecond
+	defer func() { mqtt.TABLE_QUERY_TIMEOUT = timeout }()
+	response = decodeResponse(t, server.Handle(getQuery(t, "missing.default.app.ns", layers.DNSTypeA)))
+	if response.ResponseCode != layers.DNSResponseCodeNXDomain {
+		t.Errorf("Expected NXDomain after the timeout, got %v", response.ResponseCode)
+	}
+}
+
+func TestHandleCaseInsensitive(t *testing.T) {
+	server := NewServer(&FakeResolver{}, nil)
+
+	response := decodeResponse(t, server.Handle(getQuery(t, "SVC.Default.App.NS", layers.DNSTypeA)))
+	if len(response.Answers) != 2 || string(response.Answers[0].Name) != "SVC.Default.App.NS" {
+		t.Errorf("Expected the service IPs, got %v %v", response.ResponseCode, response.Answers)
+	}
+}
+
+func TestHandleTrimmed(t *testing.T) {
+	entries := make([]TableEntryCache.TableEntry, 0)
+	for i := 0; i < 40; i++ {
+		entry := getFakeEntries()[0]
+		entry.Instancenumber = i
+		entry.ServiceIP = []TableEntryCache.ServiceIP{
+			{IpType: TableEntryCache.Closest, Address: net.IPv4(10, 30, 1, byte(i))},
+		}
+		entries = append(entries, entry)
+	}
+	server := NewServer(&FakeResolver{entries: entries}, nil)
+
+	// there is no TCP listener to retry on, the answers that don't fit are dropped
+	message := server.Handle(getQuery(t, "svc.default.app.ns", layers.DNSTypeA))
+	response := decodeResponse(t, message)
+	if len(message) > udpMessageSize || response.TC || len(response.Answers) == 0 || len(response.Answers) == 40 {
+		t.Errorf("Expected the answers fitting %d bytes, got %d answers in %d bytes", udpMessageSize, len(response.Answers), len(message))
+	}
+
+	// a client announcing a larger buffer with EDNS receives all the answers
+	query := &layers.DNS{}
+	_ = query.DecodeFromBytes(getQuery(t, "svc.default.app.ns", layers.DNSTypeA), gopacket.NilDecodeFeedback)
+	query.Additionals = []layers.DNSResourceRecord{{Type: layers.DNSTypeOPT, Class: 4096}}
+	buffer := gopacket.NewSerializeBuffer()
+	if err := query.SerializeTo(buffer, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	response = decodeResponse(t, server.Handle(buffer.Bytes()))
+	if response.TC || len(response.Answers) != 40 {
+		t.Errorf("Expected the complete response, got %d answers", len(response.Answers))
+	}
+}
+
+func TestForwardUpstream(t *testing.T) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Skip("Unable to start the fake upstream server")
+	}
+	defer upstream.Close()
+	go func() {
+		buffer := make([]byte, maxMessageSize)
+		n, addr, err := upstream.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		query := &layers.DNS{}
+		_ = query.DecodeFromBytes(buffer[:n], gopacket.NilDecodeFeedback)
+		server := NewServer(&FakeResolver{}, nil)
+		answer := record(query.Questions[0].Name, layers.DNSTypeA, net.ParseIP("93.184.216.34").To4())
+		_, _ = upstream.WriteToUDP(server.reply(query, layers.DNSResponseCodeNoErr, []layers.DNSResourceRecord{answer}), addr)
+	}()
+
+	server := NewServer(&FakeResolver{}, []string{upstream.LocalAddr().String()})
+	response := decodeResponse(t, server.Handle(getQuery(t, "example.com", layers.DNSTypeA)))
+	if len(response.Answers) != 1 || !response.Answers[0].IP.Equal(net.ParseIP("93.184.216.34")) {
+		t.Errorf("Expected the upstream answer, got %v", response.Answers)
+	}
+}
+
+type FakeLocalResolver struct {
+}
+
+func (resolver *FakeLocalResolver) DeployedInstances() []env.DeployedInstance {
+	return []env.DeployedInstance{
+		{JobName: "app.ns.svc.default", Instancenumber: 0, Ip: net.ParseIP("10.19.1.2"), Ipv6: net.ParseIP("fc00::2")},
+		{JobName: "app.ns.svc.default", Instancenumber: 1, Ip: net.ParseIP("10.19.1.3"), Ipv6: net.ParseIP("fc00::3")},
+		{JobName: "app.ns.other.default", Instancenumber: 0, Ip: net.ParseIP("10.19.1.4")},
+	}
+}
+
+func decodeMdnsResponse(t *testing.T, response []byte) *layers.DNS {
+	if response == nil {
+		t.Fatal("No response")
+	}
+	decoded := &layers.DNS{}
+	if err := decoded.DecodeFromBytes(response, gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestMdnsServiceName(t *testing.T) {
+	responder := NewMdnsResponder(&FakeLocalResolver{})
+
+	response, unicast := responder.Handle(getQuery(t, "svc.default.app.ns.local", layers.DNSTypeA), false)
+	decoded := decodeMdnsResponse(t, response)
+	if unicast || decoded.ID != 0 || len(decoded.Questions) != 0 {
+		t.Error("Expected a multicast response without questions")
+	}
+	if len(decoded.Answers) != 2 || decoded.Answers[0].TTL != MDNS_TTL || decoded.Answers[0].Class != layers.DNSClassIN|mdnsClassFlag {
+		t.Fatalf("Expected a record for each local instance, got %v", decoded.Answers)
+	}
+
+	response, _ = responder.Handle(getQuery(t, "1.svc.default.app.ns.local", layers.DNSTypeAAAA), false)
+	decoded = decodeMdnsResponse(t, response)
+	if len(decoded.Answers) != 1 || !decoded.Answers[0].IP.Equal(net.ParseIP("fc00::3")) {
+		t.Errorf("Expected the AAAA record of instance 1, got %v", decoded.Answers)
+	}
+}
+
+func TestMdnsLegacyQuery(t *testing.T) {
+	responder := NewMdnsResponder(&FakeLocalResolver{})
+
+	response, unicast := responder.Handle(getQuery(t, "other.default.app.ns.local", layers.DNSTypeA), true)
+	decoded := decodeMdnsResponse(t, response)
+	if !unicast || decoded.ID != 42 || len(decoded.Questions) != 1 {
+		t.Error("Expected a unicast response matching the query")
+	}
+	if len(decoded.Answers) != 1 || decoded.Answers[0].TTL != LEGACY_MDNS_TTL || decoded.Answers[0].Class != layers.DNSClassIN {
+		t.Errorf("Unexpected legacy answers %v", decoded.Answers)
+	}
+}
+
+func TestMdnsNoAnswer(t *testing.T) {
+	responder := NewMdnsResponder(&FakeLocalResolver{})
+
+	for _, name := range []string{"svc.default.app.ns", "unknown.default.app.ns.local", "5.svc.default.app.ns.local", "printer.local"} {
+		if response, _ := responder.Handle(getQuery(t, name, layers.DNSTypeA), false); response != nil {
+			t.Errorf("No response expected for %s", name)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package dns
+
+import (
+	"NetManager/env"
+	"NetManager/logger"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// MDNS_TTL is the TTL of the mDNS records, in seconds, as recommended for the host names
+var MDNS_TTL uint32 = 120
+
+// LEGACY_MDNS_TTL is the TTL of the answers to the one-shot queries, not sent from the mDNS port
+var LEGACY_MDNS_TTL uint32 = 10
+
+var mdnsPort = 5353
+var mdnsGroupv4 = net.IPv4(224, 0, 0, 251)
+var mdnsGroupv6 = net.ParseIP("ff02::fb")
+
+// top bit of the class, unicast response requested in a question, cache flush in a record
+const mdnsClassFlag = 0x8000
+
+// QTYPE ANY, not declared by gopacket
+const dnsTypeAny layers.DNSType = 255
+
+// LocalResolver returns the instances deployed on this node
+type LocalResolver interface {
+	DeployedInstances() []env.DeployedInstance
+}
+
+// MdnsResponder answers the .local queries received on the bridge for the instances deployed on this node:
+// servicename.servicenamespace.appname.appns.local for every instance of the service, and
+// instancenumber.servicename.servicenamespace.appname.appns.local for a single instance.
+type MdnsResponder struct {
+	resolver LocalResolver
+	conns    []*mdnsConn
+}
+
+type mdnsConn struct {
+	conn  *net.UDPConn
+	group *net.UDPAddr
+	// reads a packet, with the index of the interface that received it
+	read func(buffer []byte) (int, int, net.Addr, error)
+}
+
+func NewMdnsResponder(resolver LocalResolver) *MdnsResponder {
+	return &MdnsResponder{
+		resolver: resolver,
+		conns:    make([]*mdnsConn, 0),
+	}
+}
+
+// Listen joins the IPv4 and IPv6 mDNS groups on the interface, the queries received on other interfaces are ignored
+func (responder *MdnsResponder) Listen(ifname string) error {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return err
+	}
+	var result error
+
+	group := &net.UDPAddr{IP: mdnsGroupv4, Port: mdnsPort}
+	if conn, err := net.ListenMulticastUDP("udp4", iface, group); err == nil {
+		packetConn := ipv4.NewPacketConn(conn)
+		_ = packetConn.SetControlMessage(ipv4.FlagInterface, true)
+		_ = packetConn.SetMulticastInterface(iface)
+		_ = packetConn.SetMulticastTTL(255)
+		responder.serve(iface, &mdnsConn{
+			conn:  conn,
+			group: group,
+			read: func(buffer []byte) (int, int, net.Addr, error) {
+				n, cm, addr, err := packetConn.ReadFrom(buffer)
+				if cm == nil {
+					return n, 0, addr, err
+				}
+				return n, cm.IfIndex, addr, err
+			},
+		})
+	} else {
+		logger.ErrorLogger().Printf("mDNS: unable to join %s on %s: %v", mdnsGroupv4, ifname, err)
+		result = err
+	}
+
+	groupv6 := &net.UDPAddr{IP: mdnsGroupv6, Port: mdnsPort, Zone: ifname}
+	if conn, err := net.ListenMulticastUDP("udp6", iface, groupv6); err == nil {
+		packetConn := ipv6.NewPacketConn(conn)
+		_ = packetConn.SetControlMessage(ipv6.FlagInterface, true)
+		_ = packetConn.SetMulticastInterface(iface)
+		_ = packetConn.SetMulticastHopLimit(255)
+		responder.serve(iface, &mdnsConn{
+			conn:  conn,
+			group: groupv6,
+			read: func(buffer []byte) (int, int, net.Addr, error) {
+				n, cm, addr, err := packetConn.ReadFrom(buffer)
+				if cm == nil {
+					return n, 0, addr, err
+				}
+				return n, cm.IfIndex, addr, err
+			},
+		})
+	} else {
+		logger.ErrorLogger().Printf("mDNS: unable to join %s on %s: %v", mdnsGroupv6, ifname, err)
+		result = err
+	}
+
+	return result
+}
+
+// Close leaves the mDNS groups
+func (responder *MdnsResponder) Close() {
+	for _, c := range responder.conns {
+		_ = c.conn.Close()
+	}
+	responder.conns = responder.conns[:0]
+}
+
+func (responder *MdnsResponder) serve(iface *net.Interface, c *mdnsConn) {
+	responder.conns = append(responder.conns, c)
+	logger.InfoLogger().Printf("mDNS: listening on %s %s", iface.Name, c.group.IP)
+	go func() {
+		buffer := make([]byte, maxMessageSize)
+		for {
+			n, ifindex, addr, err := c.read(buffer)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil || ifindex != iface.Index {
+				continue
+			}
+			source, ok := addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			response, unicast := responder.Handle(buffer[:n], source.Port != mdnsPort)
+			if response == nil {
+				continue
+			}
+			destination := c.group
+			if unicast {
+				destination = source
+			}
+			_, _ = c.conn.WriteToUDP(response, destination)
+		}
+	}()
+}
+
+// Handle returns the response to an mDNS query and whether it must be sent to the sender only.
+// Legacy queries, not sent from the mDNS port, get a unicast DNS response. There is no response if no question
+// is about a local instance.
+func (responder *MdnsResponder) Handle(query []byte, legacy bool) ([]byte, bool) {
+	request := &layers.DNS{}
+	if err := request.DecodeFromBytes(query, gopacket.NilDecodeFeedback); err != nil || request.QR || request.OpCode != layers.DNSOpCodeQuery {
+		return nil, false
+	}
+	unicast := legacy
+	answers := make([]layers.DNSResourceRecord, 0)
+	for _, question := range request.Questions {
+		if question.Class&mdnsClassFlag != 0 {
+			unicast = true
+		}
+		answers = append(answers, responder.answer(question, legacy)...)
+	}
+	if len(answers) == 0 {
+		return nil, false
+	}
+	response := &layers.DNS{
+		QR:      true,
+		AA:      true,
+		Answers: answers,
+	}
+	if legacy {
+		response.ID = request.ID
+		response.Questions = request.Questions
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	if err := response.SerializeTo(buffer, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		logger.ErrorLogger().Printf("mDNS: unable to serialize the response: %v", err)
+		return nil, false
+	}
+	return buffer.Bytes(), unicast
+}
+
+func (responder *MdnsResponder) answer(question layers.DNSQuestion, legacy bool) []layers.DNSResourceRecord {
+	records := make([]layers.DNSResourceRecord, 0)
+	if question.Class&^mdnsClassFlag != layers.DNSClassIN && question.Class&^mdnsClassFlag != layers.DNSClassAny {
+		return records
+	}
+	wantv4 := question.Type == layers.DNSTypeA || question.Type == dnsTypeAny
+	wantv6 := question.Type == layers.DNSTypeAAAA || question.Type == dnsTypeAny
+	jobname, instancenumber, ok := localName(string(question.Name))
+	if !ok || !(wantv4 || wantv6) {
+		return records
+	}
+
+	ttl, class := MDNS_TTL, layers.DNSClassIN|mdnsClassFlag
+	if legacy {
+		ttl, class = LEGACY_MDNS_TTL, layers.DNSClassIN
+	}
+	for _, instance := range responder.resolver.DeployedInstances() {
+		if !strings.EqualFold(instance.JobName, jobname) || (instancenumber >= 0 && instance.Instancenumber != instancenumber) {
+			continue
+		}
+		if wantv4 && instance.Ip.To4() != nil {
+			records = append(records, layers.DNSResourceRecord{Name: question.Name, Type: layers.DNSTypeA, Class: class, TTL: ttl, IP: instance.Ip.To4()})
+		}
+		if wantv6 && instance.Ipv6 != nil && instance.Ipv6.To4() == nil {
+			records = append(records, layers.DNSResourceRecord{Name: question.Name, Type: layers.DNSTypeAAAA, Class: class, TTL: ttl, IP: instance.Ipv6})
+		}
+	}
+	return records
+}
+
+// localName returns the job name and the instance number of a .local name, the instance number is -1 for a
+// service name
+func localName(name string) (string, int, bool) {
+	name = strings.TrimSuffix(name, ".")
+	if !strings.HasSuffix(strings.ToLower(name), ".local") {
+		return "", 0, false
+	}
+	return ServiceName(name[:len(name)-len(".local")])
+}
@@ -67,6 +67,7 @@ func (h *ContainerDeyplomentHandler) DeployNetwork(pid int, sname string, instan
 	ipv6, err := env.generateIPv6Address()
 	if err != nil {
 		cleanup(vethIfce)
+		env.freeContainerAddress(ip)
 		return nil, nil, err
 	}
 
@@ -130,6 +131,7 @@ func (h *ContainerDeyplomentHandler) DeployNetwork(pid int, sname string, instan
 		veth:        vethIfce,
 	}
 	env.deployedServicesLock.Unlock()
+	env.saveDeployments()
 	return ip, ipv6, nil
 }
 
@@ -149,6 +151,7 @@ func (env *Environment) DetachContainer(sname string, instance int) {
 		_ = network.ManageContainerPorts(s.ip, s.portmapping, network.ClosePorts)
 		_ = network.ManageContainerPorts(s.ipv6, s.portmapping, network.ClosePorts)
 		_ = netlink.LinkDel(s.veth)
+		env.saveDeployments()
 		//if no interest registered delete all remaining info about the service
 		if !mqtt.MqttIsInterestRegistered(sname) {
 			env.RemoveServiceEntries(sname)
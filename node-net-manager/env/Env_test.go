@@ -0,0 +1,242 @@
+package env
+
+import (
+	"NetManager/TableEntryCache"
+	"NetManager/ipam"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolvConf(t *testing.T) {
+	env := &Environment{}
+	if _, err := env.resolvConf("app.ns.svc.default"); err == nil {
+		t.Error("Expected an error without nameservers")
+	}
+
+	env.SetNameservers(net.ParseIP("10.19.1.1"), nil, net.ParseIP("fc00::1"))
+	content, err := env.resolvConf("app.ns.svc.default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	expected := []string{"# Generated by NetManager", "nameserver 10.19.1.1", "nameserver fc00::1", "search app.ns"}
+	if len(lines) != len(expected) {
+		t.Fatalf("Unexpected resolv.conf %q", content)
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Errorf("Expected %q, got %q", expected[i], lines[i])
+		}
+	}
+
+	if _, err := env.resolvConf("app.ns.svc"); err == nil {
+		t.Error("Expected an error for an invalid name")
+	}
+}
+
+func TestWriteInRoot(t *testing.T) {
+	host := t.TempDir()
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(host, "passwd"), []byte("root"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"etc", host} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// an absolute symlink set by the container resolves inside its filesystem
+	if err := os.Symlink(filepath.Join(host, "passwd"), filepath.Join(root, "etc", "resolv.conf")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeInRoot(root, "/etc/resolv.conf", []byte("nameserver 10.19.1.1\n")); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(host, "passwd")); string(content) != "root" {
+		t.Error("A file out of the root has been written")
+	}
+	content, err := os.ReadFile(filepath.Join(root, host, "passwd"))
+	if err != nil || string(content) != "nameserver 10.19.1.1\n" {
+		t.Errorf("Expected the file written in the root, got %q %v", content, err)
+	}
+}
+
+func getFakeConfig() Configuration {
+	return Configuration{
+		HostBridgeName:       "goProxyBridge",
+		HostBridgeIP:         "10.19.1.1",
+		HostBridgeMask:       "/26",
+		HostBridgeIPv6:       "fc00::1",
+		HostBridgeIPv6Prefix: "/120",
+	}
+}
+
+func TestStateStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netmanager", "state.json")
+	if _, exist, err := NewStateStore(path).Load(); exist || err != nil {
+		t.Fatalf("Expected no previous state, got %t %v", exist, err)
+	}
+
+	store := NewStateStore(path)
+	store.SaveDeployments(getFakeConfig(), persistedAllocations{NextVethNumber: 3}, map[string]persistedService{
+		"app.ns.svc.default.0": {Ip: net.ParseIP("10.19.1.2"), Sname: "app.ns.svc.default", Veth: "veth0030abcd"},
+	})
+	store.SaveEntries([]TableEntryCache.TableEntry{{JobName: "app.ns.svc.default", Nsip: net.ParseIP("10.19.1.2")}})
+
+	state, exist, err := NewStateStore(path).Load()
+	if err != nil || !exist {
+		t.Fatalf("Expected the saved state, got %t %v", exist, err)
+	}
+	if !sameBridge(state.Config, getFakeConfig()) || state.Allocations.NextVethNumber != 3 {
+		t.Errorf("Unexpected configuration %+v %+v", state.Config, state.Allocations)
+	}
+	if s, ok := state.Services["app.ns.svc.default.0"]; !ok || !s.Ip.Equal(net.ParseIP("10.19.1.2")) || s.Veth != "veth0030abcd" {
+		t.Errorf("Unexpected services %v", state.Services)
+	}
+	if len(state.Entries) != 1 || !state.Entries[0].Nsip.Equal(net.ParseIP("10.19.1.2")) {
+		t.Errorf("Unexpected entries %v", state.Entries)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := NewStateStore(path).Load(); err == nil {
+		t.Error("Expected an error for a corrupted state")
+	}
+}
+
+func TestSameBridge(t *testing.T) {
+	config := getFakeConfig()
+	// the interface to the internet is detected again at every start
+	config.ConnectedInternetInterface = "eth0"
+	if !sameBridge(getFakeConfig(), config) {
+		t.Error("Expected the same bridge")
+	}
+	config.HostBridgeIP = "10.19.2.1"
+	if sameBridge(getFakeConfig(), config) {
+		t.Error("A bridge with another address is a different bridge")
+	}
+	config = getFakeConfig()
+	config.HostBridgeIPv6Prefix = "/64"
+	if sameBridge(getFakeConfig(), config) {
+		t.Error("A bridge with another IPv6 prefix is a different bridge")
+	}
+}
+
+func TestBridgeAlive(t *testing.T) {
+	config := getFakeConfig()
+	config.HostBridgeName = "nmTestNoBridge"
+	if bridgeAlive(config) {
+		t.Error("The subnetwork of a missing bridge must not be reused")
+	}
+}
+
+func TestRestoreState(t *testing.T) {
+	table := TableEntryCache.NewTableManager()
+	env := &Environment{
+		translationTable: &table,
+		deployedServices: make(map[string]service),
+	}
+	var err error
+	env.ipv4Pool, err = ipam.NewPool("10.19.1.0/26", net.ParseIP("10.19.1.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env.restoreState(persistedState{
+		Config:      getFakeConfig(),
+		Allocations: persistedAllocations{NextVethNumber: 7},
+		Services: map[string]persistedService{
+			"app.ns.svc.default.0": {Ip: net.ParseIP("10.19.1.2"), Sname: "app.ns.svc.default", Veth: "nmTestNoVeth"},
+		},
+	})
+	if env.nextVethNumber != 7 {
+		t.Errorf("Expected the veth numbering to continue, got %d", env.nextVethNumber)
+	}
+	// the veth of the service is gone
+	if len(env.deployedServices) != 0 {
+		t.Errorf("Unexpected adopted services %v", env.deployedServices)
+	}
+	if err := env.ipv4Pool.Claim(net.ParseIP("10.19.1.2")); err != nil {
+		t.Errorf("The address of a service gone must stay free: %v", err)
+	}
+}
+
+func getFakeEntry(jobname string, nsip string, nsipv6 string) TableEntryCache.TableEntry {
+	return TableEntryCache.TableEntry{
+		JobName:          jobname,
+		Appname:          "app",
+		Appns:            "ns",
+		Servicename:      "svc",
+		Servicenamespace: "default",
+		Nodeip:           net.ParseIP("10.30.0.1"),
+		Nodeport:         50103,
+		Nsip:             net.ParseIP(nsip),
+		Nsipv6:           net.ParseIP(nsipv6),
+		ServiceIP: []TableEntryCache.ServiceIP{{
+			IpType:  TableEntryCache.RoundRobin,
+			Address: net.ParseIP("10.30.255.255"),
+		}},
+	}
+}
+
+func TestAddTableQueryEntryStatic(t *testing.T) {
+	table := TableEntryCache.NewTableManager()
+	env := &Environment{translationTable: &table}
+	static := getFakeEntry("infra.ns.svc.default", "10.19.1.10", "fc00::10")
+	if err := table.AddStatic(static); err != nil {
+		t.Fatal(err)
+	}
+
+	// the cluster never replaces a static entry, by IPv4 nor by IPv6 namespace IP
+	env.AddTableQueryEntry(getFakeEntry("app.ns.svc.default", "10.19.1.10", "fc00::20"))
+	env.AddTableQueryEntry(getFakeEntry("app.ns.svc.default", "10.19.1.20", "fc00::10"))
+	entry, exist := table.SearchByNsIP(static.Nsip)
+	if !exist || entry.JobName != static.JobName || !table.IsStatic(entry) {
+		t.Errorf("Static entry replaced by %v", entry)
+	}
+	if len(table.SearchByJobName("app.ns.svc.default")) != 0 {
+		t.Error("Clashing cluster entries must be ignored")
+	}
+
+	env.AddTableQueryEntry(getFakeEntry("app.ns.svc.default", "10.19.1.30", "fc00::30"))
+	if len(table.SearchByJobName("app.ns.svc.default")) != 1 {
+		t.Error("Cluster entry not added")
+	}
+}
+
+func TestExpireTableEntriesIPv4Only(t *testing.T) {
+	policy := TableEntryCache.DefaultValidationPolicy()
+	policy.AddressFamily = TableEntryCache.IPv4Only
+	table := TableEntryCache.NewTableManager(policy)
+	env := &Environment{
+		translationTable: &table,
+		deployedServices: map[string]service{
+			"app.ns.svc.default.0": {ip: net.ParseIP("10.19.1.2"), sname: "app.ns.svc.default"},
+		},
+	}
+	local := getFakeEntry("app.ns.svc.default", "10.19.1.2", "")
+	remote := getFakeEntry("app.ns.svc.default", "10.19.2.2", "")
+	remote.Instancenumber = 1
+	for _, entry := range []TableEntryCache.TableEntry{local, remote} {
+		if err := table.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ttl := TABLE_ENTRY_TTL
+	TABLE_ENTRY_TTL = -time.Second
+	defer func() { TABLE_ENTRY_TTL = ttl }()
+	env.expireTableEntries()
+	if _, exist := table.SearchByNsIP(remote.Nsip); exist {
+		t.Error("Idle remote entry not expired")
+	}
+	if _, exist := table.SearchByNsIP(local.Nsip); !exist {
+		t.Error("Entry of a local instance expired")
+	}
+}
@@ -3,6 +3,7 @@ package env
 import (
 	"NetManager/TableEntryCache"
 	"NetManager/events"
+	"NetManager/ipam"
 	"NetManager/logger"
 	"NetManager/mqtt"
 	"NetManager/network"
@@ -16,6 +17,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
@@ -23,10 +25,20 @@ import (
 
 const NamespaceAlreadyDeclared string = "namespace already declared"
 
+// prefixes of the node subnetworks, if the cluster does not assign them
+var DEFAULT_IPV4_PREFIX = "/26"
+var DEFAULT_IPV6_PREFIX = "/120"
+
+// TABLE_ENTRY_TTL is the time after which an unused translation table entry of a remote instance is removed
+var TABLE_ENTRY_TTL = 5 * time.Minute
+
 type EnvironmentManager interface {
 	GetTableEntryByServiceIP(ip net.IP) []TableEntryCache.TableEntry
+	LookupTableEntryByServiceIP(ip net.IP) []TableEntryCache.TableEntry
+	ResolveServiceIP(ip net.IP, callback func([]TableEntryCache.TableEntry))
 	GetTableEntryByNsIP(ip net.IP) (TableEntryCache.TableEntry, bool)
 	GetTableEntryByInstanceIP(ip net.IP) (TableEntryCache.TableEntry, bool)
+	WatchTable() (<-chan TableEntryCache.TableChange, func())
 }
 
 type Configuration struct {
@@ -38,6 +50,10 @@ type Configuration struct {
 	HostTunName                string
 	ConnectedInternetInterface string
 	Mtusize                    int
+	// file used to persist the node state across restarts, empty to disable persistence
+	StateFile string
+	// JSON list of entries never queried from nor expired by the cluster, empty if none
+	StaticEntriesFile string
 }
 
 type Environment struct {
@@ -49,20 +65,19 @@ type Environment struct {
 	nextVethNumber    int
 	proxyName         string
 	config            Configuration
-	translationTable  TableEntryCache.TableManager
+	translationTable  *TableEntryCache.TableManager
+	stateStore        *StateStore
 	//### Deployment management variables
 	deployedServices     map[string]service //all the deployed services with the ip and ports
 	deployedServicesLock sync.RWMutex
-	nextContainerIP      net.IP //next address for the next container to be deployed
-	nextContainerIPv6    net.IP
-	totNextAddr          int //number of addresses currently generated, max 62
-	totNextAddrv6        int
-	addrCache            []net.IP //Cache used to store the free addresses available for new containers
-	addrCachev6          []net.IP
+	ipv4Pool             *ipam.Pool //addresses of the bridge subnetwork available for new containers
+	ipv6Pool             *ipam.Pool
 	//### Communication variables
 	clusterPort string
 	clusterAddr string
 	mtusize     int
+	//addresses of the node DNS, empty if disabled
+	nameservers []net.IP
 }
 
 type service struct {
@@ -87,25 +102,33 @@ type networkInterface struct {
 
 // NewCustom environment constructor
 func NewCustom(proxyname string, customConfig Configuration) *Environment {
+	table := TableEntryCache.NewTableManager(tableValidationPolicy())
 	e := Environment{
 		nameSpaces:        make([]string, 0),
 		networkInterfaces: make([]networkInterface, 0),
 		nextVethNumber:    0,
 		proxyName:         proxyname,
 		config:            customConfig,
-		translationTable:  TableEntryCache.NewTableManager(),
-		nextContainerIP:   network.NextIP(net.ParseIP(customConfig.HostBridgeIP), 1),
-		nextContainerIPv6: network.NextIP(net.ParseIP(customConfig.HostBridgeIPv6), 1),
-		totNextAddr:       1,
-		totNextAddrv6:     1,
-		addrCache:         make([]net.IP, 0),
-		addrCachev6:       make([]net.IP, 0),
+		translationTable:  &table,
 		deployedServices:  make(map[string]service, 0),
 		clusterAddr:       os.Getenv("CLUSTER_MANAGER_IP"),
 		clusterPort:       os.Getenv("CLUSTER_MANAGER_PORT"),
 		mtusize:           customConfig.Mtusize,
 	}
 
+	//the bridge addresses are the gateways of the subnetworks
+	var err error
+	e.ipv4Pool, err = ipam.NewPool(customConfig.HostBridgeIP+customConfig.HostBridgeMask, net.ParseIP(customConfig.HostBridgeIP))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if customConfig.HostBridgeIPv6 != "" {
+		e.ipv6Pool, err = ipam.NewPool(customConfig.HostBridgeIPv6+customConfig.HostBridgeIPv6Prefix, net.ParseIP(customConfig.HostBridgeIPv6))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	//Get Connected Internet Interface
 	if e.config.ConnectedInternetInterface == "" {
 		_, e.config.ConnectedInternetInterface = network.GetLocalIPandIface()
@@ -113,10 +136,20 @@ func NewCustom(proxyname string, customConfig Configuration) *Environment {
 
 	}
 
+	//adopt the bridge of the previous run, if any, so that the running services keep their network
+	if customConfig.StateFile != "" {
+		e.stateStore = NewStateStore(customConfig.StateFile)
+	}
+	previousState, adopt := e.loadPreviousState()
+
 	//create bridge
-	logger.InfoLogger().Println("Creation of goProxyBridge")
-	if err := e.CreateHostBridge(); err != nil {
-		log.Fatal(err)
+	if adopt {
+		logger.InfoLogger().Println("Adopting the existing goProxyBridge")
+	} else {
+		logger.InfoLogger().Println("Creation of goProxyBridge")
+		if err := e.CreateHostBridge(); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	//disable reverse path filtering
@@ -133,12 +166,37 @@ func NewCustom(proxyname string, customConfig Configuration) *Environment {
 
 	//update status with current network configuration
 	logger.InfoLogger().Println("Reading the current environment configuration")
+	if adopt {
+		e.restoreState(previousState)
+	}
+	e.saveDeployments()
+	e.loadStaticEntries()
+
+	//start the translation table garbage collection
+	tableEntryTTL, err := strconv.Atoi(os.Getenv("TABLE_ENTRY_TTL"))
+	if err == nil && tableEntryTTL > 0 {
+		TABLE_ENTRY_TTL = time.Duration(tableEntryTTL) * time.Second
+	}
+	go e.tableJanitor()
 
 	return &e
 }
 
 // NewEnvironmentClusterConfigured Creates a new environment using the default configuration and asking the cluster for a new subnetwork
 func NewEnvironmentClusterConfigured(proxyname string) *Environment {
+	//after a restart the subnetwork of the previous run is kept if its bridge is adopted, the running services still use it.
+	//Otherwise the cluster may have assigned the subnetwork to another node meanwhile.
+	stateFile := stateFilePath()
+	previousState, exist, err := NewStateStore(stateFile).Load()
+	if err == nil && exist && previousState.Config.HostBridgeIP != "" && bridgeAlive(previousState.Config) {
+		logger.InfoLogger().Println("Reusing the subnetwork of the previous run")
+		config := previousState.Config
+		config.ConnectedInternetInterface = ""
+		config.StateFile = stateFile
+		config.StaticEntriesFile = staticEntriesFilePath()
+		return NewCustom(proxyname, config)
+	}
+
 	logger.InfoLogger().Println("Asking the cluster for a new subnetwork")
 	subnetwork_response, err := mqtt.RequestSubnetworkMqttBlocking()
 	if err != nil {
@@ -146,8 +204,8 @@ func NewEnvironmentClusterConfigured(proxyname string) *Environment {
 	}
 	logger.InfoLogger().Println("got subnetwork data: ", subnetwork_response)
 	subnetworks := strings.Fields(subnetwork_response)
-	ipv4_subnet := subnetworks[0]
-	ipv6_subnet := subnetworks[1]
+	ipv4_subnet, ipv4_prefix := splitSubnetwork(subnetworks[0], DEFAULT_IPV4_PREFIX)
+	ipv6_subnet, ipv6_prefix := splitSubnetwork(subnetworks[1], DEFAULT_IPV6_PREFIX)
 
 	logger.InfoLogger().Println("Creating with default config")
 	mtusize, err := strconv.Atoi(os.Getenv("TUN_MTU_SIZE"))
@@ -158,16 +216,28 @@ func NewEnvironmentClusterConfigured(proxyname string) *Environment {
 	config := Configuration{
 		HostBridgeName:             "goProxyBridge",
 		HostBridgeIP:               network.NextIP(net.ParseIP(ipv4_subnet), 1).String(),
-		HostBridgeMask:             "/26",
+		HostBridgeMask:             ipv4_prefix,
 		HostBridgeIPv6:             network.NextIP(net.ParseIP(ipv6_subnet), 1).String(),
-		HostBridgeIPv6Prefix:       "/120",
+		HostBridgeIPv6Prefix:       ipv6_prefix,
 		HostTunName:                "goProxyTun",
 		ConnectedInternetInterface: "",
 		Mtusize:                    mtusize,
+		StateFile:                  stateFile,
+		StaticEntriesFile:          staticEntriesFilePath(),
 	}
 	return NewCustom(proxyname, config)
 }
 
+// splitSubnetwork returns the address and the prefix of a subnetwork assigned by the cluster, the default prefix
+// is used if the subnetwork is not in CIDR notation
+func splitSubnetwork(subnetwork string, defaultPrefix string) (string, string) {
+	address, prefix, found := strings.Cut(subnetwork, "/")
+	if !found {
+		return subnetwork, defaultPrefix
+	}
+	return address, "/" + prefix
+}
+
 func (env *Environment) Destroy() {
 	_ = netlink.LinkDel(&netlink.GenericLink{
 		LinkAttrs: netlink.LinkAttrs{
@@ -450,13 +520,8 @@ func (env *Environment) CreateHostBridge() error {
 // If the entry is not present a TableQuery is performed and the interest registered
 func (env *Environment) GetTableEntryByServiceIP(ip net.IP) []TableEntryCache.TableEntry {
 	//If entry already available
-	table := env.translationTable.SearchByServiceIP(ip)
+	table := env.LookupTableEntryByServiceIP(ip)
 	if len(table) > 0 {
-		//Fire table instance usage event
-		events.GetInstance().Emit(events.Event{
-			EventType:   events.TableQuery,
-			EventTarget: table[0].JobName,
-		})
 		return table
 	}
 
@@ -477,6 +542,113 @@ func (env *Environment) GetTableEntryByServiceIP(ip net.IP) []TableEntryCache.Ta
 	return table
 }
 
+// GetTableEntryByJobName Given a job name this method performs a search in the local ServiceCache
+// If the job is not present a TableQuery is performed and the interest registered
+func (env *Environment) GetTableEntryByJobName(jobname string) []TableEntryCache.TableEntry {
+	//If entry already available
+	table := env.translationTable.SearchByJobName(jobname)
+	if len(table) > 0 {
+		//Fire table instance usage event
+		events.GetInstance().Emit(events.Event{
+			EventType:   events.TableQuery,
+			EventTarget: jobname,
+		})
+		return table
+	}
+
+	//if no entry available -> TableQuery
+	entryList, version, err := tableQueryByJobName(jobname)
+	if err == nil && len(entryList) > 0 && env.translationTable.ReplaceJob(jobname, entryList, version) == nil {
+		mqtt.MqttRegisterInterest(jobname, env)
+		table = env.translationTable.SearchByJobName(jobname)
+	}
+
+	return table
+}
+
+// LookupTableEntryByJobName Given a job name this method performs a search only in the local ServiceCache.
+// It never blocks, missing jobs must be resolved with ResolveJobName.
+func (env *Environment) LookupTableEntryByJobName(jobname string) []TableEntryCache.TableEntry {
+	table := env.translationTable.SearchByJobName(jobname)
+	if len(table) > 0 {
+		//Fire table instance usage event
+		events.GetInstance().Emit(events.Event{
+			EventType:   events.TableQuery,
+			EventTarget: jobname,
+		})
+	}
+	return table
+}
+
+// ResolveJobName performs the TableQuery of a job in background and registers the interest.
+// The callback receives the resolved entries, or an empty list if the query failed.
+func (env *Environment) ResolveJobName(jobname string, callback func([]TableEntryCache.TableEntry)) {
+	go func() {
+		callback(env.GetTableEntryByJobName(jobname))
+	}()
+}
+
+// BridgeAddresses returns the IPv4 and IPv6 addresses of the host bridge, the gateway of the deployed services
+func (env *Environment) BridgeAddresses() (net.IP, net.IP) {
+	return net.ParseIP(env.config.HostBridgeIP), net.ParseIP(env.config.HostBridgeIPv6)
+}
+
+// BridgeName returns the name of the host bridge interface
+func (env *Environment) BridgeName() string {
+	return env.config.HostBridgeName
+}
+
+// DeployedInstance is a service instance deployed on this node
+type DeployedInstance struct {
+	JobName        string
+	Instancenumber int
+	Ip             net.IP
+	Ipv6           net.IP
+}
+
+// DeployedInstances returns the service instances deployed on this node
+func (env *Environment) DeployedInstances() []DeployedInstance {
+	env.deployedServicesLock.RLock()
+	defer env.deployedServicesLock.RUnlock()
+	result := make([]DeployedInstance, 0, len(env.deployedServices))
+	for name, s := range env.deployedServices {
+		// the services are indexed by sname.instancenumber, or sname.instance.instancenumber for the unikernels
+		instancenumber, err := strconv.Atoi(name[strings.LastIndex(name, ".")+1:])
+		if err != nil {
+			continue
+		}
+		result = append(result, DeployedInstance{
+			JobName:        s.sname,
+			Instancenumber: instancenumber,
+			Ip:             s.ip,
+			Ipv6:           s.ipv6,
+		})
+	}
+	return result
+}
+
+// LookupTableEntryByServiceIP Given a ServiceIP this method performs a search only in the local ServiceCache.
+// It never blocks, missing entries must be resolved with ResolveServiceIP.
+func (env *Environment) LookupTableEntryByServiceIP(ip net.IP) []TableEntryCache.TableEntry {
+	table := env.translationTable.SearchByServiceIP(ip)
+	if len(table) > 0 {
+		//Fire table instance usage event
+		events.GetInstance().Emit(events.Event{
+			EventType:   events.TableQuery,
+			EventTarget: table[0].JobName,
+		})
+	}
+	return table
+}
+
+// ResolveServiceIP performs the TableQuery of a ServiceIP in background and registers the interest.
+// The callback receives the resolved entries, or an empty list if the query failed.
+func (env *Environment) ResolveServiceIP(ip net.IP, callback func([]TableEntryCache.TableEntry)) {
+	go func() {
+		callback(env.GetTableEntryByServiceIP(ip))
+	}()
+}
+
 // GetTableEntryByInstanceIP Given a ServiceIP this method performs a search in the local ServiceCache
 // If the entry is not present a TableQuery is performed and the interest registered
 func (env *Environment) GetTableEntryByInstanceIP(ip net.IP) (TableEntryCache.TableEntry, bool) {
@@ -506,8 +678,20 @@ func (env *Environment) GetTableEntryByNsIP(ip net.IP) (TableEntryCache.TableEnt
 	return entry, false
 }
 
-// AddTableQueryEntry Add new entry to the resolution table
+// WatchTable returns the changes of the translation table, see TableEntryCache.TableManager.Watch
+func (env *Environment) WatchTable() (<-chan TableEntryCache.TableChange, func()) {
+	return env.translationTable.Watch()
+}
+
+// AddTableQueryEntry Add new entry to the resolution table. Entries clashing with a static entry are ignored,
+// the static entries are never replaced by the cluster.
 func (env *Environment) AddTableQueryEntry(entry TableEntryCache.TableEntry) {
+	for _, nsip := range []net.IP{entry.Nsip, entry.Nsipv6} {
+		if existing, exist := env.translationTable.SearchByNsIP(nsip); exist && env.translationTable.IsStatic(existing) {
+			logger.ErrorLogger().Printf("Ignoring entry %s.%d, %s belongs to a static entry", entry.JobName, entry.Instancenumber, nsip)
+			return
+		}
+	}
 	_ = env.translationTable.RemoveByNsip(entry.Nsip)
 	err := env.translationTable.Add(entry)
 	if err != nil {
@@ -517,69 +701,167 @@ func (env *Environment) AddTableQueryEntry(entry TableEntryCache.TableEntry) {
 
 // RefreshServiceTable force a table query refresh for a service
 func (env *Environment) RefreshServiceTable(jobname string) {
+	_ = env.refreshServiceTable(jobname, 0)
+}
+
+// refreshServiceTable replaces the entries of the job. If the answer carries no version, the job is considered at
+// knownVersion, 0 leaves it unversioned.
+func (env *Environment) refreshServiceTable(jobname string, knownVersion uint64) error {
+	if env.translationTable.IsStaticJob(jobname) {
+		return nil
+	}
 	logger.DebugLogger().Printf("Requested table query refresh for %s", jobname)
-	entryList, err := tableQueryByJobName(jobname, true)
+	entryList, version, err := tableQueryByJobName(jobname, true)
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		version = knownVersion
+	}
+	err = env.translationTable.ReplaceJob(jobname, entryList, version)
+	if errors.Is(err, TableEntryCache.ErrStaleVersion) {
+		// a newer update has been applied meanwhile
+		logger.DebugLogger().Printf("Dropped the refresh of %s at version %d: %v", jobname, version, err)
+		return nil
+	}
+	if err != nil {
+		logger.ErrorLogger().Printf("Unable to refresh %s: %v", jobname, err)
+		return err
+	}
+	return nil
+}
+
+// ApplyServiceUpdate applies the diff of a job update to the table, the whole job is refreshed if a version is missing
+func (env *Environment) ApplyServiceUpdate(jobname string, update mqtt.JobUpdate) {
+	if env.translationTable.IsStaticJob(jobname) {
+		return
+	}
+	diff, err := jobUpdateParser(jobname, update)
+	if err != nil {
+		logger.ErrorLogger().Println(err)
+		return
+	}
+	err = env.translationTable.ApplyDiff(diff)
 	if err == nil {
-		_ = env.translationTable.RemoveByJobName(jobname)
-		for _, tableEntry := range entryList {
-			env.AddTableQueryEntry(tableEntry)
-		}
+		return
 	}
+	logger.DebugLogger().Printf("Unable to apply update %d of %s: %v, refreshing the table", update.Version, jobname, err)
+	// the answer is at least as recent as the update
+	go env.refreshServiceTable(jobname, update.Version)
 }
 
 func (env *Environment) RemoveServiceEntries(jobname string) {
+	if env.translationTable.IsStaticJob(jobname) {
+		return
+	}
 	err := env.translationTable.RemoveByJobName(jobname)
 	if err != nil {
 		logger.ErrorLogger().Printf("CRITICAL-ERROR: %v", err)
 	}
 }
 
+// tableValidationPolicy returns the default validation policy, adjusted by the TABLE_MAX_NAME_LENGTH and
+// TABLE_ADDRESS_FAMILY (dual, ipv4, ipv6 or any) env variables
+func tableValidationPolicy() TableEntryCache.ValidationPolicy {
+	policy := TableEntryCache.DefaultValidationPolicy()
+	maxNameLength, err := strconv.Atoi(os.Getenv("TABLE_MAX_NAME_LENGTH"))
+	if err == nil && maxNameLength > 0 {
+		policy.MaxNameLength = maxNameLength
+	}
+	switch os.Getenv("TABLE_ADDRESS_FAMILY") {
+	case "ipv4":
+		policy.AddressFamily = TableEntryCache.IPv4Only
+	case "ipv6":
+		policy.AddressFamily = TableEntryCache.IPv6Only
+	case "any":
+		policy.AddressFamily = TableEntryCache.AnyFamily
+	}
+	return policy
+}
+
+// tableJanitor periodically removes the unused entries of remote instances from the translation table
+func (env *Environment) tableJanitor() {
+	ticker := time.NewTicker(TABLE_ENTRY_TTL / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		env.expireTableEntries()
+		env.saveEntries()
+	}
+}
+
+func (env *Environment) expireTableEntries() {
+	expired := env.translationTable.ExpireIdle(TABLE_ENTRY_TTL, env.isDeployedLocally)
+	for _, entry := range expired {
+		logger.DebugLogger().Printf("Translation table entry %s.%d expired", entry.JobName, entry.Instancenumber)
+		events.GetInstance().Emit(events.Event{
+			EventType:    events.TableEntryExpired,
+			EventTarget:  entry.JobName,
+			EventMessage: fmt.Sprintf("%s %s", entry.Nsip.String(), entry.Nsipv6.String()),
+		})
+	}
+}
+
+// isDeployedLocally returns true if the entry belongs to an instance deployed in this node, those entries never expire
+func (env *Environment) isDeployedLocally(entry TableEntryCache.TableEntry) bool {
+	env.deployedServicesLock.RLock()
+	defer env.deployedServicesLock.RUnlock()
+	for _, element := range env.deployedServices {
+		if sameAddress(element.ip, entry.Nsip) || sameAddress(element.ipv6, entry.Nsipv6) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameAddress compares two addresses, a missing address never matches, e.g. the IPv6 ones in IPv4 only mode
+func sameAddress(a net.IP, b net.IP) bool {
+	return a != nil && b != nil && a.Equal(b)
+}
+
 func (env *Environment) RemoveNsIPEntries(nsip string) {
 	_ = env.translationTable.RemoveByNsip(net.IP(nsip))
 }
 
 func (env *Environment) generateAddress() (net.IP, error) {
-	var result net.IP
-	if len(env.addrCache) > 0 {
-		result, env.addrCache = env.addrCache[0], env.addrCache[1:]
-	} else {
-		result = env.nextContainerIP
-		if env.totNextAddr < 62 {
-			env.totNextAddr++
-		} else {
-			logger.ErrorLogger().Printf("exhausted IPv4 address space")
-			return result, errors.New("IPv4 address space exhausted")
-		}
-		env.nextContainerIP = network.NextIP(env.nextContainerIP, 1)
+	ip, err := env.ipv4Pool.Allocate()
+	if err != nil {
+		logger.ErrorLogger().Printf("exhausted IPv4 address space")
 	}
-	return result, nil
+	return ip, err
 }
 
 func (env *Environment) generateIPv6Address() (net.IP, error) {
-	var result net.IP
-	if len(env.addrCachev6) > 0 {
-		result, env.addrCachev6 = env.addrCachev6[0], env.addrCachev6[1:]
-	} else {
-		result = env.nextContainerIPv6
-		if env.totNextAddrv6 < 255 {
-			env.totNextAddrv6++
-		} else {
-			logger.ErrorLogger().Printf("exhausted IPv6 address space")
-			return result, errors.New("IPv6 address space exhausted")
-		}
-		env.nextContainerIPv6 = network.NextIP(env.nextContainerIPv6, 1)
+	if env.ipv6Pool == nil {
+		return nil, errors.New("IPv6 subnetwork not configured")
 	}
-	return result, nil
+	ip, err := env.ipv6Pool.Allocate()
+	if err != nil {
+		logger.ErrorLogger().Printf("exhausted IPv6 address space")
+	}
+	return ip, err
 }
 
 func (env *Environment) freeContainerAddress(ip net.IP) {
-	// if ip is an IPv4 addr
-	if err := ip.To4(); err != nil {
-		env.addrCache = append(env.addrCache, ip)
-	} else
-	// else check whether it is a correct IPv6 address
-	// this cannot be an IPv4-to-IPv6 mapped IPv6 addr, as we handle IPv4 beforehand
-	if err = ip.To16(); err != nil {
-		env.addrCachev6 = append(env.addrCachev6, ip)
+	if ip == nil {
+		return
+	}
+	pool := env.ipv6Pool
+	if ip.To4() != nil {
+		pool = env.ipv4Pool
+	}
+	if pool == nil {
+		return
+	}
+	if err := pool.Release(ip); err != nil {
+		logger.ErrorLogger().Printf("Unable to release the address: %v", err)
+	}
+}
+
+// AddressUsage returns the occupation of the IPv4 and IPv6 subnetworks of the node
+func (env *Environment) AddressUsage() []ipam.Usage {
+	usage := []ipam.Usage{env.ipv4Pool.Usage()}
+	if env.ipv6Pool != nil {
+		usage = append(usage, env.ipv6Pool.Usage())
 	}
+	return usage
 }
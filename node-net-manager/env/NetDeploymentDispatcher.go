@@ -9,6 +9,7 @@ const (
 
 type NetDeploymentInterface interface {
 	DeployNetwork(pid int, sname string, instancenumber int, portmapping string) (net.IP, net.IP, error)
+	ConfigureNameResolution(pid int, sname string, instancenumber int, mode string) error
 }
 
 func GetNetDeployment(handler string) NetDeploymentInterface {
@@ -5,7 +5,9 @@ import (
 	"NetManager/network"
 	"fmt"
 	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime/debug"
 
 	"github.com/vishvananda/netlink"
@@ -92,6 +94,7 @@ func (h *UnikernelDeyplomentHandler) DeployNetwork(pid int, sname string, instan
 	ipv6, err := env.generateIPv6Address()
 	if err != nil {
 		cleanup(vethIfce)
+		env.freeContainerAddress(ip)
 		return nil, nil, err
 	}
 
@@ -245,6 +248,7 @@ func (h *UnikernelDeyplomentHandler) DeployNetwork(pid int, sname string, instan
 		veth:        vethIfce,
 	}
 	env.deployedServicesLock.Unlock()
+	env.saveDeployments()
 	logger.DebugLogger().Println("Successful Network creation for Unikernel")
 	return ip, ipv6, nil
 
@@ -265,5 +269,7 @@ func (env *Environment) DeleteUnikernelNamespace(sname string, instance int) {
 		_ = network.ManageContainerPorts(s.ipv6, s.portmapping, network.ClosePorts)
 		_ = netlink.LinkDel(s.veth)
 		_ = netns.DeleteNamed(name)
+		_ = os.RemoveAll(filepath.Join(NETNS_ETC_DIR, name))
+		env.saveDeployments()
 	}
 }
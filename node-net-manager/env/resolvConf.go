@@ -0,0 +1,130 @@
+package env
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// resolv.conf modes of a deploy request, the default leaves the name resolution to the runtime
+const (
+	RESOLV_CONF_NONE  = "none"
+	RESOLV_CONF_WRITE = "write"
+	RESOLV_CONF_BIND  = "bind"
+)
+
+// NETNS_ETC_DIR holds the files that `ip netns exec` bind mounts in the named namespaces
+var NETNS_ETC_DIR = "/etc/netns"
+
+// SetNameservers sets the addresses of the node DNS, used in the resolv.conf of the deployed services
+func (env *Environment) SetNameservers(nameservers ...net.IP) {
+	env.nameservers = make([]net.IP, 0, len(nameservers))
+	for _, ip := range nameservers {
+		if ip != nil {
+			env.nameservers = append(env.nameservers, ip)
+		}
+	}
+}
+
+// ValidResolvConfMode returns an error if the resolv.conf mode of a deploy request is unknown
+func ValidResolvConfMode(mode string) error {
+	switch mode {
+	case "", RESOLV_CONF_NONE, RESOLV_CONF_WRITE, RESOLV_CONF_BIND:
+		return nil
+	}
+	return fmt.Errorf("unknown resolv.conf mode: %s", mode)
+}
+
+// resolvConf generates the resolv.conf of a service, the search domain is the app namespace of the service so that
+// the other services of the app resolve as servicename.servicenamespace
+func (env *Environment) resolvConf(sname string) ([]byte, error) {
+	if len(env.nameservers) == 0 {
+		return nil, errors.New("the node DNS is not enabled")
+	}
+	appCompleteName := strings.Split(sname, ".")
+	if len(appCompleteName) != 4 {
+		return nil, errors.New("app complete name not of size 4")
+	}
+	var content strings.Builder
+	content.WriteString("# Generated by NetManager\n")
+	for _, ip := range env.nameservers {
+		content.WriteString(fmt.Sprintf("nameserver %s\n", ip))
+	}
+	content.WriteString(fmt.Sprintf("search %s.%s\n", appCompleteName[0], appCompleteName[1]))
+	return []byte(content.String()), nil
+}
+
+// ConfigureNameResolution points the container to the node DNS. With RESOLV_CONF_WRITE the resolv.conf of the
+// container is overwritten, with RESOLV_CONF_BIND the generated file is mounted over it, this requires the mount
+// command in the container image.
+func (h *ContainerDeyplomentHandler) ConfigureNameResolution(pid int, sname string, instancenumber int, mode string) error {
+	if err := ValidResolvConfMode(mode); err != nil || mode == "" || mode == RESOLV_CONF_NONE {
+		return err
+	}
+	content, err := h.env.resolvConf(sname)
+	if err != nil {
+		return err
+	}
+	root := fmt.Sprintf("/proc/%d/root", pid)
+	if mode == RESOLV_CONF_WRITE {
+		return writeInRoot(root, "/etc/resolv.conf", content)
+	}
+	// the mount namespace of the container can't be entered by a multithreaded process
+	if err := writeInRoot(root, "/etc/resolv.conf.netmanager", content); err != nil {
+		return err
+	}
+	output, err := exec.Command("nsenter", "--target", strconv.Itoa(pid), "--mount", "--",
+		"mount", "--bind", "/etc/resolv.conf.netmanager", "/etc/resolv.conf").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// writeInRoot writes a file of the container filesystem mounted at root. The path is resolved as if root was /,
+// the symlinks of the container can't lead to a file of the host.
+func writeInRoot(root string, path string, content []byte) error {
+	rootFd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer unix.Close(rootFd)
+	fd, err := unix.Openat2(rootFd, path, &unix.OpenHow{
+		Flags:   unix.O_WRONLY | unix.O_CREAT | unix.O_TRUNC | unix.O_CLOEXEC,
+		Mode:    0644,
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	if err != nil {
+		return &os.PathError{Op: "openat2", Path: filepath.Join(root, path), Err: err}
+	}
+	file := os.NewFile(uintptr(fd), filepath.Join(root, path))
+	if _, err := file.Write(content); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ConfigureNameResolution points the unikernel namespace to the node DNS. Both modes write the resolv.conf of the
+// named namespace, bind mounted by `ip netns exec`.
+func (h *UnikernelDeyplomentHandler) ConfigureNameResolution(pid int, sname string, instancenumber int, mode string) error {
+	if err := ValidResolvConfMode(mode); err != nil || mode == "" || mode == RESOLV_CONF_NONE {
+		return err
+	}
+	content, err := h.env.resolvConf(sname)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(NETNS_ETC_DIR, fmt.Sprintf("%s.instance.%d", sname, instancenumber))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "resolv.conf"), content, 0644)
+}
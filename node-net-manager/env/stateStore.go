@@ -0,0 +1,274 @@
+package env
+
+import (
+	"NetManager/TableEntryCache"
+	"NetManager/logger"
+	"NetManager/mqtt"
+	"NetManager/network"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+)
+
+// DEFAULT_STATE_FILE is the file used to persist the node state in cluster mode, overridden by NETMANAGER_STATE_FILE
+var DEFAULT_STATE_FILE = "/var/lib/netmanager/state.json"
+
+// persistedState is the content of the state file
+type persistedState struct {
+	Config      Configuration                `json:"config"`
+	Allocations persistedAllocations         `json:"allocations"`
+	Services    map[string]persistedService  `json:"services"`
+	Entries     []TableEntryCache.TableEntry `json:"entries"`
+}
+
+// the addresses in use are those of the persisted services
+type persistedAllocations struct {
+	NextVethNumber int `json:"next_veth_number"`
+}
+
+type persistedService struct {
+	Ip          net.IP `json:"ip"`
+	Ipv6        net.IP `json:"ipv6"`
+	Sname       string `json:"sname"`
+	Portmapping string `json:"portmapping"`
+	Veth        string `json:"veth"`
+}
+
+// StateStore keeps the last known state of the node in a JSON file. Deployments and table entries are updated
+// independently, every update rewrites the whole file.
+type StateStore struct {
+	path  string
+	state persistedState
+	lock  sync.Mutex
+}
+
+func NewStateStore(path string) *StateStore {
+	return &StateStore{
+		path: path,
+		state: persistedState{
+			Services: make(map[string]persistedService),
+			Entries:  make([]TableEntryCache.TableEntry, 0),
+		},
+	}
+}
+
+// Load reads the state file, returns false if there is no previous state
+func (store *StateStore) Load() (persistedState, bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	content, err := os.ReadFile(store.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return persistedState{}, false, nil
+	}
+	if err != nil {
+		return persistedState{}, false, err
+	}
+	var state persistedState
+	err = json.Unmarshal(content, &state)
+	if err != nil {
+		return persistedState{}, false, err
+	}
+	store.state = state
+	return state, true, nil
+}
+
+// SaveDeployments records the configuration, the address allocations and the deployed services
+func (store *StateStore) SaveDeployments(config Configuration, allocations persistedAllocations, services map[string]persistedService) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.state.Config = config
+	store.state.Allocations = allocations
+	store.state.Services = services
+	store.write()
+}
+
+// SaveEntries records the entries of the translation table
+func (store *StateStore) SaveEntries(entries []TableEntryCache.TableEntry) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.state.Entries = entries
+	store.write()
+}
+
+// write replaces the state file atomically, a crash never leaves a truncated file
+func (store *StateStore) write() {
+	content, err := json.Marshal(store.state)
+	if err != nil {
+		logger.ErrorLogger().Printf("Unable to serialize the node state: %v", err)
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(store.path), 0755)
+	if err == nil {
+		tmp := store.path + ".tmp"
+		err = os.WriteFile(tmp, content, 0600)
+		if err == nil {
+			err = os.Rename(tmp, store.path)
+		}
+	}
+	if err != nil {
+		logger.ErrorLogger().Printf("Unable to persist the node state: %v", err)
+	}
+}
+
+// stateFilePath returns the state file used in cluster mode
+func stateFilePath() string {
+	if path := os.Getenv("NETMANAGER_STATE_FILE"); path != "" {
+		return path
+	}
+	return DEFAULT_STATE_FILE
+}
+
+// loadPreviousState returns the state persisted by the previous run, if the bridge it describes still exists
+func (env *Environment) loadPreviousState() (persistedState, bool) {
+	if env.stateStore == nil {
+		return persistedState{}, false
+	}
+	state, exist, err := env.stateStore.Load()
+	if err != nil {
+		logger.ErrorLogger().Printf("Unable to read the previous state: %v", err)
+		return persistedState{}, false
+	}
+	if !exist {
+		return persistedState{}, false
+	}
+	if !sameBridge(state.Config, env.config) {
+		logger.InfoLogger().Println("The previous state refers to a different bridge, ignoring it")
+		return persistedState{}, false
+	}
+	if !bridgeAlive(env.config) {
+		logger.InfoLogger().Println("The bridge of the previous run is gone, ignoring the previous state")
+		return persistedState{}, false
+	}
+	return state, true
+}
+
+// bridgeAlive returns true if the bridge of the configuration exists and still holds its IPv4 address
+func bridgeAlive(config Configuration) bool {
+	bridge, err := netlink.LinkByName(config.HostBridgeName)
+	if err != nil {
+		return false
+	}
+	addresses, err := netlink.AddrList(bridge, netlink.FAMILY_V4)
+	if err != nil {
+		return false
+	}
+	for _, address := range addresses {
+		if address.IP.Equal(net.ParseIP(config.HostBridgeIP)) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameBridge(a Configuration, b Configuration) bool {
+	return a.HostBridgeName == b.HostBridgeName &&
+		a.HostBridgeIP == b.HostBridgeIP &&
+		a.HostBridgeMask == b.HostBridgeMask &&
+		a.HostBridgeIPv6 == b.HostBridgeIPv6 &&
+		a.HostBridgeIPv6Prefix == b.HostBridgeIPv6Prefix
+}
+
+// restoreState adopts the services deployed by the previous run, claiming their addresses, then restores the
+// translation table. Services whose veth is gone are dropped, their addresses stay free.
+func (env *Environment) restoreState(state persistedState) {
+	env.nextVethNumber = state.Allocations.NextVethNumber
+
+	for name, s := range state.Services {
+		link, err := netlink.LinkByName(s.Veth)
+		veth, isVeth := link.(*netlink.Veth)
+		if err != nil || !isVeth {
+			logger.InfoLogger().Printf("Service %s is gone, releasing its addresses", name)
+			continue
+		}
+		if err := env.claimAddresses(s.Ip, s.Ipv6); err != nil {
+			logger.ErrorLogger().Printf("Unable to adopt service %s: %v", name, err)
+			continue
+		}
+		// the NAT rules have been flushed at startup, the FORWARD rules of the veth are still in place
+		_ = network.ManageContainerPorts(s.Ip, s.Portmapping, network.OpenPorts)
+		_ = network.ManageContainerPorts(s.Ipv6, s.Portmapping, network.OpenPorts)
+		env.deployedServicesLock.Lock()
+		env.deployedServices[name] = service{
+			ip:          s.Ip,
+			ipv6:        s.Ipv6,
+			sname:       s.Sname,
+			portmapping: s.Portmapping,
+			veth:        veth,
+		}
+		env.deployedServicesLock.Unlock()
+		logger.InfoLogger().Printf("Adopted service %s", name)
+	}
+
+	jobs := make(map[string]bool)
+	for _, entry := range state.Entries {
+		if env.translationTable.Add(entry) == nil {
+			jobs[entry.JobName] = true
+		}
+	}
+	// the updates of the restored jobs must be received again
+	for job := range jobs {
+		mqtt.MqttRegisterInterest(job, env)
+	}
+}
+
+// saveDeployments persists the deployed services and the address allocations
+func (env *Environment) saveDeployments() {
+	if env.stateStore == nil {
+		return
+	}
+	env.deployedServicesLock.RLock()
+	services := make(map[string]persistedService, len(env.deployedServices))
+	for name, s := range env.deployedServices {
+		vethName := ""
+		if s.veth != nil {
+			vethName = s.veth.Name
+		}
+		services[name] = persistedService{
+			Ip:          s.ip,
+			Ipv6:        s.ipv6,
+			Sname:       s.sname,
+			Portmapping: s.portmapping,
+			Veth:        vethName,
+		}
+	}
+	env.deployedServicesLock.RUnlock()
+	env.stateStore.SaveDeployments(env.config, persistedAllocations{
+		NextVethNumber: env.nextVethNumber,
+	}, services)
+}
+
+// claimAddresses allocates the addresses of an adopted service, none of them if one is not available
+func (env *Environment) claimAddresses(ip net.IP, ipv6 net.IP) error {
+	if ip != nil {
+		if err := env.ipv4Pool.Claim(ip); err != nil {
+			return err
+		}
+	}
+	if ipv6 != nil && env.ipv6Pool != nil {
+		if err := env.ipv6Pool.Claim(ipv6); err != nil {
+			env.freeContainerAddress(ip)
+			return err
+		}
+	}
+	return nil
+}
+
+// saveEntries persists the entries received from the cluster
+func (env *Environment) saveEntries() {
+	if env.stateStore == nil {
+		return
+	}
+	entries := make([]TableEntryCache.TableEntry, 0)
+	for _, entry := range env.translationTable.Entries() {
+		// the static entries are read again from their own file
+		if !env.translationTable.IsStatic(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	env.stateStore.SaveEntries(entries)
+}
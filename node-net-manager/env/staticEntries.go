@@ -0,0 +1,79 @@
+package env
+
+import (
+	"NetManager/TableEntryCache"
+	"NetManager/logger"
+	"errors"
+	"net"
+	"os"
+	"sync"
+)
+
+// DEFAULT_STATIC_ENTRIES_FILE declares the static entries in cluster mode, overridden by NETMANAGER_STATIC_ENTRIES
+var DEFAULT_STATIC_ENTRIES_FILE = "/etc/netmanager/static-entries.json"
+
+// the admin API may rewrite the file concurrently
+var staticEntriesFileLock sync.Mutex
+
+func staticEntriesFilePath() string {
+	if path := os.Getenv("NETMANAGER_STATIC_ENTRIES"); path != "" {
+		return path
+	}
+	return DEFAULT_STATIC_ENTRIES_FILE
+}
+
+// loadStaticEntries adds the entries declared in the static entries file, a missing file is not an error
+func (env *Environment) loadStaticEntries() {
+	if env.config.StaticEntriesFile == "" {
+		return
+	}
+	entries, err := TableEntryCache.LoadStaticEntries(env.config.StaticEntriesFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		logger.ErrorLogger().Printf("Unable to read the static entries: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		if err := env.translationTable.AddStatic(entry); err != nil {
+			logger.ErrorLogger().Printf("Invalid static entry %s.%d: %v", entry.JobName, entry.Instancenumber, err)
+		}
+	}
+	logger.InfoLogger().Printf("Loaded %d static entries", len(entries))
+}
+
+// AddStaticEntry adds an entry that is never queried from nor expired by the cluster
+func (env *Environment) AddStaticEntry(entry TableEntryCache.TableEntry) error {
+	err := env.translationTable.AddStatic(entry)
+	if err == nil {
+		env.saveStaticEntries()
+	}
+	return err
+}
+
+// RemoveStaticEntry removes the static entry with the given namespace IP
+func (env *Environment) RemoveStaticEntry(nsip net.IP) error {
+	err := env.translationTable.RemoveStatic(nsip)
+	if err == nil {
+		env.saveStaticEntries()
+	}
+	return err
+}
+
+func (env *Environment) StaticEntries() []TableEntryCache.TableEntry {
+	return env.translationTable.StaticEntries()
+}
+
+// saveStaticEntries writes the static entries back to the file, so that the entries added at runtime survive a restart
+func (env *Environment) saveStaticEntries() {
+	if env.config.StaticEntriesFile == "" {
+		return
+	}
+	staticEntriesFileLock.Lock()
+	defer staticEntriesFileLock.Unlock()
+	err := TableEntryCache.SaveStaticEntries(env.config.StaticEntriesFile, env.translationTable.StaticEntries())
+	if err != nil {
+		logger.ErrorLogger().Printf("Unable to save the static entries: %v", err)
+	}
+}
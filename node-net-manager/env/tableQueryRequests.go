@@ -6,6 +6,7 @@ import (
 	"errors"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 )
 
@@ -27,17 +28,18 @@ func tableQueryByIP(ip net.IP, force_optional ...bool) ([]TableEntryCache.TableE
 /*
 Asks the MQTT client for a table query and parses the result
 */
-func tableQueryByJobName(jobname string, force_optional ...bool) ([]TableEntryCache.TableEntry, error) {
+func tableQueryByJobName(jobname string, force_optional ...bool) ([]TableEntryCache.TableEntry, uint64, error) {
 
 	log.Println("[MQTT TABLE QUERY] sname:", jobname)
 	var mqttTablequery mqttifce.TablequeryMqttInterface = mqttifce.GetTableQueryRequestCacheInstance()
 
 	responseStruct, err := mqttTablequery.TableQueryByJobNameRequestBlocking(jobname, force_optional...)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	return responseParser(responseStruct)
+	entries, err := responseParser(responseStruct)
+	return entries, responseStruct.Version, err
 }
 
 func responseParser(responseStruct mqttifce.TableQueryResponse) ([]TableEntryCache.TableEntry, error) {
@@ -50,31 +52,84 @@ func responseParser(responseStruct mqttifce.TableQueryResponse) ([]TableEntryCac
 	result := make([]TableEntryCache.TableEntry, 0)
 
 	for _, instance := range responseStruct.InstanceList {
-		sipList := make([]TableEntryCache.ServiceIP, 0)
+		result = append(result, instanceToEntry(responseStruct.JobName, appCompleteName, instance))
+	}
 
-		for _, ip := range instance.ServiceIp {
-			sipList = append(sipList, toServiceIP(ip.Type, ip.Address, ip.Address_v6))
-		}
+	return result, nil
+}
 
-		entry := TableEntryCache.TableEntry{
-			JobName:          responseStruct.JobName,
-			Appname:          appCompleteName[0],
-			Appns:            appCompleteName[1],
-			Servicename:      appCompleteName[2],
-			Servicenamespace: appCompleteName[3],
-			Instancenumber:   instance.InstanceNumber,
-			Cluster:          0,
-			Nodeip:           net.ParseIP(instance.HostIp),
-			Nodeport:         instance.HostPort,
-			Nsip:             net.ParseIP(instance.NamespaceIp),
-			Nsipv6:           net.ParseIP(instance.NamespaceIpv6),
-			ServiceIP:        sipList,
-		}
+/*
+Converts the diff of a job update into a table diff
+*/
+func jobUpdateParser(jobname string, update mqttifce.JobUpdate) (TableEntryCache.TableDiff, error) {
+	appCompleteName := strings.Split(jobname, ".")
 
-		result = append(result, entry)
+	if len(appCompleteName) != 4 {
+		return TableEntryCache.TableDiff{}, errors.New("app complete name not of size 4")
 	}
 
-	return result, nil
+	diff := TableEntryCache.TableDiff{
+		JobName: jobname,
+		Version: update.Version,
+		Added:   make([]TableEntryCache.TableEntry, 0, len(update.Added)),
+		Changed: make([]TableEntryCache.TableEntry, 0, len(update.Changed)),
+		Removed: update.Removed,
+	}
+	for _, instance := range update.Added {
+		diff.Added = append(diff.Added, instanceToEntry(jobname, appCompleteName, instance))
+	}
+	for _, instance := range update.Changed {
+		diff.Changed = append(diff.Changed, instanceToEntry(jobname, appCompleteName, instance))
+	}
+
+	return diff, nil
+}
+
+func instanceToEntry(jobname string, appCompleteName []string, instance mqttifce.ServiceInstance) TableEntryCache.TableEntry {
+	sipList := make([]TableEntryCache.ServiceIP, 0)
+
+	for _, ip := range instance.ServiceIp {
+		sipList = append(sipList, toServiceIP(ip.Type, ip.Address, ip.Address_v6))
+	}
+
+	return TableEntryCache.TableEntry{
+		JobName:          jobname,
+		Appname:          appCompleteName[0],
+		Appns:            appCompleteName[1],
+		Servicename:      appCompleteName[2],
+		Servicenamespace: appCompleteName[3],
+		Instancenumber:   instance.InstanceNumber,
+		Cluster:          0,
+		Nodeip:           net.ParseIP(instance.HostIp),
+		Nodeport:         instance.HostPort,
+		Nsip:             net.ParseIP(instance.NamespaceIp),
+		Nsipv6:           net.ParseIP(instance.NamespaceIpv6),
+		ServiceIP:        sipList,
+		Weight:           instance.Weight,
+		Ports:            toServicePorts(instance.Ports),
+	}
+}
+
+// toServicePorts returns the container ports of a port mapping, the ports reachable on the service IPs
+func toServicePorts(portmapping string) []TableEntryCache.ServicePort {
+	if portmapping == "" {
+		return nil
+	}
+	result := make([]TableEntryCache.ServicePort, 0)
+	for _, portmap := range strings.Split(portmapping, ";") {
+		protocol := "tcp"
+		if strings.HasSuffix(portmap, "/udp") {
+			protocol = "udp"
+		}
+		portmap = strings.TrimSuffix(strings.TrimSuffix(portmap, "/udp"), "/tcp")
+		ports := strings.Split(portmap, ":")
+		port, err := strconv.Atoi(ports[len(ports)-1])
+		if err != nil || port <= 0 || port > 65535 {
+			continue
+		}
+		result = append(result, TableEntryCache.ServicePort{Port: port, Protocol: protocol})
+	}
+	return result
 }
 
 func toServiceIP(Type string, Addr string, Addr_v6 string) TableEntryCache.ServiceIP {
@@ -13,7 +13,8 @@ type EventManager interface {
 
 type Events struct {
 	//map of event target to event kind
-	eventTableQueryChannelQueue map[string]chan Event
+	eventTableQueryChannelQueue        map[string]chan Event
+	eventTableEntryExpiredChannelQueue map[string]chan Event
 }
 
 type Event struct {
@@ -26,8 +27,14 @@ type EventType int
 
 const (
 	TableQuery EventType = iota
+	// TableEntryExpired is emitted when an unused entry is removed from the translation table.
+	// The target is the job name, the message contains the namespace IPs of the instance separated by a space.
+	TableEntryExpired
 )
 
+// AnyTarget registers to the events of every target
+const AnyTarget = "*"
+
 /* ------------- singleton instance ------- */
 var once sync.Once
 var rwlock sync.RWMutex
@@ -40,7 +47,8 @@ var (
 func GetInstance() EventManager {
 	once.Do(func() {
 		eventInstance = &Events{
-			eventTableQueryChannelQueue: make(map[string]chan Event, 0),
+			eventTableQueryChannelQueue:        make(map[string]chan Event, 0),
+			eventTableEntryExpiredChannelQueue: make(map[string]chan Event, 0),
 		}
 	})
 	return eventInstance
@@ -58,6 +66,13 @@ func (e *Events) Emit(event Event) {
 				channel <- event
 			}
 		}
+	case TableEntryExpired:
+		for _, target := range []string{event.EventTarget, AnyTarget} {
+			channel := e.eventTableEntryExpiredChannelQueue[target]
+			if channel != nil && len(channel) < cap(channel) {
+				channel <- event
+			}
+		}
 	}
 }
 
@@ -72,6 +87,13 @@ func (e *Events) Register(eventType EventType, eventTarget string) (chan Event,
 		}
 		e.eventTableQueryChannelQueue[eventTarget] = channel
 		return channel, nil
+	case TableEntryExpired:
+		channel := e.eventTableEntryExpiredChannelQueue[eventTarget]
+		if channel == nil {
+			channel = make(chan Event, 100)
+		}
+		e.eventTableEntryExpiredChannelQueue[eventTarget] = channel
+		return channel, nil
 	}
 	return nil, errors.New("Invalid EventType")
 }
@@ -86,5 +108,11 @@ func (e *Events) DeRegister(eventType EventType, eventTarget string) {
 			e.eventTableQueryChannelQueue[eventTarget] = nil
 			close(channel)
 		}
+	case TableEntryExpired:
+		channel := e.eventTableEntryExpiredChannelQueue[eventTarget]
+		if channel != nil {
+			delete(e.eventTableEntryExpiredChannelQueue, eventTarget)
+			close(channel)
+		}
 	}
 }
@@ -106,3 +106,32 @@ func TestRegisterMultipleAndEmit(t *testing.T) {
 	}
 
 }
+
+func TestExpiredEventAnyTarget(t *testing.T) {
+	eventManager := GetInstance()
+	anyChannel, _ := eventManager.Register(TableEntryExpired, AnyTarget)
+	jobChannel, _ := eventManager.Register(TableEntryExpired, "job-expired")
+	defer eventManager.DeRegister(TableEntryExpired, AnyTarget)
+	defer eventManager.DeRegister(TableEntryExpired, "job-expired")
+
+	eventManager.Emit(Event{
+		EventType:    TableEntryExpired,
+		EventMessage: "10.18.0.1 fc00::1",
+		EventTarget:  "job-expired",
+	})
+	eventManager.Emit(Event{
+		EventType:   TableEntryExpired,
+		EventTarget: "other-job",
+	})
+
+	if len(anyChannel) != 2 {
+		t.Error("AnyTarget received ", len(anyChannel), " events; want = 2")
+	}
+	if len(jobChannel) != 1 {
+		t.Error("Target received ", len(jobChannel), " events; want = 1")
+	}
+	event := <-jobChannel
+	if event.EventMessage != "10.18.0.1 fc00::1" {
+		t.Error("Wrong event message ", event.EventMessage)
+	}
+}
@@ -50,6 +50,7 @@ Request Json:
 		appName:string
 		instanceNumber:int
 		portMapppings: map[int]int (host port, container port)
+		resolvConf:string # optional, "write" or "bind" to point the container to the node DNS, "none" by default. The deployment fails if the resolv.conf can't be configured
 	}
 
 Response Json:
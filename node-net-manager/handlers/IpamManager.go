@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"NetManager/env"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type IpamManager struct {
+	Env      *env.Environment
+	WorkerID *string
+}
+
+var ipamManager *IpamManager
+
+func init() {
+	AdminManagers["ipam"] = GetIpamManager
+	ipamManager = &IpamManager{}
+}
+
+func GetIpamManager() ManagerInterface {
+	return ipamManager
+}
+
+func (m *IpamManager) Register(Env *env.Environment, WorkerID *string, NodePublicAddress string, NodePublicPort string, Router *mux.Router) {
+	m.Env = Env
+	m.WorkerID = WorkerID
+
+	Router.HandleFunc("/ipam", m.addressUsage).Methods("GET")
+}
+
+/*
+Endpoint: /ipam
+Usage: reports the usage of the IPv4 and IPv6 subnetworks of the node. This method can be used only after the registration
+Method: GET
+Response Json:
+
+	[
+		{
+			subnet:string # subnetwork in CIDR notation
+			size:int # addresses managed
+			reserved:int # network, broadcast and gateway addresses
+			allocated:int # addresses assigned to the services
+			free:int
+		}
+	]
+*/
+func (m *IpamManager) addressUsage(writer http.ResponseWriter, request *http.Request) {
+	log.Println("Received HTTP request - GET /ipam ")
+
+	if *m.WorkerID == "" {
+		log.Printf("[ERROR] Node not initialized")
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(writer).Encode(m.Env.AddressUsage())
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+	}
+}
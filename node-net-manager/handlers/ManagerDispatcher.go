@@ -24,6 +24,9 @@ type DeployResponse struct {
 
 var AvailableRuntimes = make(map[string]func() ManagerInterface)
 
+// AdminManagers expose the node administration endpoints
+var AdminManagers = make(map[string]func() ManagerInterface)
+
 type ManagerInterface interface {
 	Register(Env *env.Environment, WorkerID *string, NodePublicAddress string, NodePublicPort string, Router *mux.Router)
 }
@@ -39,4 +42,7 @@ func RegisterAllManagers(Env *env.Environment, WorkerID *string, NodePublicAddre
 	for _, getfunc := range AvailableRuntimes {
 		getfunc().Register(Env, WorkerID, NodePublicAddress, NodePublicPort, Router)
 	}
+	for _, getfunc := range AdminManagers {
+		getfunc().Register(Env, WorkerID, NodePublicAddress, NodePublicPort, Router)
+	}
 }
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"NetManager/TableEntryCache"
+	"NetManager/env"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type StaticEntriesManager struct {
+	Env      *env.Environment
+	WorkerID *string
+}
+
+var staticEntriesManager *StaticEntriesManager
+
+func init() {
+	AdminManagers["static-entries"] = GetStaticEntriesManager
+	staticEntriesManager = &StaticEntriesManager{}
+}
+
+func GetStaticEntriesManager() ManagerInterface {
+	return staticEntriesManager
+}
+
+func (m *StaticEntriesManager) Register(Env *env.Environment, WorkerID *string, NodePublicAddress string, NodePublicPort string, Router *mux.Router) {
+	m.Env = Env
+	m.WorkerID = WorkerID
+
+	Router.HandleFunc("/table/static", m.listStaticEntries).Methods("GET")
+	Router.HandleFunc("/table/static", m.addStaticEntry).Methods("POST")
+	Router.HandleFunc("/table/static/{nsip}", m.removeStaticEntry).Methods("DELETE")
+}
+
+/*
+Endpoint: /table/static
+Usage: lists the static entries of the translation table. This method can be used only after the registration
+Method: GET
+Response Json: list of TableEntry
+*/
+func (m *StaticEntriesManager) listStaticEntries(writer http.ResponseWriter, request *http.Request) {
+	log.Println("Received HTTP request - GET /table/static ")
+
+	if *m.WorkerID == "" {
+		log.Printf("[ERROR] Node not initialized")
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(writer).Encode(m.Env.StaticEntries())
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+/*
+Endpoint: /table/static
+Usage: adds a static entry, it replaces the entry with the same namespace IP. The entry is never queried from
+nor expired by the cluster. This method can be used only after the registration
+Method: POST
+Request Json: TableEntry
+Response: 200 OK, or 400 with the validation error
+*/
+func (m *StaticEntriesManager) addStaticEntry(writer http.ResponseWriter, request *http.Request) {
+	log.Println("Received HTTP request - POST /table/static ")
+
+	if *m.WorkerID == "" {
+		log.Printf("[ERROR] Node not initialized")
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reqBody, _ := io.ReadAll(request.Body)
+	var entry TableEntryCache.TableEntry
+	err := json.Unmarshal(reqBody, &entry)
+	if err == nil {
+		err = m.Env.AddStaticEntry(entry)
+	}
+	if err != nil {
+		log.Printf("[ERROR] %v", err)
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+}
+
+/*
+Endpoint: /table/static/{nsip}
+Usage: removes the static entry with the given namespace IP. This method can be used only after the registration
+Method: DELETE
+Response: 200 OK or 404 Not Found
+*/
+func (m *StaticEntriesManager) removeStaticEntry(writer http.ResponseWriter, request *http.Request) {
+	log.Println("Received HTTP request - DELETE /table/static ")
+
+	if *m.WorkerID == "" {
+		log.Printf("[ERROR] Node not initialized")
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	nsip := net.ParseIP(mux.Vars(request)["nsip"])
+	if nsip == nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := m.Env.RemoveStaticEntry(nsip); err != nil {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+}
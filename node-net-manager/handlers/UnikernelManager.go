@@ -47,6 +47,7 @@ Request Json:
 
 	{
 		client_id:string # id of the worker node
+		resolvConf:string # optional, "write" or "bind" to write the resolv.conf of the namespace, "none" by default
 		#TODO
 	}
 
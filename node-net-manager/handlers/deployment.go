@@ -17,6 +17,7 @@ type ContainerDeployTask struct {
 	ServiceName    string `json:"serviceName"`
 	Instancenumber int    `json:"instanceNumber"`
 	PortMappings   string `json:"portMappings"`
+	ResolvConf     string `json:"resolvConf"`
 	Runtime        string
 	PublicAddr     string
 	PublicPort     string
@@ -84,6 +85,9 @@ func deploymentHandler(requestStruct *ContainerDeployTask) (net.IP, net.IP, erro
 	if len(appCompleteName) != 4 {
 		return nil, nil, errors.New(fmt.Sprintf("Invalid app name: %s", appCompleteName))
 	}
+	if err := env.ValidResolvConfMode(requestStruct.ResolvConf); err != nil {
+		return nil, nil, err
+	}
 
 	//attach network to the container
 	netHandler := env.GetNetDeployment(requestStruct.Runtime)
@@ -94,6 +98,15 @@ func deploymentHandler(requestStruct *ContainerDeployTask) (net.IP, net.IP, erro
 		return nil, nil, err
 	}
 
+	//point the service to the node DNS, unless the runtime manages the name resolution
+	err = netHandler.ConfigureNameResolution(requestStruct.Pid, requestStruct.ServiceName, requestStruct.Instancenumber, requestStruct.ResolvConf)
+	if err != nil {
+		logger.ErrorLogger().Printf("Unable to configure the name resolution of %s: %v", requestStruct.ServiceName, err)
+		//the service would not resolve the other services, the deployment fails and the network is released
+		detachNetwork(requestStruct)
+		return nil, nil, err
+	}
+
 	//notify to net-component
 	err = mqtt.NotifyDeploymentStatus(
 		requestStruct.ServiceName,
@@ -112,6 +125,15 @@ func deploymentHandler(requestStruct *ContainerDeployTask) (net.IP, net.IP, erro
 	return addr, addrv6, nil
 }
 
+func detachNetwork(requestStruct *ContainerDeployTask) {
+	switch requestStruct.Runtime {
+	case env.CONTAINER_RUNTIME:
+		requestStruct.Env.DetachContainer(requestStruct.ServiceName, requestStruct.Instancenumber)
+	case env.UNIKERNEL_RUNTIME:
+		requestStruct.Env.DeleteUnikernelNamespace(requestStruct.ServiceName, requestStruct.Instancenumber)
+	}
+}
+
 func updateInternalProxyDataStructures(requestStruct *ContainerDeployTask) {
 	//Update internal table entry if an interest has not been set already.
 	//Otherwise, do nothing, the net will autonomously update.
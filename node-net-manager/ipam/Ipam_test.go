@@ -0,0 +1,111 @@
+package ipam
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestPoolAllocateIPv4(t *testing.T) {
+	pool, err := NewPool("10.19.1.0/29", net.ParseIP("10.19.1.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// network, gateway and broadcast are reserved
+	allocated := make([]net.IP, 0)
+	for i := 0; i < 5; i++ {
+		ip, err := pool.Allocate()
+		if err != nil {
+			t.Fatalf("Allocation %d failed: %v", i, err)
+		}
+		allocated = append(allocated, ip)
+	}
+	if !allocated[0].Equal(net.ParseIP("10.19.1.2")) || !allocated[4].Equal(net.ParseIP("10.19.1.6")) {
+		t.Errorf("Unexpected allocations %v", allocated)
+	}
+	if len(allocated[0]) != net.IPv4len {
+		t.Error("IPv4 addresses must be 4 bytes long")
+	}
+	if _, err := pool.Allocate(); !errors.Is(err, ErrExhausted) {
+		t.Errorf("Expected an exhausted pool, got %v", err)
+	}
+
+	if err := pool.Release(allocated[2]); err != nil {
+		t.Fatal(err)
+	}
+	ip, err := pool.Allocate()
+	if err != nil || !ip.Equal(allocated[2]) {
+		t.Errorf("Expected the released address, got %v %v", ip, err)
+	}
+}
+
+func TestPoolRelease(t *testing.T) {
+	pool, _ := NewPool("10.19.1.0/26", net.ParseIP("10.19.1.1"))
+	ip, _ := pool.Allocate()
+
+	if err := pool.Release(ip); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Release(ip); !errors.Is(err, ErrDoubleFree) {
+		t.Errorf("Expected a double free, got %v", err)
+	}
+	if err := pool.Release(net.ParseIP("10.19.1.1")); !errors.Is(err, ErrReserved) {
+		t.Errorf("The gateway must not be released, got %v", err)
+	}
+	if err := pool.Release(net.ParseIP("10.19.2.1")); !errors.Is(err, ErrNotInPool) {
+		t.Errorf("Expected an address out of the pool, got %v", err)
+	}
+}
+
+func TestPoolNoImmediateReuse(t *testing.T) {
+	pool, _ := NewPool("10.19.1.0/26", net.ParseIP("10.19.1.1"))
+	first, _ := pool.Allocate()
+	_ = pool.Release(first)
+
+	second, _ := pool.Allocate()
+	if second.Equal(first) {
+		t.Error("A released address must not be reused while others are free")
+	}
+}
+
+func TestPoolClaim(t *testing.T) {
+	pool, _ := NewPool("fc00::/120", net.ParseIP("fc00::1"))
+
+	if err := pool.Claim(net.ParseIP("fc00::2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Claim(net.ParseIP("fc00::2")); !errors.Is(err, ErrAllocated) {
+		t.Errorf("Expected an allocated address, got %v", err)
+	}
+	ip, _ := pool.Allocate()
+	if !ip.Equal(net.ParseIP("fc00::3")) {
+		t.Errorf("Expected the next free address, got %v", ip)
+	}
+
+	usage := pool.Usage()
+	// IPv6 has no broadcast address
+	if usage.Subnet != "fc00::/120" || usage.Size != 256 || usage.Reserved != 2 || usage.Allocated != 2 || usage.Free != 252 {
+		t.Errorf("Unexpected usage %+v", usage)
+	}
+}
+
+func TestPoolLargePrefix(t *testing.T) {
+	pool, err := NewPool("fc00::/64", net.ParseIP("fc00::1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage := pool.Usage(); usage.Size != 1<<MAX_POOL_BITS {
+		t.Errorf("Expected the pool to be capped, got %d addresses", usage.Size)
+	}
+	if pool.Contains(net.ParseIP("fc00::1:0:0")) {
+		t.Error("The addresses beyond the cap must not belong to the pool")
+	}
+
+	if _, err := NewPool("10.19.1.0/31"); err == nil {
+		t.Error("A /31 subnetwork is too small")
+	}
+	if _, err := NewPool("10.19.1.0/26", net.ParseIP("10.19.2.1")); !errors.Is(err, ErrNotInPool) {
+		t.Errorf("Expected a gateway out of the subnetwork, got %v", err)
+	}
+}
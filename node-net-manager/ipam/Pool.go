@@ -0,0 +1,197 @@
+package ipam
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+	"sync"
+)
+
+// MAX_POOL_BITS caps the host bits managed by a pool, e.g. only the first 2^16 addresses of an IPv6 /64 are used
+var MAX_POOL_BITS = 16
+
+var (
+	ErrExhausted  = errors.New("address space exhausted")
+	ErrNotInPool  = errors.New("address not in the pool")
+	ErrReserved   = errors.New("address reserved")
+	ErrAllocated  = errors.New("address already allocated")
+	ErrDoubleFree = errors.New("address already free")
+)
+
+// Pool allocates the addresses of a subnetwork, one bit per address.
+// The network address, the broadcast address of IPv4 subnetworks and the given gateways are never allocated.
+type Pool struct {
+	subnet *net.IPNet
+	size   uint64
+	// set bits are in use, either allocated or reserved
+	bitmap    []uint64
+	reserved  map[uint64]bool
+	allocated int
+	// allocations continue after the last allocated address, a released address is not immediately reused
+	next uint64
+	lock sync.Mutex
+}
+
+// Usage describes the occupation of a pool
+type Usage struct {
+	Subnet    string `json:"subnet"`
+	Size      int    `json:"size"`
+	Reserved  int    `json:"reserved"`
+	Allocated int    `json:"allocated"`
+	Free      int    `json:"free"`
+}
+
+// NewPool creates the pool of a subnetwork, in CIDR notation, reserving the gateways
+func NewPool(cidr string, gateways ...net.IP) (*Pool, error) {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, length := subnet.Mask.Size()
+	hostBits := length - ones
+	if hostBits < 2 {
+		return nil, fmt.Errorf("subnetwork %s too small", cidr)
+	}
+	capped := hostBits > MAX_POOL_BITS
+	if capped {
+		hostBits = MAX_POOL_BITS
+	}
+	pool := &Pool{
+		subnet:   subnet,
+		size:     uint64(1) << hostBits,
+		reserved: make(map[uint64]bool),
+	}
+	pool.bitmap = make([]uint64, (pool.size+63)/64)
+
+	pool.reserve(0)
+	if subnet.IP.To4() != nil && !capped {
+		pool.reserve(pool.size - 1)
+	}
+	for _, gateway := range gateways {
+		offset, ok := pool.offset(gateway)
+		if !ok {
+			return nil, fmt.Errorf("gateway %s: %w", gateway, ErrNotInPool)
+		}
+		pool.reserve(offset)
+	}
+	return pool, nil
+}
+
+// Allocate returns a free address
+func (pool *Pool) Allocate() (net.IP, error) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	for i := uint64(0); i < pool.size; i++ {
+		offset := (pool.next + i) % pool.size
+		if !pool.isSet(offset) {
+			pool.set(offset)
+			pool.allocated++
+			pool.next = offset + 1
+			return pool.ip(offset), nil
+		}
+	}
+	return nil, fmt.Errorf("%s: %w", pool.subnet, ErrExhausted)
+}
+
+// Claim allocates the given address, e.g. the address of a service adopted after a restart
+func (pool *Pool) Claim(ip net.IP) error {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	offset, ok := pool.offset(ip)
+	if !ok {
+		return fmt.Errorf("%s: %w", ip, ErrNotInPool)
+	}
+	if pool.reserved[offset] {
+		return fmt.Errorf("%s: %w", ip, ErrReserved)
+	}
+	if pool.isSet(offset) {
+		return fmt.Errorf("%s: %w", ip, ErrAllocated)
+	}
+	pool.set(offset)
+	pool.allocated++
+	return nil
+}
+
+// Release frees an allocated address
+func (pool *Pool) Release(ip net.IP) error {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	offset, ok := pool.offset(ip)
+	if !ok {
+		return fmt.Errorf("%s: %w", ip, ErrNotInPool)
+	}
+	if pool.reserved[offset] {
+		return fmt.Errorf("%s: %w", ip, ErrReserved)
+	}
+	if !pool.isSet(offset) {
+		return fmt.Errorf("%s: %w", ip, ErrDoubleFree)
+	}
+	pool.bitmap[offset/64] &^= 1 << (offset % 64)
+	pool.allocated--
+	return nil
+}
+
+// Contains returns true if the address belongs to the pool
+func (pool *Pool) Contains(ip net.IP) bool {
+	_, ok := pool.offset(ip)
+	return ok
+}
+
+func (pool *Pool) Usage() Usage {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	used := 0
+	for _, word := range pool.bitmap {
+		used += bits.OnesCount64(word)
+	}
+	return Usage{
+		Subnet:    pool.subnet.String(),
+		Size:      int(pool.size),
+		Reserved:  len(pool.reserved),
+		Allocated: pool.allocated,
+		Free:      int(pool.size) - used,
+	}
+}
+
+func (pool *Pool) reserve(offset uint64) {
+	if !pool.isSet(offset) {
+		pool.set(offset)
+		pool.reserved[offset] = true
+	}
+}
+
+func (pool *Pool) isSet(offset uint64) bool {
+	return pool.bitmap[offset/64]&(1<<(offset%64)) != 0
+}
+
+func (pool *Pool) set(offset uint64) {
+	pool.bitmap[offset/64] |= 1 << (offset % 64)
+}
+
+// offset returns the position of the address in the pool
+func (pool *Pool) offset(ip net.IP) (uint64, bool) {
+	if ip == nil || !pool.subnet.Contains(ip) {
+		return 0, false
+	}
+	base := pool.subnet.IP.To16()
+	address := ip.To16()
+	offset := binary.BigEndian.Uint64(address[8:]) - binary.BigEndian.Uint64(base[8:])
+	// the addresses beyond MAX_POOL_BITS are not managed
+	if binary.BigEndian.Uint64(address[:8]) != binary.BigEndian.Uint64(base[:8]) || offset >= pool.size {
+		return 0, false
+	}
+	return offset, true
+}
+
+func (pool *Pool) ip(offset uint64) net.IP {
+	result := make(net.IP, net.IPv6len)
+	base := pool.subnet.IP.To16()
+	copy(result, base)
+	binary.BigEndian.PutUint64(result[8:], binary.BigEndian.Uint64(base[8:])+offset)
+	if pool.subnet.IP.To4() != nil {
+		return result.To4()
+	}
+	return result
+}
@@ -25,6 +25,7 @@ type jobUpdatesTimer struct {
 
 type jobEnvironmentManagerActions interface {
 	RefreshServiceTable(sname string)
+	ApplyServiceUpdate(sname string, update JobUpdate)
 	RemoveServiceEntries(sname string)
 	IsServiceDeployed(fullSnameAndInstance string) bool
 }
@@ -33,9 +34,25 @@ type mqttInterestDeregisterRequest struct {
 	Appname string `json:"appname"`
 }
 
+// JobUpdate is the diff of the instances of a job since the previous version. Removed contains instance numbers.
+type JobUpdate struct {
+	Version uint64            `json:"version"`
+	Added   []ServiceInstance `json:"added"`
+	Changed []ServiceInstance `json:"changed"`
+	Removed []int             `json:"removed"`
+}
+
 func (jut *jobUpdatesTimer) MessageHandler(client mqtt.Client, message mqtt.Message) {
 	log.Printf("Received job update regarding %s", message.Topic())
-	go jut.env.RefreshServiceTable(jut.job)
+	var update JobUpdate
+	err := json.Unmarshal(message.Payload(), &update)
+	if err != nil || update.Version == 0 {
+		// notification without diff, the whole job is queried again
+		go jut.env.RefreshServiceTable(jut.job)
+		return
+	}
+	// diffs are applied synchronously to preserve their order
+	jut.env.ApplyServiceUpdate(jut.job, update)
 }
 
 func (jut *jobUpdatesTimer) startSelfDestructTimeout() {
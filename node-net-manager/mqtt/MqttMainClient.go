@@ -46,7 +46,7 @@ func InitNetMqttClient(clientid string, brokerurl string, brokerport string) *Ne
 			handlerlist := make([]mqtt.MessageHandler, 0)
 			netMqttClient.mqttTopicsMutex.RLock()
 			for key, handler := range netMqttClient.topics {
-				if strings.Contains(msg.Topic(), key) {
+				if topicMatches(key, msg.Topic()) {
 					handlerlist = append(handlerlist, handler)
 				}
 			}
@@ -105,10 +105,15 @@ func (netmqtt *NetMqttClient) runMqttClient(opts *mqtt.ClientOptions) {
 	}
 }
 
-func (netmqtt *NetMqttClient) PublishToBroker(topic string, payload string) error {
+// PublishToBroker publishes the payload to nodes/<clientID>/net/<topic>, the broker keeps the message if retained_optional is true
+func (netmqtt *NetMqttClient) PublishToBroker(topic string, payload string, retained_optional ...bool) error {
+	retained := false
+	if len(retained_optional) > 0 {
+		retained = retained_optional[0]
+	}
 	netmqtt.mqttWriteMutex.Lock()
 	logger.DebugLogger().Printf("MQTT - publish to - %s - the payload - %s", topic, payload)
-	token := netmqtt.mainMqttClient.Publish(fmt.Sprintf("nodes/%s/net/%s", netmqtt.clientID, topic), 1, false, payload)
+	token := netmqtt.mainMqttClient.Publish(fmt.Sprintf("nodes/%s/net/%s", netmqtt.clientID, topic), 1, retained, payload)
 	netmqtt.mqttWriteMutex.Unlock()
 	if token.WaitTimeout(time.Second*5) && token.Error() != nil {
 		log.Printf("ERROR: MQTT PUBLISH: %s", token.Error())
@@ -130,3 +135,24 @@ func (netmqtt *NetMqttClient) DeRegisterTopic(topic string) {
 	netmqtt.mainMqttClient.Unsubscribe(topic)
 	delete(netmqtt.topics, topic) //removing topic from the topic list in case of disconnection
 }
+
+// topicMatches checks the topic against a subscription filter supporting the + and # wildcards
+func topicMatches(filter string, topic string) bool {
+	if !strings.ContainsAny(filter, "+#") {
+		return strings.Contains(topic, filter)
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,194 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type FakeMqttClient struct {
+	mqtt.Client
+	published []string
+	lock      sync.Mutex
+}
+
+func (client *FakeMqttClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	client.published = append(client.published, topic)
+	return &mqtt.DummyToken{}
+}
+
+func (client *FakeMqttClient) publishedCount() int {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return len(client.published)
+}
+
+type FakeMqttMessage struct {
+	mqtt.Message
+	payload []byte
+}
+
+func (msg *FakeMqttMessage) Payload() []byte {
+	return msg.payload
+}
+
+func getFakeTableQueryCache(t *testing.T) (*TableQueryRequestCache, *FakeMqttClient) {
+	client := &FakeMqttClient{}
+	netMqttClient = NetMqttClient{
+		clientID:        "test",
+		mainMqttClient:  client,
+		mqttWriteMutex:  &sync.Mutex{},
+		mqttTopicsMutex: &sync.RWMutex{},
+	}
+	timeout, negativeTTL, maxBackoff := TABLE_QUERY_TIMEOUT, TABLE_QUERY_NEGATIVE_TTL, TABLE_QUERY_MAX_BACKOFF
+	TABLE_QUERY_TIMEOUT = 50 * time.Millisecond
+	TABLE_QUERY_NEGATIVE_TTL = time.Second
+	TABLE_QUERY_MAX_BACKOFF = 4 * time.Second
+	t.Cleanup(func() {
+		TABLE_QUERY_TIMEOUT, TABLE_QUERY_NEGATIVE_TTL, TABLE_QUERY_MAX_BACKOFF = timeout, negativeTTL, maxBackoff
+	})
+	return &TableQueryRequestCache{
+		siprequests: make(map[string]*[]chan TableQueryResponse),
+		failures:    make(map[string]*queryFailure),
+	}, client
+}
+
+func TestTableQueryCoalescing(t *testing.T) {
+	cache, client := getFakeTableQueryCache(t)
+	TABLE_QUERY_TIMEOUT = 5 * time.Second
+
+	results := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := cache.TableQueryByJobNameRequestBlocking("app.ns.svc.default")
+			results <- err
+		}()
+	}
+	// wait for the 3 requests to be registered
+	for deadline := time.Now().Add(time.Second); ; {
+		cache.requestadd.RLock()
+		waiting := 0
+		if requests := cache.siprequests["app.ns.svc.default"]; requests != nil {
+			waiting = len(*requests)
+		}
+		cache.requestadd.RUnlock()
+		if waiting == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("waiting requests = ", waiting, "; want = 3")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	response, _ := json.Marshal(TableQueryResponse{
+		JobName:      "app.ns.svc.default",
+		InstanceList: []ServiceInstance{{InstanceNumber: 0, NamespaceIp: "10.19.1.2"}},
+	})
+	cache.TablequeryResultMqttHandler(nil, &FakeMqttMessage{payload: response})
+	for i := 0; i < 3; i++ {
+		if err := <-results; err != nil {
+			t.Error("Request failed: ", err)
+		}
+	}
+	if client.publishedCount() != 1 {
+		t.Error("published = ", client.publishedCount(), "; want = 1")
+	}
+}
+
+func TestTableQueryBackoff(t *testing.T) {
+	cache, client := getFakeTableQueryCache(t)
+
+	if _, err := cache.TableQueryByIpRequestBlocking("10.30.0.1"); err == nil {
+		t.Fatal("Expected a timeout")
+	}
+	failure := cache.failures["10.30.0.1"]
+	if failure == nil || time.Until(failure.retryAt) > time.Second || time.Until(failure.retryAt) < 900*time.Millisecond {
+		t.Fatal("Expected a first backoff of 1s, got ", failure)
+	}
+	// no new request while the backoff lasts
+	if _, err := cache.TableQueryByIpRequestBlocking("10.30.0.1"); err == nil || client.publishedCount() != 1 {
+		t.Error("Request repeated during the backoff, published = ", client.publishedCount())
+	}
+
+	// each consecutive failure doubles the backoff, up to the maximum
+	for _, expected := range []time.Duration{2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		failure.retryAt = time.Now()
+		cache.queryFailed("10.30.0.1")
+		if backoff := time.Until(failure.retryAt); backoff > expected || backoff < expected-100*time.Millisecond {
+			t.Error("backoff = ", backoff, "; want = ", expected)
+		}
+	}
+}
+
+func TestTableQueryForce(t *testing.T) {
+	cache, client := getFakeTableQueryCache(t)
+	cache.queryFailed("app.ns.svc.default")
+
+	// the update notifications must reach the cluster even after a failure
+	_, _ = cache.TableQueryByJobNameRequestBlocking("app.ns.svc.default", true)
+	if client.publishedCount() != 1 {
+		t.Error("Forced request not published")
+	}
+}
+
+func TestTableQueryFailuresForgotten(t *testing.T) {
+	cache, _ := getFakeTableQueryCache(t)
+	cache.queryFailed("10.30.0.1")
+	cache.failures["10.30.0.1"].forgetAt = time.Now().Add(-time.Millisecond)
+
+	cache.queryFailed("10.30.0.2")
+	if _, exist := cache.failures["10.30.0.1"]; exist {
+		t.Error("Expired failure still remembered")
+	}
+
+	maxFailures := TABLE_QUERY_MAX_FAILURES
+	TABLE_QUERY_MAX_FAILURES = 2
+	defer func() { TABLE_QUERY_MAX_FAILURES = maxFailures }()
+	cache.queryFailed("10.30.0.3")
+	cache.queryFailed("10.30.0.4")
+	if len(cache.failures) != 2 {
+		t.Error("failures = ", len(cache.failures), "; want = 2")
+	}
+	if _, exist := cache.failures["10.30.0.2"]; exist {
+		t.Error("The oldest failure must be forgotten first")
+	}
+}
+
+func TestTableQueryNoInstances(t *testing.T) {
+	cache, _ := getFakeTableQueryCache(t)
+	TABLE_QUERY_TIMEOUT = 5 * time.Second
+	answer := func(key string) {
+		response, _ := json.Marshal(TableQueryResponse{QueryKey: key, InstanceList: []ServiceInstance{}})
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			cache.requestadd.RLock()
+			waiting := cache.siprequests[key] != nil
+			cache.requestadd.RUnlock()
+			if waiting {
+				break
+			}
+		}
+		cache.TablequeryResultMqttHandler(nil, &FakeMqttMessage{payload: response})
+	}
+
+	// an unknown service IP is a failure
+	go answer("10.30.0.1")
+	if _, err := cache.TableQueryByIpRequestBlocking("10.30.0.1"); err == nil {
+		t.Error("Expected an error for an unknown service IP")
+	}
+	if cache.failures["10.30.0.1"] == nil {
+		t.Error("Unknown service IP not remembered")
+	}
+
+	// a job scaled to zero is answered without instances
+	go answer("app.ns.svc.default")
+	response, err := cache.TableQueryByJobNameRequestBlocking("app.ns.svc.default", true)
+	if err != nil || len(response.InstanceList) != 0 || response.JobName != "app.ns.svc.default" {
+		t.Error("Expected an empty answer for the job, got ", response, err)
+	}
+}
@@ -2,8 +2,10 @@ package mqtt
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net"
+	"strings"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -14,6 +16,9 @@ var subnetworkResponseChannel chan string
 type mqttSubnetworkResponse struct {
 	Address    string `json:"address"`
 	Address_v6 string `json:"addressv6"`
+	// prefix lengths of the subnetworks, the node defaults are used if not given
+	Prefix    int `json:"prefix,omitempty"`
+	Prefix_v6 int `json:"prefixv6,omitempty"`
 }
 type mqttSubnetworkRequest struct {
 	METHOD string `json:"METHOD"`
@@ -36,8 +41,16 @@ func subnetworkAssignmentMqttHandler(client mqtt.Client, msg mqtt.Message) {
 		subnetworkResponseChannel <- ""
 		return
 	}
-	subnetworkResponseChannel <- responseStruct.Address
-	subnetworkResponseChannel <- responseStruct.Address_v6
+	subnetworkResponseChannel <- withPrefix(responseStruct.Address, responseStruct.Prefix)
+	subnetworkResponseChannel <- withPrefix(responseStruct.Address_v6, responseStruct.Prefix_v6)
+}
+
+// withPrefix returns the subnetwork in CIDR notation if the prefix length is known
+func withPrefix(address string, prefix int) string {
+	if prefix <= 0 || address == "" || strings.Contains(address, "/") {
+		return address
+	}
+	return fmt.Sprintf("%s/%d", address, prefix)
 }
 
 /*Request a subnetwork to the cluster using the mqtt broker*/
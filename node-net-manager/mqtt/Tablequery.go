@@ -6,6 +6,8 @@ import (
 	"errors"
 	"log"
 	"net"
+	"os"
+	"strconv"
 	"sync"
 	"time"
 
@@ -20,6 +22,18 @@ var (
 
 /*-----------------------------------*/
 
+// TABLE_QUERY_TIMEOUT is the maximum time a table query waits for the answer of the cluster service manager
+var TABLE_QUERY_TIMEOUT = 5 * time.Second
+
+// TABLE_QUERY_NEGATIVE_TTL is the time a failed table query is not repeated, doubled at each consecutive failure
+var TABLE_QUERY_NEGATIVE_TTL = 5 * time.Second
+
+// TABLE_QUERY_MAX_BACKOFF is the maximum time a failing table query is not repeated
+var TABLE_QUERY_MAX_BACKOFF = 2 * time.Minute
+
+// TABLE_QUERY_MAX_FAILURES bounds the failed queries remembered, the oldest is forgotten first
+var TABLE_QUERY_MAX_FAILURES = 4096
+
 /*----- Mqtt Table query cache classes and interfaces -----*/
 type TablequeryMqttInterface interface {
 	TableQueryByIpRequestBlocking(sip string, force_optional ...bool) (TableQueryResponse, error)
@@ -28,7 +42,16 @@ type TablequeryMqttInterface interface {
 
 type TableQueryRequestCache struct {
 	siprequests map[string]*[]chan TableQueryResponse
-	requestadd  sync.RWMutex
+	// negative cache of the failed queries
+	failures   map[string]*queryFailure
+	requestadd sync.RWMutex
+}
+
+type queryFailure struct {
+	count   int
+	retryAt time.Time
+	// without new failures until then the query is forgotten, the next failure starts again from the shortest backoff
+	forgetAt time.Time
 }
 
 /*---------------------------------------------------------*/
@@ -38,6 +61,7 @@ type TableQueryResponse struct {
 	JobName      string            `json:"app_name"`
 	InstanceList []ServiceInstance `json:"instance_list"`
 	QueryKey     string            `json:"query_key"`
+	Version      uint64            `json:"version,omitempty"`
 }
 
 type ServiceInstance struct {
@@ -47,6 +71,9 @@ type ServiceInstance struct {
 	HostIp         string `json:"host_ip"`
 	HostPort       int    `json:"host_port"`
 	ServiceIp      []Sip  `json:"service_ip"`
+	Weight         int    `json:"weight,omitempty"`
+	// exposed ports, same format as the port mappings of a deployment e.g. 80:8080/tcp;53/udp
+	Ports string `json:"ports,omitempty"`
 }
 
 type Sip struct {
@@ -70,16 +97,28 @@ func GetTableQueryRequestCacheInstance() *TableQueryRequestCache {
 
 		tableQueryRequestCacheInstance = TableQueryRequestCache{
 			siprequests: make(map[string]*[]chan TableQueryResponse),
+			failures:    make(map[string]*queryFailure),
 			requestadd:  sync.RWMutex{},
 		}
 
+		negativeTTL, err := strconv.Atoi(os.Getenv("TABLE_QUERY_NEGATIVE_TTL"))
+		if err == nil && negativeTTL > 0 {
+			TABLE_QUERY_NEGATIVE_TTL = time.Duration(negativeTTL) * time.Second
+		}
+		maxBackoff, err := strconv.Atoi(os.Getenv("TABLE_QUERY_MAX_BACKOFF"))
+		if err == nil && maxBackoff > 0 {
+			TABLE_QUERY_MAX_BACKOFF = time.Duration(maxBackoff) * time.Second
+		}
+
 	})
 	return &tableQueryRequestCacheInstance
 }
 
 /*
 Perform a table query by ServiceIp to the cluster manager
-The call is blocking and awaits the response for a maximum of 10 seconds
+The call is blocking and awaits the response for a maximum of TABLE_QUERY_TIMEOUT
+Concurrent requests for the same key wait for the same answer, a single request is published.
+Failed requests are not repeated until their backoff expires.
 set the force value to force the table query even in the event of interest already registered. Used in case of incoming updates notification.
 */
 func (cache *TableQueryRequestCache) tableQueryRequestBlocking(sip string, sname string, force_optional ...bool) (TableQueryResponse, error) {
@@ -96,42 +135,122 @@ func (cache *TableQueryRequestCache) tableQueryRequestBlocking(sip string, sname
 	}
 
 	responseChannel := make(chan TableQueryResponse, 10)
-	var updatedRequests []chan TableQueryResponse
 
 	//appending response channel used by the Mqtt handler
 	cache.requestadd.Lock()
-	siprequests := cache.siprequests[reqname]
-	if siprequests != nil {
+	if failure := cache.failures[reqname]; failure != nil && !force && time.Now().Before(failure.retryAt) {
 		cache.requestadd.Unlock()
-		return TableQueryResponse{}, errors.New("Table query already happening for this address")
-		//updatedRequests = *siprequests
+		return TableQueryResponse{}, errors.New("table query failed recently, retry after backoff")
 	}
-	updatedRequests = append(updatedRequests, responseChannel)
-	cache.siprequests[reqname] = &updatedRequests
+	siprequests := cache.siprequests[reqname]
+	publish := siprequests == nil
+	if publish {
+		siprequests = &[]chan TableQueryResponse{}
+		cache.siprequests[reqname] = siprequests
+	}
+	*siprequests = append(*siprequests, responseChannel)
 	cache.requestadd.Unlock()
 
-	//publishing mqtt message
-	jsonreq, _ := json.Marshal(tableQueryRequest{
-		Sname: sname,
-		Sip:   sip,
-	})
-	_ = GetNetMqttClient().PublishToBroker("tablequery/request", string(jsonreq))
+	//publishing mqtt message, only once for all the waiting requests
+	if publish {
+		jsonreq, _ := json.Marshal(tableQueryRequest{
+			Sname: sname,
+			Sip:   sip,
+		})
+		_ = GetNetMqttClient().PublishToBroker("tablequery/request", string(jsonreq))
+	}
 
-	//waiting for maximum 5 seconds the mqtt handler to receive a response. Otherwise fail the tableQuery.
+	//waiting the mqtt handler to receive a response. Otherwise fail the tableQuery.
 	log.Printf("waiting for table query %s", reqname)
 	select {
 	case result := <-responseChannel:
+		if len(result.InstanceList) == 0 {
+			cache.queryFailed(reqname)
+			// a job without instances is a valid answer, its entries must be cleared
+			if sname == "" && !force {
+				return result, errors.New("table query answered without instances")
+			}
+			if result.JobName == "" {
+				result.JobName = sname
+			}
+		}
 		return result, nil
-	case <-time.After(5 * time.Second):
+	case <-time.After(TABLE_QUERY_TIMEOUT):
 		logger.ErrorLogger().Printf("TIMEOUT - Table query without response, quitting goroutine")
 	}
 
+	cache.removeRequest(reqname, responseChannel)
+	if publish {
+		cache.queryFailed(reqname)
+	}
 	return TableQueryResponse{}, net.UnknownNetworkError("Mqtt Timeout")
 }
 
+// removeRequest removes the response channel of a request that is not waiting anymore
+func (cache *TableQueryRequestCache) removeRequest(reqname string, responseChannel chan TableQueryResponse) {
+	cache.requestadd.Lock()
+	defer cache.requestadd.Unlock()
+	siprequests := cache.siprequests[reqname]
+	if siprequests == nil {
+		return
+	}
+	for i, channel := range *siprequests {
+		if channel == responseChannel {
+			*siprequests = append((*siprequests)[:i], (*siprequests)[i+1:]...)
+			break
+		}
+	}
+	if len(*siprequests) == 0 {
+		delete(cache.siprequests, reqname)
+	}
+}
+
+// queryFailed records the failure of a query and doubles its backoff, up to TABLE_QUERY_MAX_BACKOFF.
+// The failures forgotten meanwhile are removed, only the recent ones are kept.
+func (cache *TableQueryRequestCache) queryFailed(reqname string) {
+	cache.requestadd.Lock()
+	defer cache.requestadd.Unlock()
+	now := time.Now()
+	for key, failure := range cache.failures {
+		if now.After(failure.forgetAt) {
+			delete(cache.failures, key)
+		}
+	}
+	failure := cache.failures[reqname]
+	if failure == nil {
+		if len(cache.failures) >= TABLE_QUERY_MAX_FAILURES {
+			cache.forgetOldestFailure()
+		}
+		failure = &queryFailure{}
+		cache.failures[reqname] = failure
+	} else if now.Before(failure.retryAt) {
+		// already recorded by another waiter
+		return
+	}
+	backoff := TABLE_QUERY_NEGATIVE_TTL << failure.count
+	if backoff > TABLE_QUERY_MAX_BACKOFF || backoff <= 0 {
+		backoff = TABLE_QUERY_MAX_BACKOFF
+	} else {
+		failure.count++
+	}
+	failure.retryAt = now.Add(backoff)
+	failure.forgetAt = failure.retryAt.Add(backoff)
+	logger.DebugLogger().Printf("Table query %s failed, next attempt in %s", reqname, backoff)
+}
+
+func (cache *TableQueryRequestCache) forgetOldestFailure() {
+	oldest := ""
+	for key, failure := range cache.failures {
+		if oldest == "" || failure.forgetAt.Before(cache.failures[oldest].forgetAt) {
+			oldest = key
+		}
+	}
+	delete(cache.failures, oldest)
+}
+
 /*
 Perform a table query by ServiceIp to the cluster manager
-The call is blocking and awaits the response for a maximum of 5 seconds
+The call is blocking and awaits the response for a maximum of TABLE_QUERY_TIMEOUT
 */
 func (cache *TableQueryRequestCache) TableQueryByIpRequestBlocking(sip string, force_optional ...bool) (TableQueryResponse, error) {
 	return cache.tableQueryRequestBlocking(sip, "", force_optional...)
@@ -139,7 +258,7 @@ func (cache *TableQueryRequestCache) TableQueryByIpRequestBlocking(sip string, f
 
 /*
 Perform a table query by ServiceName to the cluster manager
-The call is blocking and awaits the response for a maximum of 5 seconds
+The call is blocking and awaits the response for a maximum of TABLE_QUERY_TIMEOUT
 */
 func (cache *TableQueryRequestCache) TableQueryByJobNameRequestBlocking(jobname string, force_optional ...bool) (TableQueryResponse, error) {
 	return cache.tableQueryRequestBlocking("", jobname, force_optional...)
@@ -181,7 +300,11 @@ func (cache *TableQueryRequestCache) TablequeryResultMqttHandler(client mqtt.Cli
 				logger.DebugLogger().Printf("TableQuery response - channel notified")
 			}
 		}
-		cache.siprequests[key] = nil
+		delete(cache.siprequests, key)
+		//the key exists again
+		if len(responseStruct.InstanceList) > 0 {
+			delete(cache.failures, key)
+		}
 		cache.requestadd.Unlock()
 	}
 }
@@ -0,0 +1,58 @@
+package mqtt
+
+import (
+	"NetManager/logger"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// every node announces its tunnel key with a retained message, new nodes receive all the keys at subscription time
+const tunnelKeyTopic = "nodes/+/net/tunnel/key"
+
+type mqttTunnelKeyAnnouncement struct {
+	Hostip    string `json:"host_ip"`
+	Hostport  string `json:"host_port"`
+	PublicKey []byte `json:"public_key"`
+}
+
+// AnnounceTunnelKey publishes the tunnel public key of this node reachable at hostip:hostport
+func AnnounceTunnelKey(hostip string, hostport string, publicKey []byte) error {
+	announcement := mqttTunnelKeyAnnouncement{
+		Hostip:    hostip,
+		Hostport:  hostport,
+		PublicKey: publicKey,
+	}
+	jsonreq, _ := json.Marshal(announcement)
+	return GetNetMqttClient().PublishToBroker("tunnel/key", string(jsonreq), true)
+}
+
+// SubscribeTunnelKeys calls the handler for each tunnel key announced by the nodes of the cluster, with the ID of
+// the announcing node taken from the topic. The announcements are not signed, the node ID can be trusted only if
+// the broker ACLs allow each node to publish on its own topic alone.
+func SubscribeTunnelKeys(handler func(nodeid string, hostip net.IP, hostport int, publicKey []byte)) {
+	GetNetMqttClient().RegisterTopic(tunnelKeyTopic, func(client mqtt.Client, msg mqtt.Message) {
+		// nodes/<nodeid>/net/tunnel/key
+		nodeid := strings.Split(msg.Topic(), "/")[1]
+		announcement := mqttTunnelKeyAnnouncement{}
+		err := json.Unmarshal(msg.Payload(), &announcement)
+		if err != nil {
+			log.Printf("ERROR - Invalid tunnel key announcement from %s", msg.Topic())
+			return
+		}
+		hostport, err := strconv.Atoi(announcement.Hostport)
+		hostip := net.ParseIP(announcement.Hostip)
+		if err != nil || hostip == nil {
+			log.Printf("ERROR - Invalid tunnel address %s:%s", announcement.Hostip, announcement.Hostport)
+			return
+		}
+		logger.DebugLogger().Printf("Received tunnel key of %s from %s", fmt.Sprintf("%s:%d", hostip, hostport), nodeid)
+		handler(nodeid, hostip, hostport, announcement.PublicKey)
+	})
+	log.Printf("MQTT - Subscribed to %s ", tunnelKeyTopic)
+}
@@ -55,19 +55,17 @@ func NameUniqueHash(name string, size int) string {
 	return hashedAndEncoded[:size]
 }
 
-// Given an IP, give IP+inc
-// TODO rework, since it is not safe for use
+// NextIP returns IP+inc, the given IP is not modified. The result has the length of the given IP.
 func NextIP(ip net.IP, inc uint) net.IP {
-	ipBytes := ip.To16()
-	for i := len(ipBytes) - 1; i >= 0; i-- {
-		if ipBytes[i] == 255 {
-			ipBytes[i] = 0
-		} else {
-			ipBytes[i] = ipBytes[i] + byte(inc)
-			break
-		}
+	result := make(net.IP, len(ip))
+	copy(result, ip)
+	carry := uint64(inc)
+	for i := len(result) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(result[i]) + carry
+		result[i] = byte(sum)
+		carry = sum >> 8
 	}
-	return net.IP(ipBytes)
+	return result
 }
 
 //Given an ipv4, gives the next IP
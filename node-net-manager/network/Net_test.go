@@ -99,6 +99,18 @@ func TestIncIP_simple(t *testing.T) {
 	}
 }
 
+func TestIncIP_carry(t *testing.T) {
+	ip := net.ParseIP("10.19.0.255")
+
+	inc := NextIP(ip, 258)
+	if !inc.Equal(net.ParseIP("10.19.2.1")) {
+		t.Fatalf("Problem in NextIP function, got %s", inc)
+	}
+	if !ip.Equal(net.ParseIP("10.19.0.255")) {
+		t.Fatal("NextIP must not modify its argument")
+	}
+}
+
 type mockiptable struct {
 	CalledWith []string
 }
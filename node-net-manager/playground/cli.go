@@ -5,6 +5,7 @@ import (
 	"NetManager/proxy"
 	"fmt"
 	"log"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -20,12 +21,10 @@ var ENV *env.Environment
 var PROXY proxy.GoProxyTunnel
 var APP *tview.Application
 var Services [][]string
-var Entries [][]string
 var killchan []*chan bool
 
 func CliLoop(addr string, port string) {
 	Services = make([][]string, 0)
-	Entries = make([][]string, 0)
 	killchan = make([]*chan bool, 0)
 	PUBLIC_ADDRESS = addr
 	PUBLIC_PORT, _ = strconv.Atoi(port)
@@ -54,6 +53,11 @@ func initEnv(addr string, port string) {
 	PROXY.Listen()
 	cleanAll()
 
+	//the playground routes only have IPv4 addresses
+	if os.Getenv("TABLE_ADDRESS_FAMILY") == "" {
+		_ = os.Setenv("TABLE_ADDRESS_FAMILY", "ipv4")
+	}
+
 	//initialize the Env Manager
 	config := env.Configuration{
 		HostBridgeName:             "goProxyBridge",
@@ -259,7 +263,7 @@ func p2pSync() {
 		}).
 		AddButton("Sync", func() {
 			APP.Stop()
-			err := AskSync(address, port, Entries)
+			err := AskSync(address, port)
 			if err != nil {
 				log.Printf("ERROR: impossible to sync: %v", err)
 			}
@@ -280,7 +284,8 @@ func listRoutes() {
 	table := tview.NewTable().
 		SetBorders(true)
 	colsNames := strings.Split("index appname nsIP instanceIP RR_IP nodeIP port", " ")
-	cols, rows := 7, len(Entries)+1
+	routes := Routes()
+	cols, rows := 7, len(routes)+1
 	word := 0
 	for r := 0; r < rows; r++ {
 		for c := 0; c < cols; c++ {
@@ -300,7 +305,7 @@ func listRoutes() {
 							SetAlign(tview.AlignCenter))
 				} else {
 					table.SetCell(r, c,
-						tview.NewTableCell(Entries[r-1][c-1]).
+						tview.NewTableCell(EntryToString(routes[r-1])[c-1]).
 							SetTextColor(color).
 							SetAlign(tview.AlignCenter))
 				}
@@ -326,7 +331,8 @@ func removeRoutes() {
 	table := tview.NewTable().
 		SetBorders(true)
 	colsNames := strings.Split("index appname nsIP instanceIP RR_IP nodeIP port", " ")
-	cols, rows := 7, len(Entries)+1
+	routes := Routes()
+	cols, rows := 7, len(routes)+1
 	word := 0
 	for r := 0; r < rows; r++ {
 		for c := 0; c < cols; c++ {
@@ -346,7 +352,7 @@ func removeRoutes() {
 							SetAlign(tview.AlignCenter))
 				} else {
 					table.SetCell(r, c,
-						tview.NewTableCell(Entries[r-1][c-1]).
+						tview.NewTableCell(EntryToString(routes[r-1])[c-1]).
 							SetTextColor(color).
 							SetAlign(tview.AlignCenter))
 				}
@@ -364,8 +370,7 @@ func removeRoutes() {
 	}).SetSelectedFunc(func(row int, column int) {
 		if row > 0 {
 			APP.Stop()
-			ENV.RemoveNsIPEntries(Entries[row-1][1])
-			Entries = append(Entries[:row-1], Entries[row:]...)
+			_ = ENV.RemoveStaticEntry(routes[row-1].Nsip)
 			listRoutes()
 		}
 	})
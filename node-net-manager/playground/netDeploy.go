@@ -3,8 +3,11 @@ package playground
 import (
 	"NetManager/TableEntryCache"
 	"NetManager/env"
+	"bytes"
 	"fmt"
+	"log"
 	"net"
+	"sort"
 	"strconv"
 )
 
@@ -45,49 +48,22 @@ func attachNetwork(appname string, pid int, instance int, mappings string, iip s
 	return fmt.Sprintf("%s", addr.String()), nil
 }
 
+// AddRoute adds the entry as a static route, it replaces the route with the same namespace IP
 func AddRoute(entry TableEntryCache.TableEntry) {
-	if !entryExist(entry) {
-		ENV.AddTableQueryEntry(entry)
-		Entries = append(Entries, EntryToString(entry))
+	if err := ENV.AddStaticEntry(entry); err != nil {
+		log.Printf("ERROR: invalid route: %v", err)
 	}
 }
 
-func StringToEntry(entry []string) TableEntryCache.TableEntry {
-	port, _ := strconv.Atoi(entry[5])
-	instance, _ := strconv.Atoi(entry[6])
-	return TableEntryCache.TableEntry{
-		JobName:          entry[0],
-		Appname:          entry[0],
-		Appns:            "default",
-		Servicename:      "test",
-		Servicenamespace: "default",
-		Instancenumber:   instance,
-		Cluster:          0,
-		Nodeip:           net.ParseIP(entry[4]),
-		Nodeport:         port,
-		Nsip:             net.ParseIP(entry[1]),
-		ServiceIP: []TableEntryCache.ServiceIP{
-			{
-				IpType:  TableEntryCache.InstanceNumber,
-				Address: net.ParseIP(entry[2]),
-			},
-			{
-				IpType:  TableEntryCache.RoundRobin,
-				Address: net.ParseIP(entry[3]),
-			},
-		},
-	}
+// Routes returns the static routes sorted by namespace IP
+func Routes() []TableEntryCache.TableEntry {
+	routes := ENV.StaticEntries()
+	sort.Slice(routes, func(i, j int) bool {
+		return bytes.Compare(routes[i].Nsip.To16(), routes[j].Nsip.To16()) < 0
+	})
+	return routes
 }
 
 func EntryToString(entry TableEntryCache.TableEntry) []string {
 	return []string{entry.Appname, fmt.Sprintf("%s", entry.Nsip.String()), fmt.Sprintf("%s", entry.ServiceIP[0].Address.String()), fmt.Sprintf("%s", entry.ServiceIP[1].Address.String()), fmt.Sprintf("%s", entry.Nodeip.String()), strconv.Itoa(entry.Nodeport), strconv.Itoa(entry.Instancenumber)}
 }
-
-func entryExist(toAdd TableEntryCache.TableEntry) bool {
-	for _, entry := range Entries {
-		if entry[1] == fmt.Sprintf("%s", toAdd.Nsip.String()) {
-			return true
-		}
-	}
-	return false
-}
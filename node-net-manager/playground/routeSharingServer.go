@@ -15,10 +15,10 @@ type SyncPacket struct {
 	EntryList []TableEntryCache.TableEntry `json:"entry_list"`
 }
 
-func AskSync(ip string, port string, entries [][]string) error {
+func AskSync(ip string, port string) error {
 	RequestUrl := fmt.Sprintf("http://%s:%s/sync", ip, port)
 	req := SyncPacket{
-		EntryList: entriesToList(entries),
+		EntryList: ENV.StaticEntries(),
 	}
 	body, err := json.Marshal(req)
 	if err != nil {
@@ -62,7 +62,7 @@ func handleSync(writer http.ResponseWriter, request *http.Request) {
 	for _, entry := range syncPacket.EntryList {
 		AddRoute(entry)
 	}
-	syncPacket.EntryList = entriesToList(Entries)
+	syncPacket.EntryList = ENV.StaticEntries()
 	body, err := json.Marshal(syncPacket)
 	if err != nil {
 		writer.WriteHeader(500)
@@ -75,11 +75,3 @@ func handleSync(writer http.ResponseWriter, request *http.Request) {
 	}
 
 }
-
-func entriesToList(entries [][]string) []TableEntryCache.TableEntry {
-	res := make([]TableEntryCache.TableEntry, 0)
-	for _, entry := range entries {
-		res = append(res, StringToEntry(entry))
-	}
-	return res
-}
@@ -10,8 +10,10 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"runtime"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/songgao/water"
 )
@@ -61,6 +63,35 @@ func New() GoProxyTunnel {
 		proxyIPv6SubnetworkPrefix = 7
 	}
 
+	flowTableSize, err := strconv.Atoi(os.Getenv("PROXY_FLOW_TABLE_SIZE"))
+	if err == nil && flowTableSize > 0 {
+		FLOW_TABLE_SIZE = flowTableSize
+	}
+	flowIdleTimeout, err := strconv.Atoi(os.Getenv("PROXY_FLOW_TIMEOUT"))
+	if err == nil && flowIdleTimeout > 0 {
+		FLOW_IDLE_TIMEOUT = time.Duration(flowIdleTimeout) * time.Second
+	}
+	tcpEstablishedTimeout, err := strconv.Atoi(os.Getenv("PROXY_TCP_ESTABLISHED_TIMEOUT"))
+	if err == nil && tcpEstablishedTimeout > 0 {
+		TCP_ESTABLISHED_TIMEOUT = time.Duration(tcpEstablishedTimeout) * time.Second
+	}
+	logger.InfoLogger().Printf("Proxy flow table size %d, idle timeout %s, established TCP timeout %s",
+		FLOW_TABLE_SIZE, FLOW_IDLE_TIMEOUT, TCP_ESTABLISHED_TIMEOUT)
+
+	// opt-in, the nodes without a key can't talk to the encrypting ones, e.g. during a rolling upgrade
+	tunnelEncryption := os.Getenv("TUNNEL_ENCRYPTION")
+	if len(tunnelEncryption) == 0 {
+		logger.InfoLogger().Printf("Default to tunnel encryption disabled")
+		tunnelEncryption = "false"
+	}
+	mssClamp := os.Getenv("PROXY_MSS_CLAMP") == "true"
+	workers, err := strconv.Atoi(os.Getenv("PROXY_WORKERS"))
+	if err != nil || workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	multiQueue := os.Getenv("PROXY_TUN_MULTIQUEUE") == "true"
+	logger.InfoLogger().Printf("Proxy packet workers %d, multi-queue TUN %t", workers, multiQueue)
+
 	tunconfig := Configuration{
 		HostTUNDeviceName:         "goProxyTun",
 		ProxySubnetwork:           proxySubnetwork,
@@ -71,6 +102,10 @@ func New() GoProxyTunnel {
 		TunNetIPv6:                tunNetIPv6,
 		ProxySubnetworkIPv6Prefix: proxyIPv6SubnetworkPrefix,
 		ProxySubnetworkIPv6:       proxyIPv6Subnetwork,
+		TunnelEncryption:          tunnelEncryption == "true",
+		MSSClamp:                  mssClamp,
+		Workers:                   workers,
+		MultiQueue:                multiQueue,
 	}
 	return NewCustom(tunconfig)
 }
@@ -82,15 +117,25 @@ func NewCustom(configuration Configuration) GoProxyTunnel {
 		errorChannel:     make(chan error),
 		finishChannel:    make(chan bool),
 		stopChannel:      make(chan bool),
-		connectionBuffer: make(map[string]*net.UDPConn),
 		proxycache:       NewProxyCache(),
-		udpwrite:         sync.RWMutex{},
-		tunwrite:         sync.RWMutex{},
-		incomingChannel:  make(chan incomingMessage, 1000),
-		outgoingChannel:  make(chan outgoingMessage, 1000),
+		peers:            &sync.Map{},
 		mtusize:          configuration.Mtusize,
-		randseed:         rand.New(rand.NewSource(42)),
+		randseed:         rand.New(newLockedSource(time.Now().UnixNano())),
+		balancer:         NewServiceBalancer(),
+		tunnelEncryption: configuration.TunnelEncryption,
+		versions:         NewPeerVersions(),
+		pathMTU:          NewPathMTUCache(),
+		pending:          NewPendingQueue(),
+		mssClamp:         configuration.MSSClamp,
+		latency:          NewLatencyStore(),
+		probeChannel:     make(chan *net.UDPAddr, 100),
+		multiQueue:       configuration.MultiQueue,
+	}
+	workers := configuration.Workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
 	}
+	proxy.outgoingChannel, proxy.incomingChannel = newWorkerChannels(workers)
 
 	//parse configuration file
 	tunconfig := configuration
@@ -113,6 +158,7 @@ func NewCustom(configuration Configuration) GoProxyTunnel {
 	//set local ip
 	ipstring, _ := network.GetLocalIPandIface()
 	proxy.localIP = net.ParseIP(ipstring)
+	proxy.nodeID = NodeID(proxy.localIP, proxy.TunnelPort)
 
 	logger.InfoLogger().Printf("Created ProxyTun device: %s\n", proxy.ifce.Name())
 	logger.InfoLogger().Printf("Local Ip detected: %s\n", proxy.localIP.String())
@@ -121,7 +167,13 @@ func NewCustom(configuration Configuration) GoProxyTunnel {
 }
 
 func (proxy *GoProxyTunnel) SetEnvironment(env env.EnvironmentManager) {
+	if proxy.stopTableWatch != nil {
+		proxy.stopTableWatch()
+	}
 	proxy.environment = env
+	changes, stop := env.WatchTable()
+	proxy.stopTableWatch = stop
+	go proxy.tableChangesListener(changes)
 }
 
 func (proxy *GoProxyTunnel) IsListening() bool {
@@ -134,6 +186,8 @@ func (proxy *GoProxyTunnel) Listen() {
 		logger.InfoLogger().Println("Starting proxy listening mode")
 		go proxy.tunOutgoingListen()
 		go proxy.tunIngoingListen()
+		go proxy.latencyProbing()
+		go proxy.flowJanitor()
 	}
 }
 
@@ -144,10 +198,23 @@ func (proxy *GoProxyTunnel) createTun() {
 		DeviceType: water.TUN,
 	}
 	config.Name = proxy.HostTUNDeviceName
+	config.MultiQueue = proxy.multiQueue
 	ifce, err := water.New(config)
 	if err != nil {
 		log.Fatal(err)
 	}
+	//one queue for each worker, the kernel spreads the flows across the queues
+	if proxy.multiQueue {
+		proxy.tunQueues = append(proxy.tunQueues, ifce)
+		config.Name = ifce.Name()
+		for len(proxy.tunQueues) < len(proxy.incomingChannel) {
+			queue, err := water.New(config)
+			if err != nil {
+				log.Fatal(err)
+			}
+			proxy.tunQueues = append(proxy.tunQueues, queue)
+		}
+	}
 
 	logger.InfoLogger().Println("Bringing tun up with addr " + proxy.tunNetIP + "/12")
 	cmd := exec.Command("ip", "addr", "add", proxy.tunNetIP+"/12", "dev", ifce.Name())
@@ -10,6 +10,7 @@ import (
 	"math/rand"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -31,11 +32,16 @@ type Configuration struct {
 	TunNetIPv6                string
 	ProxySubnetworkIPv6Prefix int
 	ProxySubnetworkIPv6       string
+
+	TunnelEncryption bool
+	MSSClamp         bool
+	Workers          int
+	MultiQueue       bool
 }
 
 type GoProxyTunnel struct {
 	stopChannel       chan bool
-	connectionBuffer  map[string]*net.UDPConn
+	peers             *sync.Map
 	finishChannel     chan bool
 	errorChannel      chan error
 	tunNetIP          string
@@ -47,14 +53,25 @@ type GoProxyTunnel struct {
 	listenConnection  *net.UDPConn
 	bufferPort        int
 	environment       env.EnvironmentManager
-	proxycache        ProxyCache
+	proxycache        *ProxyCache
 	localIP           net.IP
-	udpwrite          sync.RWMutex
-	tunwrite          sync.RWMutex
-	incomingChannel   chan incomingMessage
-	outgoingChannel   chan outgoingMessage
+	incomingChannel   []chan incomingMessage
+	outgoingChannel   []chan outgoingMessage
+	tunQueues         []*water.Interface
+	multiQueue        bool
 	mtusize           string
 	randseed          *rand.Rand
+	latency           *LatencyStore
+	balancer          *ServiceBalancer
+	tunnelEncryption  bool
+	crypto            *TunnelCrypto
+	nodeID            uint32
+	versions          *PeerVersions
+	probeChannel      chan *net.UDPAddr
+	pathMTU           *PathMTUCache
+	pending           *PendingQueue
+	mssClamp          bool
+	stopTableWatch    func()
 
 	tunNetIPv6          string
 	ProxyIPv6Subnetwork net.IPNet
@@ -64,112 +81,138 @@ type GoProxyTunnel struct {
 type incomingMessage struct {
 	from    net.UDPAddr
 	content *[]byte
+	// pooled buffer holding the content, released once the message is handled
+	buffer *[]byte
 }
 
 // outgoing message from bridge
 type outgoingMessage struct {
 	content *[]byte
+	// pooled buffer holding the content, released once the message is handled
+	buffer *[]byte
 }
 
-// handler function for all outgoing messages that are received by the TUN device
-func (proxy *GoProxyTunnel) outgoingMessage() {
+// handler function for the outgoing messages that are received by the TUN device and assigned to the worker
+func (proxy *GoProxyTunnel) outgoingMessage(worker int) {
 	for {
 		select {
-		case msg := <-proxy.outgoingChannel:
-			//logger.DebugLogger().Println("outgoingChannelSize: ", len(proxy.outgoingChannel))
-			logger.DebugLogger().Printf("Msg outgoingChannel: %x\n", (*msg.content))
-			ip, prot := decodePacket(*msg.content)
-			if ip == nil {
-				continue
-			}
-			logger.DebugLogger().Printf("Outgoing packet:\t\t\t%s ---> %s\n", ip.GetSrcIP().String(), ip.GetDestIP().String())
+		case msg := <-proxy.outgoingChannel[worker]:
+			proxy.handleOutgoingMessage(msg)
+			releaseBuffer(msg.buffer)
+		}
+	}
+}
 
-			// continue only if the packet is udp or tcp, otherwise just drop it
-			if prot == nil {
-				logger.DebugLogger().Println("Neither TCP, nor UDP packet received. Dropping it.")
-				continue
-			}
-			//proxyConversion
-			newPacket := proxy.outgoingProxy(ip, prot)
-			if newPacket == nil {
-				//if no proxy conversion available, drop it
-				logger.ErrorLogger().Println("Unable to convert the packet")
-				continue
-			}
+func (proxy *GoProxyTunnel) handleOutgoingMessage(msg outgoingMessage) {
+	//logger.DebugLogger().Println("outgoingChannelSize: ", len(proxy.outgoingChannel))
+	logger.DebugLogger().Printf("Msg outgoingChannel: %x\n", (*msg.content))
+	ip, prot := decodePacket(*msg.content)
+	if ip == nil {
+		return
+	}
+	logger.DebugLogger().Printf("Outgoing packet:\t\t\t%s ---> %s\n", ip.GetSrcIP().String(), ip.GetDestIP().String())
 
-			//fetch remote address
-			dstHost, dstPort := proxy.locateRemoteAddress(ip.GetDestIP())
+	// continue only if the packet is udp, tcp or icmp, otherwise just drop it
+	if prot == nil {
+		logger.DebugLogger().Println("Neither TCP, UDP nor ICMP packet received. Dropping it.")
+		return
+	}
+	//packets towards unknown ServiceIPs wait for the table query without blocking the worker
+	var tableEntryList []TableEntryCache.TableEntry
+	if proxy.isServiceIP(ip) {
+		tableEntryList = proxy.environment.LookupTableEntryByServiceIP(ip.GetDestIP())
+		if len(tableEntryList) < 1 {
+			proxy.deferPacket(ip.GetDestIP(), *msg.content)
+			return
+		}
+	}
+
+	//proxyConversion
+	newPacket := proxy.outgoingProxy(ip, prot, tableEntryList)
+	if newPacket == nil {
+		//if no proxy conversion available, drop it
+		logger.ErrorLogger().Println("Unable to convert the packet")
+		return
+	}
+
+	//fetch remote address
+	dstHost, dstPort := proxy.locateRemoteAddress(ip.GetDestIP())
 
-			//packetForwarding to tunnel interface
-			proxy.forward(dstHost, dstPort, newPacket, 0)
+	//packets that don't fit the path MTU are answered with an ICMP error
+	if !proxy.checkPathMTU(*msg.content, dstHost, dstPort) {
+		return
+	}
+	if proxy.mssClamp {
+		if maxSize, known := proxy.maxPacketSize(dstHost, dstPort); known && clampMSS(prot, maxSize, ip.GetProtocolVersion() == 6) {
+			newPacket = ip.SerializePacket(ip.GetDestIP(), ip.GetSrcIP(), prot)
 		}
 	}
+
+	//packetForwarding to tunnel interface
+	proxy.forward(dstHost, dstPort, newPacket, 0)
 }
 
-// handler function for all ingoing messages that are received by the UDP socket
-func (proxy *GoProxyTunnel) ingoingMessage() {
+// handler function for the ingoing messages that are received by the UDP socket and assigned to the worker
+func (proxy *GoProxyTunnel) ingoingMessage(worker int) {
 	for {
 		select {
-		case msg := <-proxy.incomingChannel:
-			//logger.DebugLogger().Println("ingoingChannelSize: ", len(proxy.incomingChannel))
-			logger.DebugLogger().Printf("Msg incomingChannel: %x\n", (*msg.content))
-			ip, prot := decodePacket(*msg.content)
+		case msg := <-proxy.incomingChannel[worker]:
+			proxy.handleIngoingMessage(msg, proxy.tunQueue(worker))
+			releaseBuffer(msg.buffer)
+		}
+	}
+}
 
-			// proceed only if this is a valid ip packet
-			if ip == nil {
-				continue
-			}
-			logger.DebugLogger().Printf("Ingoing packet:\t\t\t %s <--- %s\n", ip.GetDestIP().String(), ip.GetSrcIP().String())
+func (proxy *GoProxyTunnel) handleIngoingMessage(msg incomingMessage, ifce *water.Interface) {
+	//logger.DebugLogger().Println("ingoingChannelSize: ", len(proxy.incomingChannel))
+	logger.DebugLogger().Printf("Msg incomingChannel: %x\n", (*msg.content))
+	ip, prot := decodePacket(*msg.content)
 
-			// continue only if the packet is udp or tcp, otherwise just drop it
-			if prot == nil {
-				continue
-			}
+	// proceed only if this is a valid ip packet
+	if ip == nil {
+		return
+	}
+	logger.DebugLogger().Printf("Ingoing packet:\t\t\t %s <--- %s\n", ip.GetDestIP().String(), ip.GetSrcIP().String())
 
-			// proxyConversion
-			newPacket := proxy.ingoingProxy(ip, prot)
-			var packetBytes []byte
-			if newPacket == nil {
-				//no conversion data, forward as is
-				packetBytes = *msg.content
-			} else {
-				packetBytes = packetToByte(newPacket)
-			}
-			// output to bridge interface
-			_, err := proxy.ifce.Write(packetBytes)
-			if err != nil {
-				logger.ErrorLogger().Println(err)
-			}
-		}
+	// continue only if the packet is udp, tcp or icmp, otherwise just drop it
+	if prot == nil {
+		return
+	}
+
+	// proxyConversion
+	newPacket := proxy.ingoingProxy(ip, prot)
+	var packetBytes []byte
+	if newPacket == nil {
+		//no conversion data, forward as is
+		packetBytes = *msg.content
+	} else {
+		packetBytes = packetToByte(newPacket)
+	}
+	// output to bridge interface
+	_, err := ifce.Write(packetBytes)
+	if err != nil {
+		logger.ErrorLogger().Println(err)
 	}
 }
 
 // If packet destination is in the range of proxy.ProxyIpSubnetwork
-// then find enable load balancing policy and find out the actual dstIP address
-func (proxy *GoProxyTunnel) outgoingProxy(ip iputils.NetworkLayerPacket, prot iputils.TransportLayerProtocol) gopacket.Packet {
+// then find enable load balancing policy and find out the actual dstIP address.
+// tableEntryList contains the entries of the destination ServiceIP.
+func (proxy *GoProxyTunnel) outgoingProxy(ip iputils.NetworkLayerPacket, prot iputils.TransportLayerProtocol, tableEntryList []TableEntryCache.TableEntry) gopacket.Packet {
 	dstIP := ip.GetDestIP()
 	srcIP := ip.GetSrcIP()
-	var semanticRoutingSubnetwork bool
 	srcport := -1
 	dstport := -1
+	protocol := ""
 	if prot != nil {
 		srcport = int(prot.GetSourcePort())
 		dstport = int(prot.GetDestPort())
+		protocol = flowProtocol(prot)
 	}
 
 	//If packet destination is part of the semantic routing subnetwork let the proxy handle it
-	if ip.GetProtocolVersion() == 4 {
-		semanticRoutingSubnetwork = proxy.ProxyIpSubnetwork.IP.Mask(proxy.ProxyIpSubnetwork.Mask).
-			Equal(ip.GetDestIP().Mask(proxy.ProxyIpSubnetwork.Mask))
-	}
-	if ip.GetProtocolVersion() == 6 {
-		semanticRoutingSubnetwork = proxy.ProxyIPv6Subnetwork.IP.Mask(proxy.ProxyIPv6Subnetwork.Mask).
-			Equal(ip.GetDestIP().Mask(proxy.ProxyIPv6Subnetwork.Mask))
-	}
-
-	if semanticRoutingSubnetwork {
+	if proxy.isServiceIP(ip) {
 		//Check if the ServiceIP is known
-		tableEntryList := proxy.environment.GetTableEntryByServiceIP(dstIP)
 		if len(tableEntryList) < 1 {
 			return nil
 		}
@@ -181,45 +224,125 @@ func (proxy *GoProxyTunnel) outgoingProxy(ip iputils.NetworkLayerPacket, prot ip
 		}
 
 		//Check proxy proxycache (if any active flow is there already)
-		entry, exist := proxy.proxycache.RetrieveByServiceIP(srcIP, instanceIP, srcport, dstIP, dstport)
+		entry, exist := proxy.proxycache.RetrieveByServiceIP(protocol, srcIP, srcport, dstIP, dstport, prot)
 
-		if !exist || entry.dstport < 1 || !TableEntryCache.IsNamespaceStillValid(entry.dstip, &tableEntryList) {
+		//Established connections stay on their instance until they are closed
+		if !exist || entry.dstport < 1 || !entry.pinned() && !TableEntryCache.IsNamespaceStillValid(entry.dstip, &tableEntryList) {
 			//Choose between the table entry according to the ServiceIP algorithm
-			//TODO: so far this only uses RR, ServiceIP policies should be implemented here
-			tableEntry := tableEntryList[proxy.randseed.Intn(len(tableEntryList))]
+			tableEntry := proxy.selectTableEntry(dstIP, tableEntryList)
 
 			entryDstIP := tableEntry.Nsipv6
 			if ip.GetProtocolVersion() == 4 {
 				entryDstIP = tableEntry.Nsip
 			}
+			entryDstInstanceIP := instanceNumberIP(tableEntry, ip.GetProtocolVersion())
 
 			//Update proxycache
 			entry = ConversionEntry{
+				protocol:      protocol,
 				srcip:         srcIP,
 				dstip:         entryDstIP,
 				dstServiceIp:  dstIP,
 				srcInstanceIp: instanceIP,
+				dstInstanceIp: entryDstInstanceIP,
 				srcport:       srcport,
 				dstport:       dstport,
 			}
-			proxy.proxycache.Add(entry)
+			proxy.proxycache.Add(entry, prot)
 		}
 		return ip.SerializePacket(entry.dstip, entry.srcInstanceIp, prot)
 	}
 	return nil
 }
 
+// Returns true if the packet destination is part of the semantic routing subnetwork
+func (proxy *GoProxyTunnel) isServiceIP(ip iputils.NetworkLayerPacket) bool {
+	if ip.GetProtocolVersion() == 4 {
+		return proxy.ProxyIpSubnetwork.IP.Mask(proxy.ProxyIpSubnetwork.Mask).
+			Equal(ip.GetDestIP().Mask(proxy.ProxyIpSubnetwork.Mask))
+	}
+	if ip.GetProtocolVersion() == 6 {
+		return proxy.ProxyIPv6Subnetwork.IP.Mask(proxy.ProxyIPv6Subnetwork.Mask).
+			Equal(ip.GetDestIP().Mask(proxy.ProxyIPv6Subnetwork.Mask))
+	}
+	return false
+}
+
+// Choose the instance that serves the packet according to the balancing policy of the destination ServiceIP
+func (proxy *GoProxyTunnel) selectTableEntry(dstIP net.IP, tableEntryList []TableEntryCache.TableEntry) TableEntryCache.TableEntry {
+	ipType, _ := TableEntryCache.GetServiceIpType(dstIP, &tableEntryList)
+	switch ipType {
+	case TableEntryCache.Closest:
+		return proxy.closestTableEntry(tableEntryList)
+	default:
+		// the flow stays on the selected instance through the proxycache
+		return proxy.balancer.Next(dstIP, tableEntryList)
+	}
+}
+
+// ICMP errors belong to the flow of the packet that caused them
+func flowProtocol(prot iputils.TransportLayerProtocol) string {
+	if icmp, ok := prot.(iputils.ICMPLayerProtocol); ok && icmp.IsError() {
+		return icmp.EmbeddedProtocol()
+	}
+	return prot.GetProtocol()
+}
+
+// replies come from the instance, ICMP errors may come from any router and carry the instance IP in the embedded packet
+func flowSourceIP(ip iputils.NetworkLayerPacket, prot iputils.TransportLayerProtocol) net.IP {
+	if icmp, ok := prot.(iputils.ICMPLayerProtocol); ok && icmp.IsError() {
+		if embeddedIP := icmp.EmbeddedDestIP(); embeddedIP != nil {
+			return embeddedIP
+		}
+	}
+	return ip.GetSrcIP()
+}
+
+// removes the flows towards the instances removed from the translation table and the balancing state of the
+// ServiceIPs left without instances. If changes are lost the stale flows are left to the flowJanitor.
+func (proxy *GoProxyTunnel) tableChangesListener(changes <-chan TableEntryCache.TableChange) {
+	for change := range changes {
+		if change.Type != TableEntryCache.EntryRemoved {
+			continue
+		}
+		removed := proxy.proxycache.RemoveByDestination(change.Entry.Nsip)
+		if change.Entry.Nsipv6 != nil {
+			removed += proxy.proxycache.RemoveByDestination(change.Entry.Nsipv6)
+		}
+		if removed > 0 {
+			logger.DebugLogger().Printf("Removed %d flows towards %s.%d\n", removed, change.Entry.JobName, change.Entry.Instancenumber)
+		}
+		for _, sip := range change.Entry.ServiceIP {
+			if sip.IpType != TableEntryCache.RoundRobin {
+				continue
+			}
+			for _, address := range []net.IP{sip.Address, sip.Address_v6} {
+				if address != nil && len(proxy.environment.LookupTableEntryByServiceIP(address)) == 0 {
+					proxy.balancer.Forget(address)
+				}
+			}
+		}
+	}
+}
+
+// periodically removes the idle flows from the proxycache
+func (proxy *GoProxyTunnel) flowJanitor() {
+	ticker := time.NewTicker(FLOW_IDLE_TIMEOUT / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		removed := proxy.proxycache.Sweep()
+		if removed > 0 {
+			logger.DebugLogger().Printf("Removed %d idle flows, %d flows active\n", removed, proxy.proxycache.Len())
+		}
+	}
+}
+
 func (proxy *GoProxyTunnel) convertToInstanceIp(ip iputils.NetworkLayerPacket) (net.IP, error) {
 	instanceTableEntry, instanceexist := proxy.environment.GetTableEntryByNsIP(ip.GetSrcIP())
 	instanceIP := net.IP{}
 	if instanceexist {
-		for _, sip := range instanceTableEntry.ServiceIP {
-			if sip.IpType == TableEntryCache.InstanceNumber {
-				instanceIP = sip.Address_v6
-				if ip.GetProtocolVersion() == 4 {
-					instanceIP = sip.Address
-				}
-			}
+		if sip := instanceNumberIP(instanceTableEntry, ip.GetProtocolVersion()); sip != nil {
+			instanceIP = sip
 		}
 	} else {
 		logger.ErrorLogger().Println("Unable to find instance IP for service: ", ip.GetSrcIP())
@@ -228,20 +351,36 @@ func (proxy *GoProxyTunnel) convertToInstanceIp(ip iputils.NetworkLayerPacket) (
 	return instanceIP, nil
 }
 
+// instanceNumberIP returns the InstanceNumber service IP of an instance, the address its packets come from
+func instanceNumberIP(entry TableEntryCache.TableEntry, version uint8) net.IP {
+	var result net.IP
+	for _, sip := range entry.ServiceIP {
+		if sip.IpType == TableEntryCache.InstanceNumber {
+			result = sip.Address_v6
+			if version == 4 {
+				result = sip.Address
+			}
+		}
+	}
+	return result
+}
+
 // If packet destination port is proxy.tunnelport then is a packet forwarded by the proxy. The src address must beù
 // changed with he original packet destination
 func (proxy *GoProxyTunnel) ingoingProxy(ip iputils.NetworkLayerPacket, prot iputils.TransportLayerProtocol) gopacket.Packet {
 	dstport := -1
 	srcport := -1
+	protocol := ""
 
 	if prot != nil {
 		dstport = int(prot.GetDestPort())
 		srcport = int(prot.GetSourcePort())
+		protocol = flowProtocol(prot)
 	}
 
 	//Check proxy proxycache for REVERSE entry conversion
-	//DstIP -> srcip, DstPort->srcport, srcport -> dstport
-	entry, exist := proxy.proxycache.RetrieveByInstanceIp(ip.GetDestIP(), dstport, srcport)
+	//DstIP -> srcip, DstPort->srcport, SrcIP -> instance IP, srcport -> dstport
+	entry, exist := proxy.proxycache.RetrieveByInstanceIp(protocol, ip.GetDestIP(), dstport, flowSourceIP(ip, prot), srcport, prot)
 
 	if !exist {
 		//No proxy proxycache entry, no translation needed
@@ -259,11 +398,18 @@ func (proxy *GoProxyTunnel) ingoingProxy(ip iputils.NetworkLayerPacket, prot ipu
 func (proxy *GoProxyTunnel) tunOutgoingListen() {
 	readerror := make(chan error)
 
-	//async listener
-	go proxy.ifaceread(proxy.ifce, proxy.outgoingChannel, readerror)
+	//async listeners, one for each TUN queue
+	if len(proxy.tunQueues) == 0 {
+		go proxy.ifaceread(proxy.ifce, readerror)
+	}
+	for _, queue := range proxy.tunQueues {
+		go proxy.ifaceread(queue, readerror)
+	}
 
-	//async handler
-	go proxy.outgoingMessage()
+	//async handlers
+	for worker := range proxy.outgoingChannel {
+		go proxy.outgoingMessage(worker)
+	}
 
 	proxy.isListening = true
 	logger.InfoLogger().Println("GoProxyTunnel outgoing listening started")
@@ -290,10 +436,12 @@ func (proxy *GoProxyTunnel) tunIngoingListen() {
 	readerror := make(chan error)
 
 	//async listener
-	go proxy.udpread(proxy.listenConnection, proxy.incomingChannel, readerror)
+	go proxy.udpread(proxy.listenConnection, readerror)
 
-	//async handler
-	go proxy.ingoingMessage()
+	//async handlers
+	for worker := range proxy.incomingChannel {
+		go proxy.ingoingMessage(worker)
+	}
 
 	proxy.isListening = true
 	logger.InfoLogger().Println("GoProxyTunnel ingoing listening started")
@@ -349,46 +497,25 @@ func (proxy *GoProxyTunnel) forward(dstHost net.IP, dstPort int, packet gopacket
 			},
 			content: &packetBytes,
 		}
-		proxy.incomingChannel <- msg
+		proxy.dispatchIncoming(msg)
 		return
 	}
 
-	//Check udp channel buffer to avoid creating a new channel
-	proxy.udpwrite.Lock()
-	hoststring := fmt.Sprintf("%s:%v", dstHost, dstPort)
-	con, exist := proxy.connectionBuffer[hoststring]
-	proxy.udpwrite.Unlock()
-	//TODO: flush connection buffer by time to time
-	if !exist {
-		logger.DebugLogger().Println("Establishing a new connection to node ", hoststring)
-		connection, err := createUDPChannel(hoststring)
-		if nil != err {
-			return
-		}
-		_ = connection.SetWriteBuffer(BUFFER_SIZE)
-		proxy.udpwrite.Lock()
-		proxy.connectionBuffer[hoststring] = connection
-		proxy.udpwrite.Unlock()
-		con = connection
+	writer, err := proxy.peerWriter(peerKey(dstHost, dstPort))
+	if err != nil {
+		return
 	}
 
-	//send via UDP channel
-	proxy.udpwrite.Lock()
-	_, _, err := (*con).WriteMsgUDP(packetBytes, nil, nil)
-	proxy.udpwrite.Unlock()
+	//seal and frame the packet for the destination node
+	packetBytes, err = proxy.encapsulate(dstHost, dstPort, packetBytes, 0)
 	if err != nil {
-		_ = (*con).Close()
-		logger.ErrorLogger().Println(err)
-		connection, err := createUDPChannel(hoststring)
-		if nil != err {
-			return
-		}
-		proxy.udpwrite.Lock()
-		proxy.connectionBuffer[hoststring] = connection
-		proxy.udpwrite.Unlock()
-		//Try again
-		attemptNumber++
-		proxy.forward(dstHost, dstPort, packet, attemptNumber)
+		logger.DebugLogger().Println("Packet dropped: ", err)
+		return
+	}
+
+	//send via UDP channel
+	if !writer.send(packetBytes) {
+		logger.DebugLogger().Println("Packet dropped: queue towards ", writer.hoststring, " is full")
 	}
 }
 
@@ -408,50 +535,79 @@ func createUDPChannel(hoststring string) (*net.UDPConn, error) {
 		logger.ErrorLogger().Println("Buffer error:", err)
 		return nil, err
 	}
+	err = enablePathMTUDiscovery(connection, raddr.IP.To4() == nil)
+	if nil != err {
+		logger.DebugLogger().Println("Path MTU discovery unavailable:", err)
+	}
 	return connection, nil
 }
 
 // read output from an interface and wrap the read operation with a channel
-// out channel gives back the byte array of the output
+// each packet is given to the worker of its flow
 // errchannel is the channel where in case of error the error is routed
-func (proxy *GoProxyTunnel) ifaceread(ifce *water.Interface, out chan<- outgoingMessage, errchannel chan<- error) {
+func (proxy *GoProxyTunnel) ifaceread(ifce *water.Interface, errchannel chan<- error) {
 	buffer := make([]byte, BUFFER_SIZE)
 	for true {
 		n, err := ifce.Read(buffer)
 		if err != nil {
 			errchannel <- err
 		} else {
-			res := make([]byte, n)
-			copy(res, buffer[:n])
+			res := getBuffer(n)
+			copy(*res, buffer[:n])
 			logger.DebugLogger().Printf("Outgoing packet ready for decode action \n")
-			out <- outgoingMessage{
-				content: &res,
-			}
+			proxy.dispatchOutgoing(outgoingMessage{
+				content: res,
+				buffer:  res,
+			})
 		}
 	}
 }
 
 // read output from an UDP connection and wrap the read operation with a channel
-// out channel gives back the byte array of the output
+// up to IO_BATCH_SIZE packets are read with a single syscall
+// each packet is given to the worker of its flow
 // errchannel is the channel where in case of error the error is routed
-func (proxy *GoProxyTunnel) udpread(conn *net.UDPConn, out chan<- incomingMessage, errchannel chan<- error) {
-	buffer := make([]byte, BUFFER_SIZE)
+func (proxy *GoProxyTunnel) udpread(conn *net.UDPConn, errchannel chan<- error) {
+	batch := newBatchConn(conn)
+	messages := newBatchMessages(BUFFER_SIZE)
 	for true {
-		packet := buffer
-		n, from, err := conn.ReadFromUDP(packet)
+		n, err := batch.ReadBatch(messages, 0)
 		if err != nil {
 			errchannel <- err
-		} else {
-			res := make([]byte, n)
-			copy(res, buffer[:n])
-			out <- incomingMessage{
-				from:    *from,
-				content: &res,
+			continue
+		}
+		for i := 0; i < n; i++ {
+			from, ok := messages[i].Addr.(*net.UDPAddr)
+			if !ok {
+				continue
 			}
+			res := getBuffer(messages[i].N)
+			copy(*res, messages[i].Buffers[0][:messages[i].N])
+			proxy.tunnelPacketRead(res, from)
 		}
 	}
 }
 
+func (proxy *GoProxyTunnel) tunnelPacketRead(buffer *[]byte, from *net.UDPAddr) {
+	//foreign and unauthenticated packets never reach the TUN device
+	res, err := proxy.decapsulate(*buffer, from)
+	if err != nil {
+		logger.DebugLogger().Printf("Tunnel packet from %s dropped: %v\n", from.String(), err)
+		releaseBuffer(buffer)
+		return
+	}
+	if isProbePacket(res) {
+		proxy.handleProbe(res, from)
+		releaseBuffer(buffer)
+		return
+	}
+	proxy.dispatchIncoming(incomingMessage{
+		from:    *from,
+		content: &res,
+		buffer:  buffer,
+	})
+}
+
 func packetToByte(packet gopacket.Packet) []byte {
 	options := gopacket.SerializeOptions{
 		ComputeChecksums: false,
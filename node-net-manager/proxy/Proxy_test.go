@@ -3,10 +3,16 @@ package proxy
 import (
 	"NetManager/TableEntryCache"
 	"NetManager/proxy/iputils"
+	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"fmt"
 	"math/rand"
 	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -48,6 +54,14 @@ func (fakeenv *FakeEnv) GetTableEntryByServiceIP(ip net.IP) []TableEntryCache.Ta
 	return entrytable
 }
 
+func (fakeenv *FakeEnv) LookupTableEntryByServiceIP(ip net.IP) []TableEntryCache.TableEntry {
+	return fakeenv.GetTableEntryByServiceIP(ip)
+}
+
+func (fakeenv *FakeEnv) ResolveServiceIP(ip net.IP, callback func([]TableEntryCache.TableEntry)) {
+	callback(fakeenv.GetTableEntryByServiceIP(ip))
+}
+
 func (fakeenv *FakeEnv) GetTableEntryByNsIP(ip net.IP) (TableEntryCache.TableEntry, bool) {
 	entry := TableEntryCache.TableEntry{
 		Appname:          "a",
@@ -77,6 +91,12 @@ func (fakeenv *FakeEnv) GetTableEntryByInstanceIP(ip net.IP) (TableEntryCache.Ta
 	return TableEntryCache.TableEntry{}, false
 }
 
+func (fakeenv *FakeEnv) WatchTable() (<-chan TableEntryCache.TableChange, func()) {
+	changes := make(chan TableEntryCache.TableChange)
+	close(changes)
+	return changes, func() {}
+}
+
 func getFakeTunnel() GoProxyTunnel {
 	tunnel := GoProxyTunnel{
 		tunNetIP:    "10.19.1.254",
@@ -90,7 +110,13 @@ func getFakeTunnel() GoProxyTunnel {
 		TunnelPort:        50011,
 		listenConnection:  nil,
 		proxycache:        NewProxyCache(),
+		peers:             &sync.Map{},
 		randseed:          rand.New(rand.NewSource(42)),
+		latency:           NewLatencyStore(),
+		balancer:          NewServiceBalancer(),
+		versions:          NewPeerVersions(),
+		pathMTU:           NewPathMTUCache(),
+		pending:           NewPendingQueue(),
 		tunNetIPv6:        "fdfe::1337",
 		ProxyIPv6Subnetwork: net.IPNet{
 			IP:   net.ParseIP("fdff::"),
@@ -153,8 +179,8 @@ func TestOutgoingProxy(t *testing.T) {
 	_, ip, tcp := getFakePacket("10.19.1.1", "10.30.255.255", 666, 80)
 	_, noip, notcp := getFakePacket("10.19.1.1", "10.20.1.1", 666, 80)
 
-	newpacketproxy := proxy.outgoingProxy(ip, tcp)
-	newpacketnoproxy := proxy.outgoingProxy(noip, notcp)
+	newpacketproxy := proxyOutgoing(&proxy, ip, tcp)
+	newpacketnoproxy := proxyOutgoing(&proxy, noip, notcp)
 	if newpacketnoproxy != nil {
 		t.Error("Packet should not be proxied")
 	}
@@ -183,10 +209,12 @@ func TestIngoingProxy(t *testing.T) {
 
 	//update proxy proxycache
 	entry := ConversionEntry{
+		protocol:      "TCP",
 		srcip:         net.ParseIP("10.19.1.15"),
 		dstip:         net.ParseIP("10.19.2.1"),
 		dstServiceIp:  net.ParseIP("10.30.255.255"),
 		srcInstanceIp: net.ParseIP("10.30.0.50"),
+		dstInstanceIp: net.ParseIP("10.30.0.5"),
 		srcport:       777,
 		dstport:       666,
 	}
@@ -221,8 +249,8 @@ func TestOutgoingV6Proxy(t *testing.T) {
 	_, ip, tcp := getFakeV6Packet("fc00::1", "fdff:2000::ff", 666, 80)
 	_, noip, notcp := getFakeV6Packet("fc00::1", "fd00::12", 666, 80)
 
-	newpacketproxy := proxy.outgoingProxy(ip, tcp)
-	newpacketnoproxy := proxy.outgoingProxy(noip, notcp)
+	newpacketproxy := proxyOutgoing(&proxy, ip, tcp)
+	newpacketnoproxy := proxyOutgoing(&proxy, noip, notcp)
 	if newpacketnoproxy != nil {
 		t.Error("Packet should not be proxied")
 	}
@@ -247,10 +275,12 @@ func TestIngoingV6Proxy(t *testing.T) {
 
 	//update proxy proxycache
 	entry := ConversionEntry{
+		protocol:      "TCP",
 		srcip:         net.ParseIP("fc00::15"),
 		dstip:         net.ParseIP("fd00::12"),
 		dstServiceIp:  net.ParseIP("fdff:3000::ff"),
 		srcInstanceIp: net.ParseIP("fdff::12"),
+		dstInstanceIp: net.ParseIP("fdff::12"),
 		srcport:       777,
 		dstport:       666,
 	}
@@ -282,3 +312,1328 @@ func TestIPv6NextHeader(t *testing.T) {
 		t.Error("Failed to detect TCP Header in IPv6 Next Header field.")
 	}
 }
+
+type FakeMultiInstanceEnv struct {
+	FakeEnv
+	ipType  TableEntryCache.ServiceIpType
+	weights []int
+}
+
+func (fakeenv *FakeMultiInstanceEnv) LookupTableEntryByServiceIP(ip net.IP) []TableEntryCache.TableEntry {
+	return fakeenv.GetTableEntryByServiceIP(ip)
+}
+
+// three instances of the same service deployed on three different nodes
+func (fakeenv *FakeMultiInstanceEnv) GetTableEntryByServiceIP(ip net.IP) []TableEntryCache.TableEntry {
+	entrytable := make([]TableEntryCache.TableEntry, 0)
+	for i := 1; i <= 3; i++ {
+		entrytable = append(entrytable, TableEntryCache.TableEntry{
+			Appname:          "a",
+			Appns:            "a",
+			Servicename:      "b",
+			Servicenamespace: "b",
+			Instancenumber:   i,
+			Cluster:          0,
+			Nodeip:           net.IPv4(10, 0, 0, byte(i)),
+			Nodeport:         50103,
+			Nsip:             net.IPv4(10, 19, byte(i), 12),
+			Nsipv6:           net.ParseIP(fmt.Sprintf("fd00::%d", i)),
+			ServiceIP: []TableEntryCache.ServiceIP{{
+				IpType:     fakeenv.ipType,
+				Address:    net.ParseIP("10.30.255.255"),
+				Address_v6: net.ParseIP("fdff:1000::ff"),
+			}},
+		})
+		if len(fakeenv.weights) >= i {
+			entrytable[i-1].Weight = fakeenv.weights[i-1]
+		}
+	}
+	return entrytable
+}
+
+func TestLatencyStoreSmoothing(t *testing.T) {
+	store := NewLatencyStore()
+	peer := net.ParseIP("10.0.0.1")
+
+	store.Update(peer, 50103, 10*time.Millisecond)
+	if _, measured := store.Get(peer, 50103); measured {
+		t.Error("Samples of untracked peers must be ignored")
+	}
+
+	store.Track(peer, 50103)
+	store.Update(peer, 50103, 10*time.Millisecond)
+	store.Update(peer, 50103, 30*time.Millisecond)
+	rtt, measured := store.Get(peer, 50103)
+	if !measured {
+		t.Fatal("Peer should have been measured")
+	}
+	if rtt != 15*time.Millisecond {
+		t.Error("rtt = ", rtt, "; want = ", 15*time.Millisecond)
+	}
+}
+
+func TestClosestPolicy(t *testing.T) {
+	proxy := getFakeTunnel()
+	proxy.SetEnvironment(&FakeMultiInstanceEnv{ipType: TableEntryCache.Closest})
+
+	for i := 1; i <= 3; i++ {
+		proxy.latency.Track(net.IPv4(10, 0, 0, byte(i)), 50103)
+	}
+	proxy.latency.Update(net.IPv4(10, 0, 0, 1), 50103, 40*time.Millisecond)
+	proxy.latency.Update(net.IPv4(10, 0, 0, 2), 50103, 5*time.Millisecond)
+	proxy.latency.Update(net.IPv4(10, 0, 0, 3), 50103, 20*time.Millisecond)
+
+	_, ip, tcp := getFakePacket("10.19.1.1", "10.30.255.255", 666, 80)
+	newpacketproxy := proxyOutgoing(&proxy, ip, tcp)
+	if newpacketproxy == nil {
+		t.Fatal("Packet should be proxied")
+	}
+	ipv4, _ := newpacketproxy.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	dstexpected := net.IPv4(10, 19, 2, 12)
+	if !ipv4.DstIP.Equal(dstexpected) {
+		t.Error("dstIP = ", ipv4.DstIP.String(), "; want =", dstexpected)
+	}
+}
+
+func TestClosestPolicyPrefersLocalInstance(t *testing.T) {
+	proxy := getFakeTunnel()
+	proxy.localIP = net.IPv4(10, 0, 0, 3)
+	proxy.SetEnvironment(&FakeMultiInstanceEnv{ipType: TableEntryCache.Closest})
+
+	proxy.latency.Track(net.IPv4(10, 0, 0, 1), 50103)
+	proxy.latency.Update(net.IPv4(10, 0, 0, 1), 50103, time.Millisecond)
+
+	entries := proxy.environment.GetTableEntryByServiceIP(net.ParseIP("10.30.255.255"))
+	selected := proxy.selectTableEntry(net.ParseIP("10.30.255.255"), entries)
+	if selected.Instancenumber != 3 {
+		t.Error("selected instance = ", selected.Instancenumber, "; want = 3")
+	}
+}
+
+func TestProbeReplyUpdatesLatency(t *testing.T) {
+	proxy := getFakeTunnel()
+	from := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50103}
+	proxy.latency.Track(from.IP, from.Port)
+	nonce, ok := proxy.latency.StartProbe(from.IP, from.Port)
+	if !ok {
+		t.Fatal("Probe not started")
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	reply := make([]byte, probePacketLen)
+	reply[0] = probeReply
+	// a reply with another nonce or from another endpoint is ignored
+	binary.BigEndian.PutUint64(reply[1:], nonce+1)
+	proxy.handleProbe(reply, from)
+	binary.BigEndian.PutUint64(reply[1:], nonce)
+	proxy.handleProbe(reply, &net.UDPAddr{IP: from.IP, Port: 50104})
+	if _, measured := proxy.latency.Get(from.IP, from.Port); measured {
+		t.Fatal("Spoofed probe reply accepted")
+	}
+
+	if !isProbePacket(reply) {
+		t.Fatal("Probe reply not recognized")
+	}
+	proxy.handleProbe(reply, from)
+	rtt, measured := proxy.latency.Get(from.IP, from.Port)
+	if !measured || rtt < 10*time.Millisecond {
+		t.Error("rtt = ", rtt, "; want >= ", 10*time.Millisecond)
+	}
+
+	// the nonce is accepted once
+	if _, ok := proxy.latency.ProbeReplied(from.IP, from.Port, nonce); ok {
+		t.Error("Repeated probe reply accepted")
+	}
+}
+
+func TestRoundRobinPolicy(t *testing.T) {
+	proxy := getFakeTunnel()
+	proxy.SetEnvironment(&FakeMultiInstanceEnv{ipType: TableEntryCache.RoundRobin})
+	serviceIP := net.ParseIP("10.30.255.255")
+
+	counter := make(map[int]int)
+	previous := 0
+	for i := 0; i < 30; i++ {
+		entries := proxy.environment.GetTableEntryByServiceIP(serviceIP)
+		selected := proxy.selectTableEntry(serviceIP, entries)
+		if selected.Instancenumber == previous {
+			t.Error("Instance ", previous, " selected twice in a row")
+		}
+		previous = selected.Instancenumber
+		counter[selected.Instancenumber]++
+	}
+	for i := 1; i <= 3; i++ {
+		if counter[i] != 10 {
+			t.Error("instance ", i, " selected ", counter[i], " times; want = 10")
+		}
+	}
+}
+
+func TestWeightedRoundRobinPolicy(t *testing.T) {
+	proxy := getFakeTunnel()
+	proxy.SetEnvironment(&FakeMultiInstanceEnv{ipType: TableEntryCache.RoundRobin, weights: []int{1, 2, 3}})
+	serviceIP := net.ParseIP("10.30.255.255")
+
+	counter := make(map[int]int)
+	for i := 0; i < 60; i++ {
+		entries := proxy.environment.GetTableEntryByServiceIP(serviceIP)
+		counter[proxy.selectTableEntry(serviceIP, entries).Instancenumber]++
+	}
+	for i := 1; i <= 3; i++ {
+		if counter[i] != 10*i {
+			t.Error("instance ", i, " selected ", counter[i], " times; want = ", 10*i)
+		}
+	}
+}
+
+func TestRoundRobinIPv6OnlyInstances(t *testing.T) {
+	balancer := NewServiceBalancer()
+	serviceIP := net.ParseIP("fdff:2000::55")
+	entries := make([]TableEntryCache.TableEntry, 0)
+	for i := 1; i <= 3; i++ {
+		entries = append(entries, TableEntryCache.TableEntry{
+			Instancenumber: i,
+			Nsipv6:         net.ParseIP(fmt.Sprintf("fc00::%d", i)),
+		})
+	}
+
+	counter := make(map[int]int)
+	for i := 0; i < 30; i++ {
+		counter[balancer.Next(serviceIP, entries).Instancenumber]++
+	}
+	for i := 1; i <= 3; i++ {
+		if counter[i] != 10 {
+			t.Error("instance ", i, " selected ", counter[i], " times; want = 10")
+		}
+	}
+}
+
+func TestRoundRobinFlowIsSticky(t *testing.T) {
+	proxy := getFakeTunnel()
+	proxy.SetEnvironment(&FakeMultiInstanceEnv{ipType: TableEntryCache.RoundRobin})
+
+	_, ip, tcp := getFakePacket("10.19.1.1", "10.30.255.255", 666, 80)
+	first := proxyOutgoing(&proxy, ip, tcp)
+	_, ip, tcp = getFakePacket("10.19.1.1", "10.30.255.255", 666, 80)
+	second := proxyOutgoing(&proxy, ip, tcp)
+	_, ip, tcp = getFakePacket("10.19.1.1", "10.30.255.255", 667, 80)
+	other := proxyOutgoing(&proxy, ip, tcp)
+	if first == nil || second == nil || other == nil {
+		t.Fatal("Packets should be proxied")
+	}
+
+	firstDst := first.Layer(layers.LayerTypeIPv4).(*layers.IPv4).DstIP
+	secondDst := second.Layer(layers.LayerTypeIPv4).(*layers.IPv4).DstIP
+	otherDst := other.Layer(layers.LayerTypeIPv4).(*layers.IPv4).DstIP
+	if !firstDst.Equal(secondDst) {
+		t.Error("flow moved from ", firstDst.String(), " to ", secondDst.String())
+	}
+	if firstDst.Equal(otherDst) {
+		t.Error("new flow should be balanced to another instance than ", firstDst.String())
+	}
+}
+
+func getFakeCryptoPeers(t *testing.T) (*TunnelCrypto, *TunnelCrypto) {
+	nodeA, err := NewTunnelCrypto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeB, err := NewTunnelCrypto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nodeA.AddPeer("nodeB", net.ParseIP("10.0.0.2"), 50103, nodeB.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodeB.AddPeer("nodeA", net.ParseIP("10.0.0.1"), 50103, nodeA.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	return nodeA, nodeB
+}
+
+func TestTunnelSealOpen(t *testing.T) {
+	nodeA, nodeB := getFakeCryptoPeers(t)
+	_, ip, tcp := getFakePacket("10.19.1.1", "10.19.2.12", 666, 80)
+	packet := packetToByte(ip.SerializePacket(ip.GetDestIP(), ip.GetSrcIP(), tcp))
+
+	sealed, err := nodeA.Seal(net.ParseIP("10.0.0.2"), 50103, packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, packet) {
+		t.Error("Sealed packet contains the plaintext")
+	}
+	opened, err := nodeB.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, packet) {
+		t.Error("Opened packet differs from the original one")
+	}
+
+	// the other direction uses a different key
+	reply, _ := nodeB.Seal(net.ParseIP("10.0.0.1"), 50103, packet)
+	if _, err := nodeA.Open(reply); err != nil {
+		t.Error("Unable to open reply: ", err)
+	}
+	if _, err := nodeB.Open(reply); err == nil {
+		t.Error("Node opened a packet sealed for its peer")
+	}
+}
+
+func TestTunnelRejectsForgedPackets(t *testing.T) {
+	nodeA, nodeB := getFakeCryptoPeers(t)
+	stranger, _ := NewTunnelCrypto()
+	_ = stranger.AddPeer("nodeB", net.ParseIP("10.0.0.2"), 50103, nodeB.PublicKey())
+
+	if _, err := nodeB.Open([]byte{0x45, 0x00, 0x00, 0x14}); err == nil {
+		t.Error("Plain IP packet accepted")
+	}
+	sealed, _ := stranger.Seal(net.ParseIP("10.0.0.2"), 50103, []byte("payload"))
+	if _, err := nodeB.Open(sealed); err == nil {
+		t.Error("Packet from unknown node accepted")
+	}
+	sealed, _ = nodeA.Seal(net.ParseIP("10.0.0.2"), 50103, []byte("payload"))
+	sealed[len(sealed)-1] ^= 0xff
+	if _, err := nodeB.Open(sealed); err == nil {
+		t.Error("Tampered packet accepted")
+	}
+	if _, err := nodeA.Seal(net.ParseIP("10.0.0.3"), 50103, []byte("payload")); err == nil {
+		t.Error("Packet sealed for a node without key")
+	}
+}
+
+func TestTunnelKeyOwner(t *testing.T) {
+	nodeA, nodeB := getFakeCryptoPeers(t)
+	stranger, _ := NewTunnelCrypto()
+
+	// another node can't replace the key of nodeB
+	if err := nodeA.AddPeer("stranger", net.ParseIP("10.0.0.2"), 50103, stranger.PublicKey()); err == nil {
+		t.Error("Key replaced by another node")
+	}
+	if err := nodeA.AddPeer("stranger", net.ParseIP("10.0.0.3"), 50103, nodeB.PublicKey()); err == nil {
+		t.Error("Key of nodeB announced for another address")
+	}
+	sealed, _ := nodeB.Seal(net.ParseIP("10.0.0.1"), 50103, []byte("payload"))
+	if _, err := nodeA.Open(sealed); err != nil {
+		t.Error("Session with nodeB broken: ", err)
+	}
+
+	// nodeB announces a new key after a restart
+	restarted, _ := NewTunnelCrypto()
+	_ = restarted.AddPeer("nodeA", net.ParseIP("10.0.0.1"), 50103, nodeA.PublicKey())
+	if err := nodeA.AddPeer("nodeB", net.ParseIP("10.0.0.2"), 50103, restarted.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ = restarted.Seal(net.ParseIP("10.0.0.1"), 50103, []byte("payload"))
+	if _, err := nodeA.Open(sealed); err != nil {
+		t.Error("New key of nodeB rejected: ", err)
+	}
+}
+
+func TestTunnelReplayProtection(t *testing.T) {
+	nodeA, nodeB := getFakeCryptoPeers(t)
+	packets := make([][]byte, 0)
+	for i := 0; i < 2000; i++ {
+		sealed, _ := nodeA.Seal(net.ParseIP("10.0.0.2"), 50103, []byte("payload"))
+		packets = append(packets, sealed)
+	}
+
+	if _, err := nodeB.Open(packets[1000]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodeB.Open(packets[1000]); err == nil {
+		t.Error("Replayed packet accepted")
+	}
+	// reordered packets within the window are accepted once
+	if _, err := nodeB.Open(packets[900]); err != nil {
+		t.Error("Reordered packet rejected: ", err)
+	}
+	if _, err := nodeB.Open(packets[900]); err == nil {
+		t.Error("Replayed reordered packet accepted")
+	}
+	if _, err := nodeB.Open(packets[1999]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodeB.Open(packets[10]); err == nil {
+		t.Error("Packet older than the replay window accepted")
+	}
+}
+
+func TestTunnelReplayInOrder(t *testing.T) {
+	nodeA, nodeB := getFakeCryptoPeers(t)
+	packets := make([][]byte, 0)
+	for i := 0; i < 1100; i++ {
+		sealed, _ := nodeA.Seal(net.ParseIP("10.0.0.2"), 50103, []byte("payload"))
+		if _, err := nodeB.Open(sealed); err != nil {
+			t.Fatalf("In order packet %d rejected: %v", i, err)
+		}
+		packets = append(packets, sealed)
+	}
+	// the counters advancing within the last block must not clear the window
+	for _, i := range []int{1099, 1090, 1000, 980} {
+		if _, err := nodeB.Open(packets[i]); err == nil {
+			t.Errorf("Replayed packet %d accepted", i)
+		}
+	}
+}
+
+func TestTunnelHeader(t *testing.T) {
+	header := TunnelHeader{Version: TUNNEL_VERSION, Flags: flagSealed, NodeID: NodeID(net.ParseIP("10.0.0.1"), 50103)}
+	msg := header.Encode([]byte{0x45, 0x00})
+	if msg[0]&0xf0 == 0x40 || msg[0]&0xf0 == 0x60 {
+		t.Error("Framed packet looks like an IP packet")
+	}
+	decoded, payload, err := DecodeTunnelHeader(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != header || !bytes.Equal(payload, []byte{0x45, 0x00}) {
+		t.Error("decoded = ", decoded, payload, "; want = ", header)
+	}
+	msg[0] = 0xff
+	if _, _, err := DecodeTunnelHeader(msg); err == nil {
+		t.Error("Invalid magic accepted")
+	}
+}
+
+func TestTunnelDecapsulate(t *testing.T) {
+	proxy := getFakeTunnel()
+	proxy.nodeID = NodeID(net.ParseIP("10.0.0.1"), 50103)
+	from := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 50103}
+	peerID := NodeID(from.IP, from.Port)
+	raw, _ := hex.DecodeString(ipv4Packet)
+
+	if payload, err := proxy.decapsulate(raw, from); err != nil || !bytes.Equal(payload, raw) {
+		t.Error("Legacy packet rejected: ", err)
+	}
+	if _, err := proxy.decapsulate([]byte("SSH-2.0-OpenSSH_9.0"), from); err == nil {
+		t.Error("Foreign traffic accepted")
+	}
+	framed := TunnelHeader{Version: TUNNEL_VERSION, NodeID: peerID}.Encode(raw)
+	if payload, err := proxy.decapsulate(framed, from); err != nil || !bytes.Equal(payload, raw) {
+		t.Error("Framed packet rejected: ", err)
+	}
+	framed = TunnelHeader{Version: TUNNEL_VERSION, Flags: flagProbe, NodeID: peerID}.Encode(raw)
+	if _, err := proxy.decapsulate(framed, from); err == nil {
+		t.Error("Packet not matching the header flags accepted")
+	}
+	framed = TunnelHeader{Version: TUNNEL_VERSION, NodeID: proxy.nodeID}.Encode(raw)
+	if _, err := proxy.decapsulate(framed, from); err == nil {
+		t.Error("Remote packet carrying the local node ID accepted")
+	}
+	framed = TunnelHeader{Version: TUNNEL_VERSION + 1, NodeID: peerID}.Encode(raw)
+	if _, err := proxy.decapsulate(framed, from); err == nil {
+		t.Error("Data packet of a newer version accepted")
+	}
+}
+
+func TestTunnelVersionNegotiation(t *testing.T) {
+	proxy := getFakeTunnel()
+	proxy.probeChannel = make(chan *net.UDPAddr, 10)
+	peer := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 50103}
+	raw, _ := hex.DecodeString(ipv4Packet)
+
+	// unknown peers receive legacy packets while a framed probe is requested
+	msg, _ := proxy.encapsulate(peer.IP, peer.Port, raw, 0)
+	if !bytes.Equal(msg, raw) {
+		t.Error("Unknown peer received a framed packet")
+	}
+	if len(proxy.probeChannel) != 1 {
+		t.Error("No probe requested towards the unknown peer")
+	}
+	probe, _ := proxy.encapsulate(peer.IP, peer.Port, make([]byte, probePacketLen), flagProbe)
+	if !isFramedPacket(probe) {
+		t.Error("Probe towards unknown peer not framed")
+	}
+
+	// a newer peer answers to our probe
+	reply := make([]byte, probePacketLen)
+	reply[0] = probeReply
+	framed := TunnelHeader{Version: TUNNEL_VERSION + 1, Flags: flagProbe, NodeID: NodeID(peer.IP, peer.Port)}.Encode(reply)
+	if _, err := proxy.decapsulate(framed, peer); err != nil {
+		t.Fatal(err)
+	}
+	msg, _ = proxy.encapsulate(peer.IP, peer.Port, raw, 0)
+	header, payload, err := DecodeTunnelHeader(msg)
+	if err != nil || !bytes.Equal(payload, raw) {
+		t.Fatal("Peer supporting the header received a legacy packet")
+	}
+	if header.Version != TUNNEL_VERSION {
+		t.Error("version = ", header.Version, "; want = ", TUNNEL_VERSION)
+	}
+
+	// another node behind the same IP is still unknown
+	msg, _ = proxy.encapsulate(peer.IP, peer.Port+1, raw, 0)
+	if !bytes.Equal(msg, raw) {
+		t.Error("Peer on another port received a framed packet")
+	}
+}
+
+func getFakeICMPPacket(srcIP string, dstIP string, typeCode layers.ICMPv4TypeCode, id uint16, payload []byte) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	_ = gopacket.SerializeLayers(buf, opts,
+		&layers.IPv4{SrcIP: net.ParseIP(srcIP), DstIP: net.ParseIP(dstIP), Protocol: layers.IPProtocolICMPv4, Version: 4, IHL: 5, TTL: 64},
+		&layers.ICMPv4{TypeCode: typeCode, Id: id, Seq: 1},
+		gopacket.Payload(payload),
+	)
+	return buf.Bytes()
+}
+
+func TestICMPEchoProxy(t *testing.T) {
+	proxy := getFakeTunnel()
+
+	request := getFakeICMPPacket("10.19.1.1", "10.30.255.255", layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), 0x1234, []byte("ping"))
+	ip, icmp := decodePacket(request)
+	if icmp == nil || icmp.GetSourcePort() != 0x1234 || icmp.GetDestPort() != 0x1234 {
+		t.Fatal("ICMP echo identifier not used as flow port")
+	}
+	newpacketproxy := proxyOutgoing(&proxy, ip, icmp)
+	if newpacketproxy == nil {
+		t.Fatal("Echo request should be proxied")
+	}
+	ipv4 := newpacketproxy.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ipv4.DstIP.Equal(net.ParseIP("10.19.2.12")) {
+		t.Error("dstIP = ", ipv4.DstIP.String(), "; want = 10.19.2.12")
+	}
+	echo := newpacketproxy.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	if echo.Id != 0x1234 || !bytes.Equal(echo.Payload, []byte("ping")) {
+		t.Error("Echo request content changed")
+	}
+
+	// the reply comes back to the client namespace and must look like coming from the service IP
+	reply := getFakeICMPPacket("10.30.255.254", "10.19.1.1", layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0), 0x1234, []byte("ping"))
+	ip, icmp = decodePacket(reply)
+	newpacketproxy = proxy.ingoingProxy(ip, icmp)
+	if newpacketproxy == nil {
+		t.Fatal("Echo reply should be proxied")
+	}
+	ipv4 = newpacketproxy.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ipv4.SrcIP.Equal(net.ParseIP("10.30.255.255")) {
+		t.Error("srcIP = ", ipv4.SrcIP.String(), "; want = 10.30.255.255")
+	}
+}
+
+func TestICMPErrorProxy(t *testing.T) {
+	proxy := getFakeTunnel()
+	entry := ConversionEntry{
+		protocol:      "UDP",
+		srcip:         net.ParseIP("10.19.1.15"),
+		dstip:         net.ParseIP("10.19.2.1"),
+		dstServiceIp:  net.ParseIP("10.30.255.255"),
+		srcInstanceIp: net.ParseIP("10.30.0.50"),
+		dstInstanceIp: net.ParseIP("10.30.0.5"),
+		srcport:       777,
+		dstport:       53,
+	}
+	proxy.proxycache.Add(entry)
+
+	// udp datagram that caused the error, as translated by the remote node
+	buf := gopacket.NewSerializeBuffer()
+	embeddedUDP := &layers.UDP{SrcPort: 777, DstPort: 53}
+	embeddedIP := &layers.IPv4{SrcIP: net.ParseIP("10.19.1.15"), DstIP: net.ParseIP("10.30.0.5"), Protocol: layers.IPProtocolUDP, Version: 4, IHL: 5, TTL: 64}
+	_ = embeddedUDP.SetNetworkLayerForChecksum(embeddedIP)
+	_ = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, embeddedIP, embeddedUDP, gopacket.Payload("query"))
+
+	unreachable := getFakeICMPPacket("10.30.0.5", "10.19.1.15", layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort), 0, buf.Bytes())
+	ip, icmp := decodePacket(unreachable)
+	if icmp == nil || icmp.GetSourcePort() != 53 || icmp.GetDestPort() != 777 {
+		t.Fatal("ICMP error not matched to the embedded flow")
+	}
+	newpacketproxy := proxy.ingoingProxy(ip, icmp)
+	if newpacketproxy == nil {
+		t.Fatal("ICMP error should be proxied")
+	}
+	ipv4 := newpacketproxy.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ipv4.SrcIP.Equal(net.ParseIP("10.30.255.255")) {
+		t.Error("srcIP = ", ipv4.SrcIP.String(), "; want = 10.30.255.255")
+	}
+
+	// the embedded header must refer to the service IP the client used
+	embedded := gopacket.NewPacket(newpacketproxy.Layer(layers.LayerTypeICMPv4).LayerPayload(), layers.LayerTypeIPv4, gopacket.Default)
+	inner := embedded.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !inner.SrcIP.Equal(net.ParseIP("10.19.1.15")) || !inner.DstIP.Equal(net.ParseIP("10.30.255.255")) {
+		t.Error("embedded = ", inner.SrcIP.String(), " -> ", inner.DstIP.String(), "; want = 10.19.1.15 -> 10.30.255.255")
+	}
+	checksum := inner.Checksum
+	_ = inner.SerializeTo(gopacket.NewSerializeBuffer(), gopacket.SerializeOptions{ComputeChecksums: true})
+	if inner.Checksum != checksum {
+		t.Error("embedded checksum = ", checksum, "; want = ", inner.Checksum)
+	}
+	innerUDP := embedded.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	udpChecksum := innerUDP.Checksum
+	_ = innerUDP.SetNetworkLayerForChecksum(inner)
+	_ = gopacket.SerializeLayers(gopacket.NewSerializeBuffer(), gopacket.SerializeOptions{ComputeChecksums: true}, innerUDP, gopacket.Payload(innerUDP.Payload))
+	if innerUDP.Checksum != udpChecksum {
+		t.Error("embedded udp checksum = ", udpChecksum, "; want = ", innerUDP.Checksum)
+	}
+}
+
+func TestICMPv6EchoProxy(t *testing.T) {
+	proxy := getFakeTunnel()
+
+	buf := gopacket.NewSerializeBuffer()
+	ipv6 := &layers.IPv6{SrcIP: net.ParseIP("fc00::1"), DstIP: net.ParseIP("fdff:2000::ff"), NextHeader: layers.IPProtocolICMPv6, Version: 6, HopLimit: 64}
+	icmpv6 := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)}
+	_ = icmpv6.SetNetworkLayerForChecksum(ipv6)
+	_ = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		ipv6, icmpv6, &layers.ICMPv6Echo{Identifier: 0x4321, SeqNumber: 1}, gopacket.Payload("ping"))
+
+	ip, icmp := decodePacket(buf.Bytes())
+	if icmp == nil || icmp.GetSourcePort() != 0x4321 || icmp.GetDestPort() != 0x4321 {
+		t.Fatal("ICMPv6 echo identifier not used as flow port")
+	}
+	newpacketproxy := proxyOutgoing(&proxy, ip, icmp)
+	if newpacketproxy == nil {
+		t.Fatal("Echo request should be proxied")
+	}
+	newipv6 := newpacketproxy.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if !newipv6.DstIP.Equal(net.ParseIP("fd00::12")) {
+		t.Error("dstIP = ", newipv6.DstIP.String(), "; want = fd00::12")
+	}
+	echo, ok := newpacketproxy.Layer(layers.LayerTypeICMPv6Echo).(*layers.ICMPv6Echo)
+	if !ok || echo.Identifier != 0x4321 {
+		t.Error("Echo identifier changed")
+	}
+}
+
+func getFakeConversionEntry(protocol string, srcport int) ConversionEntry {
+	return ConversionEntry{
+		protocol:      protocol,
+		srcip:         net.ParseIP("10.19.1.15"),
+		dstip:         net.ParseIP("10.19.2.1"),
+		dstServiceIp:  net.ParseIP("10.30.255.255"),
+		srcInstanceIp: net.ParseIP("10.30.0.50"),
+		dstInstanceIp: net.ParseIP("10.30.0.5"),
+		srcport:       srcport,
+		dstport:       80,
+	}
+}
+
+func TestFlowTableLookup(t *testing.T) {
+	cache := NewProxyCache()
+	cache.Add(getFakeConversionEntry("TCP", 777))
+
+	entry, exist := cache.RetrieveByServiceIP("TCP", net.ParseIP("10.19.1.15"), 777, net.ParseIP("10.30.255.255"), 80)
+	if !exist || !entry.dstip.Equal(net.ParseIP("10.19.2.1")) {
+		t.Error("Flow not found by ServiceIP")
+	}
+	entry, exist = cache.RetrieveByInstanceIp("TCP", net.ParseIP("10.19.1.15"), 777, net.ParseIP("10.30.0.5"), 80)
+	if !exist || !entry.dstServiceIp.Equal(net.ParseIP("10.30.255.255")) {
+		t.Error("Flow not found by instance IP")
+	}
+	if _, exist := cache.RetrieveByServiceIP("UDP", net.ParseIP("10.19.1.15"), 777, net.ParseIP("10.30.255.255"), 80); exist {
+		t.Error("UDP lookup matched a TCP flow")
+	}
+	if _, exist := cache.RetrieveByInstanceIp("TCP", net.ParseIP("10.19.1.16"), 777, net.ParseIP("10.30.0.5"), 80); exist {
+		t.Error("Lookup matched a flow of another client")
+	}
+
+	// same client port towards two services on the same port, the replies are told apart by the instance IP
+	other := getFakeConversionEntry("TCP", 777)
+	other.dstip = net.ParseIP("10.19.3.1")
+	other.dstServiceIp = net.ParseIP("10.30.255.200")
+	other.dstInstanceIp = net.ParseIP("10.30.0.6")
+	cache.Add(other)
+	entry, exist = cache.RetrieveByInstanceIp("TCP", net.ParseIP("10.19.1.15"), 777, net.ParseIP("10.30.0.5"), 80)
+	if !exist || !entry.dstServiceIp.Equal(net.ParseIP("10.30.255.255")) {
+		t.Error("Flow evicted by a flow towards another instance")
+	}
+	entry, exist = cache.RetrieveByInstanceIp("TCP", net.ParseIP("10.19.1.15"), 777, net.ParseIP("10.30.0.6"), 80)
+	if !exist || !entry.dstServiceIp.Equal(net.ParseIP("10.30.255.200")) {
+		t.Error("Flow towards the second instance not found")
+	}
+	cache.RemoveByDestination(other.dstip)
+
+	// colliding flows don't evict each other anymore
+	for port := 1000; port < 1100; port++ {
+		cache.Add(getFakeConversionEntry("TCP", port))
+	}
+	if cache.Len() != 101 {
+		t.Error("flows = ", cache.Len(), "; want = 101")
+	}
+}
+
+func TestFlowTableEviction(t *testing.T) {
+	cache := NewProxyCache()
+	cache.maxSize = 3
+	cache.Add(getFakeConversionEntry("UDP", 1))
+	cache.Add(getFakeConversionEntry("UDP", 2))
+	cache.Add(getFakeConversionEntry("UDP", 3))
+
+	// flow 1 is used, flow 2 becomes the least recently used
+	cache.RetrieveByInstanceIp("UDP", net.ParseIP("10.19.1.15"), 1, net.ParseIP("10.30.0.5"), 80)
+	cache.Add(getFakeConversionEntry("UDP", 4))
+
+	if cache.Len() != 3 {
+		t.Error("flows = ", cache.Len(), "; want = 3")
+	}
+	if _, exist := cache.RetrieveByInstanceIp("UDP", net.ParseIP("10.19.1.15"), 2, net.ParseIP("10.30.0.5"), 80); exist {
+		t.Error("Least recently used flow not evicted")
+	}
+	if _, exist := cache.RetrieveByServiceIP("UDP", net.ParseIP("10.19.1.15"), 1, net.ParseIP("10.30.255.255"), 80); !exist {
+		t.Error("Recently used flow evicted")
+	}
+}
+
+func TestFlowTableExpiry(t *testing.T) {
+	cache := NewProxyCache()
+	cache.timeouts.udp = 50 * time.Millisecond
+	cache.Add(getFakeConversionEntry("UDP", 1))
+	cache.Add(getFakeConversionEntry("UDP", 2))
+
+	time.Sleep(30 * time.Millisecond)
+	cache.RetrieveByInstanceIp("UDP", net.ParseIP("10.19.1.15"), 2, net.ParseIP("10.30.0.5"), 80)
+	time.Sleep(30 * time.Millisecond)
+
+	if removed := cache.Sweep(); removed != 1 {
+		t.Error("removed = ", removed, "; want = 1")
+	}
+	if _, exist := cache.RetrieveByInstanceIp("UDP", net.ParseIP("10.19.1.15"), 1, net.ParseIP("10.30.0.5"), 80); exist {
+		t.Error("Idle flow still present")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, exist := cache.RetrieveByServiceIP("UDP", net.ParseIP("10.19.1.15"), 2, net.ParseIP("10.30.255.255"), 80); exist {
+		t.Error("Expired flow returned by lookup")
+	}
+	if cache.Len() != 0 {
+		t.Error("flows = ", cache.Len(), "; want = 0")
+	}
+}
+
+func getFakeTCPSegment(srcPort int, dstPort int, flags string) iputils.TransportLayerProtocol {
+	return &iputils.TCPLayer{TCP: &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		SYN:     strings.Contains(flags, "S"),
+		ACK:     strings.Contains(flags, "A"),
+		FIN:     strings.Contains(flags, "F"),
+		RST:     strings.Contains(flags, "R"),
+	}}
+}
+
+func TestConnTrackStates(t *testing.T) {
+	conn := connTrack{}
+	steps := []struct {
+		flags    string
+		original bool
+		state    connState
+	}{
+		{"S", true, stateNew},
+		{"SA", false, stateNew},
+		{"A", true, stateEstablished},
+		{"A", false, stateEstablished},
+		{"FA", true, stateHalfClosed},
+		{"A", false, stateHalfClosed},
+		{"FA", false, stateClosed},
+		{"S", true, stateNew},
+		{"R", false, stateClosed},
+	}
+	for i, step := range steps {
+		conn.track(getFakeTCPSegment(666, 80, step.flags), step.original)
+		if conn.state != step.state {
+			t.Error("step ", i, " state = ", conn.state, "; want = ", step.state)
+		}
+	}
+
+	timeouts := defaultFlowTimeouts()
+	if timeouts.of("UDP", stateNew) != FLOW_IDLE_TIMEOUT || timeouts.of("TCP", stateEstablished) != TCP_ESTABLISHED_TIMEOUT ||
+		timeouts.of("TCP", stateHalfClosed) != TCP_HALF_CLOSED_TIMEOUT || timeouts.of("TCP", stateClosed) != TCP_CLOSED_TIMEOUT {
+		t.Error("Wrong timeout for the flow state")
+	}
+}
+
+func TestEstablishedFlowIsPinned(t *testing.T) {
+	proxy := getFakeTunnel()
+	proxy.SetEnvironment(&FakeMultiInstanceEnv{ipType: TableEntryCache.RoundRobin})
+	clientIP := net.ParseIP("10.19.1.1")
+	serviceIP := net.ParseIP("10.30.255.255")
+
+	// two flows towards an instance that is no longer part of the service
+	for _, port := range []int{666, 667} {
+		entry := ConversionEntry{
+			protocol:      "TCP",
+			srcip:         clientIP,
+			dstip:         net.ParseIP("10.19.9.12"),
+			dstServiceIp:  serviceIP,
+			srcInstanceIp: net.ParseIP("10.30.255.253"),
+			dstInstanceIp: net.ParseIP("10.30.9.12"),
+			srcport:       port,
+			dstport:       80,
+		}
+		proxy.proxycache.Add(entry, getFakeTCPSegment(port, 80, "S"))
+	}
+	// only the first one completes the handshake
+	proxy.proxycache.RetrieveByInstanceIp("TCP", clientIP, 666, net.ParseIP("10.30.9.12"), 80, getFakeTCPSegment(80, 666, "SA"))
+	proxy.proxycache.RetrieveByServiceIP("TCP", clientIP, 666, serviceIP, 80, getFakeTCPSegment(666, 80, "A"))
+
+	_, ip, _ := getFakePacket("10.19.1.1", "10.30.255.255", 666, 80)
+	newpacketproxy := proxyOutgoing(&proxy, ip, getFakeTCPSegment(666, 80, "A"))
+	dst := newpacketproxy.Layer(layers.LayerTypeIPv4).(*layers.IPv4).DstIP
+	if !dst.Equal(net.ParseIP("10.19.9.12")) {
+		t.Error("Established connection moved to ", dst.String())
+	}
+
+	_, ip, _ = getFakePacket("10.19.1.1", "10.30.255.255", 667, 80)
+	newpacketproxy = proxyOutgoing(&proxy, ip, getFakeTCPSegment(667, 80, "S"))
+	dst = newpacketproxy.Layer(layers.LayerTypeIPv4).(*layers.IPv4).DstIP
+	if dst.Equal(net.ParseIP("10.19.9.12")) {
+		t.Error("Connection not established yet should be re-balanced")
+	}
+
+	// once closed, the connection is no longer pinned
+	proxy.proxycache.RetrieveByServiceIP("TCP", clientIP, 666, serviceIP, 80, getFakeTCPSegment(666, 80, "R"))
+	_, ip, _ = getFakePacket("10.19.1.1", "10.30.255.255", 666, 80)
+	newpacketproxy = proxyOutgoing(&proxy, ip, getFakeTCPSegment(666, 80, "S"))
+	dst = newpacketproxy.Layer(layers.LayerTypeIPv4).(*layers.IPv4).DstIP
+	if dst.Equal(net.ParseIP("10.19.9.12")) {
+		t.Error("Closed connection still pinned")
+	}
+}
+
+func getFakeBigPacket(srcIP string, dstIP string, size int, dontFragment bool) []byte {
+	ipv4 := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP(srcIP),
+		DstIP:    net.ParseIP(dstIP),
+	}
+	if dontFragment {
+		ipv4.Flags = layers.IPv4DontFragment
+	}
+	udp := &layers.UDP{SrcPort: 666, DstPort: 80}
+	_ = udp.SetNetworkLayerForChecksum(ipv4)
+	buffer := gopacket.NewSerializeBuffer()
+	_ = gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		ipv4, udp, gopacket.Payload(make([]byte, size-28)))
+	return buffer.Bytes()
+}
+
+func TestPathMTUCheck(t *testing.T) {
+	proxy := getFakeTunnel()
+	proxy.localIP = net.ParseIP("192.168.1.1")
+	peer := net.ParseIP("192.168.1.2")
+	proxy.pathMTU.set(peerKey(peer, 50103), 1400)
+
+	maxSize, known := proxy.maxPacketSize(peer, 50103)
+	if !known || maxSize != 1400-20-8-tunnelHeaderLen {
+		t.Error("maxSize = ", maxSize, "; want = ", 1400-20-8-tunnelHeaderLen)
+	}
+	if _, known := proxy.maxPacketSize(proxy.localIP, 50103); known {
+		t.Error("Local packets are not limited by the path MTU")
+	}
+
+	if !proxy.checkPathMTU(getFakeBigPacket("10.30.0.2", "10.19.1.15", maxSize, true), peer, 50103) {
+		t.Error("Packet fitting the path MTU dropped")
+	}
+	if !proxy.checkPathMTU(getFakeBigPacket("10.30.0.2", "10.19.1.15", maxSize+1, false), peer, 50103) {
+		t.Error("Packet without DF must be fragmented by the underlay")
+	}
+	if proxy.checkPathMTU(getFakeBigPacket("10.30.0.2", "10.19.1.15", maxSize+1, true), peer, 50103) {
+		t.Error("Packet with DF exceeding the path MTU must be dropped")
+	}
+}
+
+func TestPacketTooBig(t *testing.T) {
+	original := getFakeBigPacket("10.30.0.2", "10.19.1.15", 1500, true)
+	icmp := packetTooBig(original, 1364)
+	packet := gopacket.NewPacket(icmp, layers.LayerTypeIPv4, gopacket.Default)
+	ipLayer := packet.Layer(layers.LayerTypeIPv4)
+	icmpLayer := packet.Layer(layers.LayerTypeICMPv4)
+	if ipLayer == nil || icmpLayer == nil {
+		t.Fatal("Invalid frag-needed packet")
+	}
+	ipv4 := ipLayer.(*layers.IPv4)
+	if !ipv4.SrcIP.Equal(net.ParseIP("10.19.1.15")) || !ipv4.DstIP.Equal(net.ParseIP("10.30.0.2")) {
+		t.Error("frag-needed must be sent on behalf of the destination")
+	}
+	icmpv4 := icmpLayer.(*layers.ICMPv4)
+	if icmpv4.TypeCode != layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded) {
+		t.Error("TypeCode = ", icmpv4.TypeCode.String())
+	}
+	if icmpv4.Seq != 1364 {
+		t.Error("next-hop MTU = ", icmpv4.Seq, "; want = 1364")
+	}
+	if len(icmp) > 576 || !bytes.Equal(icmpv4.Payload, original[:icmpv4MaxEmbedded]) {
+		t.Error("The original packet must be embedded within the minimum MTU")
+	}
+
+	ipv6 := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolUDP,
+		SrcIP:      net.ParseIP("fdff::2"),
+		DstIP:      net.ParseIP("fdff:1::15"),
+	}
+	udp := &layers.UDP{SrcPort: 666, DstPort: 80}
+	_ = udp.SetNetworkLayerForChecksum(ipv6)
+	buffer := gopacket.NewSerializeBuffer()
+	_ = gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		ipv6, udp, gopacket.Payload(make([]byte, 1400)))
+	icmp = packetTooBig(buffer.Bytes(), 1344)
+	packet = gopacket.NewPacket(icmp, layers.LayerTypeIPv6, gopacket.Default)
+	icmpv6Layer := packet.Layer(layers.LayerTypeICMPv6)
+	if icmpv6Layer == nil {
+		t.Fatal("Invalid packet-too-big packet")
+	}
+	icmpv6 := icmpv6Layer.(*layers.ICMPv6)
+	if icmpv6.TypeCode.Type() != layers.ICMPv6TypePacketTooBig || binary.BigEndian.Uint32(icmpv6.Payload[0:4]) != 1344 {
+		t.Error("Invalid packet-too-big message")
+	}
+	if len(icmp) > 1280 {
+		t.Error("packet-too-big exceeds the minimum MTU")
+	}
+}
+
+func TestMSSClamp(t *testing.T) {
+	syn := getFakeTCPSegment(666, 80, "S")
+	mss := []byte{0x05, 0xb4}
+	syn.GetTCPLayer().Options = []layers.TCPOption{{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: mss}}
+
+	if !clampMSS(syn, 1400, false) {
+		t.Fatal("MSS not clamped")
+	}
+	if value := binary.BigEndian.Uint16(syn.GetTCPLayer().Options[0].OptionData); value != 1360 {
+		t.Error("MSS = ", value, "; want = 1360")
+	}
+	if clampMSS(syn, 1500, false) {
+		t.Error("MSS must never be increased")
+	}
+	if clampMSS(getFakeTCPSegment(666, 80, "A"), 1400, false) {
+		t.Error("Only SYN packets carry the MSS")
+	}
+}
+
+func getFakeTunnelSockets(t testing.TB) (*net.UDPConn, *net.UDPConn) {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = listener.SetReadBuffer(4 * 1024 * 1024)
+	sender, err := net.DialUDP("udp4", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener, sender
+}
+
+func TestPacketBufferPool(t *testing.T) {
+	small := getBuffer(1500)
+	if len(*small) != 1500 || cap(*small) != smallBufferSize {
+		t.Error("small buffer len = ", len(*small), " cap = ", cap(*small))
+	}
+	large := getBuffer(9000)
+	if len(*large) != 9000 || cap(*large) != BUFFER_SIZE {
+		t.Error("large buffer len = ", len(*large), " cap = ", cap(*large))
+	}
+	releaseBuffer(small)
+	releaseBuffer(large)
+	releaseBuffer(nil)
+}
+
+func TestPeerWriterBatch(t *testing.T) {
+	listener, _ := getFakeTunnelSockets(t)
+	defer listener.Close()
+	proxy := getFakeTunnel()
+	writer, err := proxy.peerWriter(listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same, _ := proxy.peerWriter(listener.LocalAddr().String()); same != writer {
+		t.Error("A single writer must exist for each peer")
+	}
+
+	packets := 3 * IO_BATCH_SIZE
+	for i := 0; i < packets; i++ {
+		for !writer.send([]byte(fmt.Sprintf("packet %d", i))) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	batch := newBatchConn(listener)
+	messages := newBatchMessages(BUFFER_SIZE)
+	_ = listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+	received := 0
+	for received < packets {
+		n, err := batch.ReadBatch(messages, 0)
+		if err != nil {
+			t.Fatal("received ", received, " packets: ", err)
+		}
+		for i := 0; i < n; i++ {
+			if string(messages[i].Buffers[0][:messages[i].N]) != fmt.Sprintf("packet %d", received) {
+				t.Error("packet ", received, " out of order")
+			}
+			received++
+		}
+	}
+}
+
+// sends packets to the listener until the benchmark is done
+func floodTunnelSocket(sender *net.UDPConn, done chan bool) {
+	batch := newBatchConn(sender)
+	messages := newBatchMessages(0)
+	for i := range messages {
+		messages[i].Buffers[0] = make([]byte, 1400)
+	}
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			_, _ = batch.WriteBatch(messages, 0)
+		}
+	}
+}
+
+func BenchmarkTunnelReadSingle(b *testing.B) {
+	listener, sender := getFakeTunnelSockets(b)
+	defer listener.Close()
+	done := make(chan bool)
+	go floodTunnelSocket(sender, done)
+	defer close(done)
+
+	buffer := make([]byte, BUFFER_SIZE)
+	b.SetBytes(1400)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n, _, err := listener.ReadFromUDP(buffer)
+		if err != nil {
+			b.Fatal(err)
+		}
+		res := make([]byte, n)
+		copy(res, buffer[:n])
+	}
+}
+
+func BenchmarkTunnelReadBatch(b *testing.B) {
+	listener, sender := getFakeTunnelSockets(b)
+	defer listener.Close()
+	done := make(chan bool)
+	go floodTunnelSocket(sender, done)
+	defer close(done)
+
+	batch := newBatchConn(listener)
+	messages := newBatchMessages(BUFFER_SIZE)
+	b.SetBytes(1400)
+	b.ResetTimer()
+	for received := 0; received < b.N; {
+		n, err := batch.ReadBatch(messages, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			res := getBuffer(messages[i].N)
+			copy(*res, messages[i].Buffers[0][:messages[i].N])
+			releaseBuffer(res)
+		}
+		received += n
+	}
+}
+
+func BenchmarkTunnelWriteSingle(b *testing.B) {
+	listener, sender := getFakeTunnelSockets(b)
+	defer listener.Close()
+	lock := sync.RWMutex{}
+	packet := make([]byte, 1400)
+	b.SetBytes(1400)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lock.Lock()
+		_, _, err := sender.WriteMsgUDP(packet, nil, nil)
+		lock.Unlock()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTunnelWriteBatch(b *testing.B) {
+	listener, sender := getFakeTunnelSockets(b)
+	defer listener.Close()
+	writer := &peerWriter{hoststring: listener.LocalAddr().String(), batch: newBatchConn(sender)}
+	writer.conn.Store(sender)
+	messages := newBatchMessages(0)
+	for i := range messages {
+		messages[i].Buffers[0] = make([]byte, 1400)
+	}
+	b.SetBytes(1400)
+	b.ResetTimer()
+	for sent := 0; sent < b.N; sent += len(messages) {
+		writer.write(messages[:minInt(len(messages), b.N-sent)])
+	}
+}
+
+func TestFlowHash(t *testing.T) {
+	_, first, _ := getFakePacket("10.30.0.2", "10.19.1.15", 666, 80)
+	_, second, _ := getFakePacket("10.30.0.2", "10.19.1.15", 667, 80)
+	firstBytes := packetToByte(first.SerializePacket(first.GetDestIP(), first.GetSrcIP(), getFakeTCPSegment(666, 80, "S")))
+	againBytes := packetToByte(first.SerializePacket(first.GetDestIP(), first.GetSrcIP(), getFakeTCPSegment(666, 80, "A")))
+	secondBytes := packetToByte(second.SerializePacket(second.GetDestIP(), second.GetSrcIP(), getFakeTCPSegment(667, 80, "S")))
+
+	if flowHash(firstBytes) != flowHash(againBytes) {
+		t.Error("Packets of the same flow must have the same hash")
+	}
+	if flowHash(firstBytes) == flowHash(secondBytes) {
+		t.Error("Different flows should have different hashes")
+	}
+	if flowHash(nil) != 0 || flowHash([]byte{0x45}) != 0 {
+		t.Error("Truncated packets must go to the first worker")
+	}
+}
+
+func TestWorkerDispatch(t *testing.T) {
+	proxy := getFakeTunnel()
+	proxy.outgoingChannel, proxy.incomingChannel = newWorkerChannels(4)
+
+	flows := 32
+	for i := 0; i < 2*flows; i++ {
+		_, ip, _ := getFakePacket("10.30.0.2", "10.19.1.15", 1000+i%flows, 80)
+		packet := packetToByte(ip.SerializePacket(ip.GetDestIP(), ip.GetSrcIP(), getFakeTCPSegment(1000+i%flows, 80, "A")))
+		proxy.dispatchOutgoing(outgoingMessage{content: &packet})
+	}
+
+	// every flow is handled by a single worker, in order
+	workerOf := make(map[uint16]int)
+	used := 0
+	for worker, channel := range proxy.outgoingChannel {
+		if len(channel) > 0 {
+			used++
+		}
+		for len(channel) > 0 {
+			msg := <-channel
+			_, prot := decodePacket(*msg.content)
+			port := prot.GetSourcePort()
+			if previous, exist := workerOf[port]; exist && previous != worker {
+				t.Error("Flow ", port, " split between workers ", previous, " and ", worker)
+			}
+			workerOf[port] = worker
+		}
+	}
+	if len(workerOf) != flows || used < 2 {
+		t.Error("Flows not spread across the workers, used = ", used)
+	}
+}
+
+// ServiceIPs are unknown until the table query answer arrives
+type FakeResolvingEnv struct {
+	FakeEnv
+	resolved bool
+	queries  int
+	answer   func([]TableEntryCache.TableEntry)
+}
+
+func (fakeenv *FakeResolvingEnv) LookupTableEntryByServiceIP(ip net.IP) []TableEntryCache.TableEntry {
+	if !fakeenv.resolved {
+		return nil
+	}
+	return fakeenv.GetTableEntryByServiceIP(ip)
+}
+
+func (fakeenv *FakeResolvingEnv) ResolveServiceIP(ip net.IP, callback func([]TableEntryCache.TableEntry)) {
+	fakeenv.queries++
+	fakeenv.answer = callback
+}
+
+func TestPendingResolution(t *testing.T) {
+	proxy := getFakeTunnel()
+	proxy.outgoingChannel, proxy.incomingChannel = newWorkerChannels(1)
+	fakeEnv := &FakeResolvingEnv{}
+	proxy.SetEnvironment(fakeEnv)
+
+	_, ip, _ := getFakePacket("10.19.1.15", "10.30.255.255", 666, 80)
+	packet := packetToByte(ip.SerializePacket(ip.GetDestIP(), ip.GetSrcIP(), getFakeTCPSegment(666, 80, "S")))
+	for i := 0; i < PENDING_QUEUE_SIZE+5; i++ {
+		content := packet
+		proxy.handleOutgoingMessage(outgoingMessage{content: &content})
+	}
+	if fakeEnv.queries != 1 {
+		t.Error("queries = ", fakeEnv.queries, "; want = 1")
+	}
+	if len(proxy.outgoingChannel[0]) != 0 {
+		t.Error("Packets towards an unresolved ServiceIP must wait")
+	}
+
+	// the answer flushes the queued packets back to the workers
+	fakeEnv.resolved = true
+	fakeEnv.answer(fakeEnv.GetTableEntryByServiceIP(nil))
+	if len(proxy.outgoingChannel[0]) != PENDING_QUEUE_SIZE {
+		t.Error("flushed = ", len(proxy.outgoingChannel[0]), "; want = ", PENDING_QUEUE_SIZE)
+	}
+	msg := <-proxy.outgoingChannel[0]
+	if !bytes.Equal(*msg.content, packet) {
+		t.Error("Flushed packet differs from the original one")
+	}
+
+	// late timeouts find nothing left to drop
+	proxy.serviceResolved(net.ParseIP("10.30.255.255"), 1, nil)
+	if len(proxy.outgoingChannel[0]) != PENDING_QUEUE_SIZE-1 {
+		t.Error("Flushed packets dropped by the timeout")
+	}
+}
+
+func TestPendingBatches(t *testing.T) {
+	queue := NewPendingQueue()
+	serviceIP := net.ParseIP("10.30.255.255")
+
+	first, isFirst, _ := queue.Enqueue(serviceIP, []byte{1})
+	if _, isFirst2, _ := queue.Enqueue(serviceIP, []byte{2}); !isFirst || isFirst2 {
+		t.Error("Only the first packet starts the resolution")
+	}
+	if packets := queue.Take(serviceIP, first); len(packets) != 2 {
+		t.Error("packets = ", len(packets), "; want = 2")
+	}
+
+	// the timeout of the first batch must not drop the packets of the next one
+	second, isFirst, _ := queue.Enqueue(serviceIP, []byte{3})
+	if !isFirst || second == first {
+		t.Fatal("Expected a new batch")
+	}
+	if packets := queue.Take(serviceIP, first); packets != nil {
+		t.Error("Stale batch took the packets of the next one")
+	}
+	if packets := queue.Take(serviceIP, second); len(packets) != 1 || packets[0][0] != 3 {
+		t.Error("Packets of the second batch lost")
+	}
+}
+
+func TestHostUnreachable(t *testing.T) {
+	original, _ := hex.DecodeString(ipv4SYNPacket)
+	icmp := hostUnreachable(original)
+	packet := gopacket.NewPacket(icmp, layers.LayerTypeIPv4, gopacket.Default)
+	icmpLayer := packet.Layer(layers.LayerTypeICMPv4)
+	if icmpLayer == nil {
+		t.Fatal("Invalid host unreachable packet")
+	}
+	icmpv4 := icmpLayer.(*layers.ICMPv4)
+	if icmpv4.TypeCode != layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeHost) {
+		t.Error("TypeCode = ", icmpv4.TypeCode.String())
+	}
+	if !bytes.Equal(icmpv4.Payload, original) {
+		t.Error("The original packet must be embedded")
+	}
+}
+
+func TestFlowTableRemoveByDestination(t *testing.T) {
+	cache := NewProxyCache()
+	for i := 0; i < 10; i++ {
+		entry := getFakeConversionEntry("TCP", 700+i)
+		if i%2 == 0 {
+			entry.dstip = net.ParseIP("10.19.2.12")
+		}
+		cache.Add(entry)
+	}
+	if removed := cache.RemoveByDestination(net.ParseIP("10.19.2.12")); removed != 5 {
+		t.Error("removed = ", removed, "; want = 5")
+	}
+	if cache.Len() != 5 {
+		t.Error("Len = ", cache.Len(), "; want = 5")
+	}
+}
+
+type FakeWatchEnv struct {
+	FakeEnv
+	table *TableEntryCache.TableManager
+}
+
+func (fakeenv *FakeWatchEnv) WatchTable() (<-chan TableEntryCache.TableChange, func()) {
+	return fakeenv.table.Watch()
+}
+
+func (fakeenv *FakeWatchEnv) LookupTableEntryByServiceIP(ip net.IP) []TableEntryCache.TableEntry {
+	return fakeenv.table.SearchByServiceIP(ip)
+}
+
+func TestFlowsRemovedWithTableEntries(t *testing.T) {
+	proxy := getFakeTunnel()
+	table := TableEntryCache.NewTableManager()
+	proxy.SetEnvironment(&FakeWatchEnv{table: &table})
+
+	entry := TableEntryCache.TableEntry{
+		JobName:          "a.a.b.b",
+		Appname:          "a",
+		Appns:            "a",
+		Servicename:      "b",
+		Servicenamespace: "b",
+		Instancenumber:   0,
+		Nodeip:           net.ParseIP("10.30.0.1"),
+		Nsip:             net.ParseIP("10.19.2.12"),
+		Nsipv6:           net.ParseIP("fc00::2"),
+		ServiceIP: []TableEntryCache.ServiceIP{{
+			IpType:  TableEntryCache.RoundRobin,
+			Address: net.ParseIP("10.30.255.255"),
+		}},
+	}
+	_ = table.Add(entry)
+	flow := getFakeConversionEntry("TCP", 777)
+	flow.dstip = entry.Nsip
+	proxy.proxycache.Add(flow)
+
+	_ = table.RemoveByNsip(entry.Nsip)
+	for i := 0; i < 100 && proxy.proxycache.Len() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if proxy.proxycache.Len() != 0 {
+		t.Error("Flow towards the removed instance still active")
+	}
+	proxy.stopTableWatch()
+}
+
+func TestBalancerForgetsRemovedServices(t *testing.T) {
+	proxy := getFakeTunnel()
+	table := TableEntryCache.NewTableManager()
+	proxy.SetEnvironment(&FakeWatchEnv{table: &table})
+	serviceIP := net.ParseIP("10.30.255.255")
+
+	entries := make([]TableEntryCache.TableEntry, 0)
+	for i := 1; i <= 2; i++ {
+		entry := TableEntryCache.TableEntry{
+			JobName:          "a.a.b.b",
+			Appname:          "a",
+			Appns:            "a",
+			Servicename:      "b",
+			Servicenamespace: "b",
+			Instancenumber:   i,
+			Nodeip:           net.ParseIP("10.30.0.1"),
+			Nsip:             net.ParseIP(fmt.Sprintf("10.19.2.%d", i)),
+			Nsipv6:           net.ParseIP(fmt.Sprintf("fc00::%d", i)),
+			ServiceIP: []TableEntryCache.ServiceIP{{
+				IpType:  TableEntryCache.RoundRobin,
+				Address: serviceIP,
+			}},
+		}
+		_ = table.Add(entry)
+		entries = append(entries, entry)
+	}
+	proxy.balancer.Next(serviceIP, entries)
+
+	balancerState := func() bool {
+		proxy.balancer.lock.Lock()
+		defer proxy.balancer.lock.Unlock()
+		_, exist := proxy.balancer.services[serviceIP.String()]
+		return exist
+	}
+	// the state stays while the ServiceIP has instances
+	_ = table.RemoveByNsip(entries[0].Nsip)
+	time.Sleep(10 * time.Millisecond)
+	if !balancerState() {
+		t.Error("Balancing state forgotten while the service has instances")
+	}
+	_ = table.RemoveByNsip(entries[1].Nsip)
+	for i := 0; i < 100 && balancerState(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if balancerState() {
+		t.Error("Balancing state of the removed service still present")
+	}
+	proxy.stopTableWatch()
+}
+
+// proxyOutgoing converts the packet with the entries of its destination, as handleOutgoingMessage
+func proxyOutgoing(proxy *GoProxyTunnel, ip iputils.NetworkLayerPacket, prot iputils.TransportLayerProtocol) gopacket.Packet {
+	return proxy.outgoingProxy(ip, prot, proxy.environment.LookupTableEntryByServiceIP(ip.GetDestIP()))
+}
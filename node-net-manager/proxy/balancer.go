@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"NetManager/TableEntryCache"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ServiceBalancer keeps the weighted round robin state of every RoundRobin ServiceIP.
+// It uses the smooth weighted round robin algorithm, which with equal weights is a plain round robin.
+type ServiceBalancer struct {
+	services map[string]*roundRobinState
+	randseed *rand.Rand
+	lock     sync.Mutex
+}
+
+type roundRobinState struct {
+	// current weight of each instance, indexed by instanceKey
+	currentWeight map[string]int
+}
+
+func NewServiceBalancer() *ServiceBalancer {
+	return &ServiceBalancer{
+		services: make(map[string]*roundRobinState),
+		randseed: rand.New(rand.NewSource(time.Now().UnixNano())),
+		lock:     sync.Mutex{},
+	}
+}
+
+func instanceWeight(entry TableEntryCache.TableEntry) int {
+	if entry.Weight < 1 {
+		return 1
+	}
+	return entry.Weight
+}
+
+// instances are identified by their namespace IP, the IPv6 one for the IPv6-only instances
+func instanceKey(entry TableEntryCache.TableEntry) string {
+	if entry.Nsip == nil {
+		return entry.Nsipv6.String()
+	}
+	return entry.Nsip.String()
+}
+
+// Next returns the instance that must serve the next flow towards the given ServiceIP
+func (balancer *ServiceBalancer) Next(serviceIP net.IP, tableEntryList []TableEntryCache.TableEntry) TableEntryCache.TableEntry {
+	// the order of the table entries is not stable, sort them to keep the sequence deterministic
+	candidates := make([]TableEntryCache.TableEntry, len(tableEntryList))
+	copy(candidates, tableEntryList)
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Instancenumber != candidates[j].Instancenumber {
+			return candidates[i].Instancenumber < candidates[j].Instancenumber
+		}
+		return instanceKey(candidates[i]) < instanceKey(candidates[j])
+	})
+
+	balancer.lock.Lock()
+	defer balancer.lock.Unlock()
+
+	state, exist := balancer.services[serviceIP.String()]
+	if !exist {
+		state = &roundRobinState{currentWeight: make(map[string]int)}
+		balancer.services[serviceIP.String()] = state
+		// start each node at a different point of the sequence, otherwise every node hits the same instance first
+		totalWeight := 0
+		for _, entry := range candidates {
+			totalWeight += instanceWeight(entry)
+		}
+		for skip := balancer.randseed.Intn(totalWeight); skip > 0; skip-- {
+			state.next(candidates)
+		}
+	}
+	return candidates[state.next(candidates)]
+}
+
+// Forget removes the balancing state of a ServiceIP
+func (balancer *ServiceBalancer) Forget(serviceIP net.IP) {
+	balancer.lock.Lock()
+	defer balancer.lock.Unlock()
+	delete(balancer.services, serviceIP.String())
+}
+
+// smooth weighted round robin step, returns the index of the selected candidate
+func (state *roundRobinState) next(candidates []TableEntryCache.TableEntry) int {
+	updatedWeight := make(map[string]int, len(candidates))
+	totalWeight := 0
+	best := 0
+	for i, entry := range candidates {
+		weight := instanceWeight(entry)
+		key := instanceKey(entry)
+		updatedWeight[key] = state.currentWeight[key] + weight
+		totalWeight += weight
+		if updatedWeight[key] > updatedWeight[instanceKey(candidates[best])] {
+			best = i
+		}
+	}
+	updatedWeight[instanceKey(candidates[best])] -= totalWeight
+	// instances no longer part of the service are dropped here
+	state.currentWeight = updatedWeight
+	return best
+}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"NetManager/logger"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// IO_BATCH_SIZE is the maximum number of packets read from or written to a tunnel socket with a single syscall
+var IO_BATCH_SIZE = 64
+
+// PEER_QUEUE_SIZE is the number of packets that can wait to be sent to a peer node, further packets are dropped
+var PEER_QUEUE_SIZE = 1024
+
+// Packets are copied from the read buffers into pooled buffers, sized for the common MTUs or for the biggest packet
+const smallBufferSize = 2048
+
+var smallBuffers = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, smallBufferSize)
+		return &buffer
+	},
+}
+
+var largeBuffers = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, BUFFER_SIZE)
+		return &buffer
+	},
+}
+
+// getBuffer returns a pooled buffer of the given size, it must be given back with releaseBuffer
+func getBuffer(size int) *[]byte {
+	var buffer *[]byte
+	if size <= smallBufferSize {
+		buffer = smallBuffers.Get().(*[]byte)
+	} else {
+		buffer = largeBuffers.Get().(*[]byte)
+	}
+	if cap(*buffer) < size {
+		newBuffer := make([]byte, size)
+		buffer = &newBuffer
+	}
+	*buffer = (*buffer)[:size]
+	return buffer
+}
+
+// releaseBuffer gives the buffer back to its pool, nil or foreign buffers are ignored
+func releaseBuffer(buffer *[]byte) {
+	if buffer == nil {
+		return
+	}
+	switch cap(*buffer) {
+	case smallBufferSize:
+		smallBuffers.Put(buffer)
+	case BUFFER_SIZE:
+		largeBuffers.Put(buffer)
+	}
+}
+
+// batchConn reads and writes multiple messages with a single recvmmsg/sendmmsg
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(conn *net.UDPConn) batchConn {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		return ipv4.NewPacketConn(conn)
+	}
+	return ipv6.NewPacketConn(conn)
+}
+
+func newBatchMessages(bufferSize int) []ipv4.Message {
+	messages := make([]ipv4.Message, IO_BATCH_SIZE)
+	for i := range messages {
+		messages[i].Buffers = make([][]byte, 1)
+		if bufferSize > 0 {
+			messages[i].Buffers[0] = make([]byte, bufferSize)
+		}
+	}
+	return messages
+}
+
+// peerWriter owns the UDP channel towards a peer node. Senders only enqueue the packets, a single goroutine
+// writes them in batches, so that no lock is shared between the peers.
+type peerWriter struct {
+	hoststring string
+	conn       atomic.Pointer[net.UDPConn]
+	batch      batchConn
+	queue      chan []byte
+}
+
+func newPeerWriter(hoststring string) (*peerWriter, error) {
+	connection, err := createUDPChannel(hoststring)
+	if err != nil {
+		return nil, err
+	}
+	writer := &peerWriter{
+		hoststring: hoststring,
+		batch:      newBatchConn(connection),
+		queue:      make(chan []byte, PEER_QUEUE_SIZE),
+	}
+	writer.conn.Store(connection)
+	return writer, nil
+}
+
+// send enqueues the packet without waiting, returns false if the queue is full
+func (writer *peerWriter) send(packet []byte) bool {
+	select {
+	case writer.queue <- packet:
+		return true
+	default:
+		return false
+	}
+}
+
+func (writer *peerWriter) run() {
+	messages := newBatchMessages(0)
+	for packet := range writer.queue {
+		messages[0].Buffers[0] = packet
+		n := 1
+		// take the packets already queued without waiting for more
+	drain:
+		for n < len(messages) {
+			select {
+			case packet = <-writer.queue:
+				messages[n].Buffers[0] = packet
+				n++
+			default:
+				break drain
+			}
+		}
+		writer.write(messages[:n])
+		for i := 0; i < n; i++ {
+			messages[i].Buffers[0] = nil
+		}
+	}
+}
+
+// write sends the batch, the channel is re-created if the write fails
+func (writer *peerWriter) write(messages []ipv4.Message) {
+	for attempt := 0; len(messages) > 0 && attempt <= 10; {
+		written, err := writer.batch.WriteBatch(messages, 0)
+		if err != nil {
+			logger.ErrorLogger().Println(err)
+			attempt++
+			if writer.reconnect() != nil {
+				return
+			}
+			continue
+		}
+		if written == 0 {
+			attempt++
+		}
+		messages = messages[written:]
+	}
+}
+
+func (writer *peerWriter) reconnect() error {
+	_ = writer.conn.Load().Close()
+	connection, err := createUDPChannel(writer.hoststring)
+	if err != nil {
+		return err
+	}
+	writer.batch = newBatchConn(connection)
+	writer.conn.Store(connection)
+	return nil
+}
+
+// peerWriter returns the writer towards the peer node, the writer is created on first use
+func (proxy *GoProxyTunnel) peerWriter(hoststring string) (*peerWriter, error) {
+	if writer, exist := proxy.peers.Load(hoststring); exist {
+		return writer.(*peerWriter), nil
+	}
+	logger.DebugLogger().Println("Establishing a new connection to node ", hoststring)
+	writer, err := newPeerWriter(hoststring)
+	if err != nil {
+		return nil, err
+	}
+	current, loaded := proxy.peers.LoadOrStore(hoststring, writer)
+	if loaded {
+		// another sender created it first
+		_ = writer.conn.Load().Close()
+		return current.(*peerWriter), nil
+	}
+	go writer.run()
+	return writer, nil
+}
+
+// peerConnection returns the UDP channel towards the peer node
+func (proxy *GoProxyTunnel) peerConnection(hoststring string) (*net.UDPConn, error) {
+	writer, err := proxy.peerWriter(hoststring)
+	if err != nil {
+		return nil, err
+	}
+	return writer.conn.Load(), nil
+}
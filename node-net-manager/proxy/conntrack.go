@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"NetManager/proxy/iputils"
+	"time"
+)
+
+// TCP_SYN_TIMEOUT is the idle timeout of a TCP flow whose handshake is not completed yet
+var TCP_SYN_TIMEOUT = 30 * time.Second
+
+// TCP_ESTABLISHED_TIMEOUT is the idle timeout of an established TCP connection
+var TCP_ESTABLISHED_TIMEOUT = 2 * time.Hour
+
+// TCP_HALF_CLOSED_TIMEOUT is the idle timeout of a TCP connection closed by one of the peers
+var TCP_HALF_CLOSED_TIMEOUT = 2 * time.Minute
+
+// TCP_CLOSED_TIMEOUT keeps a closed connection for the last retransmissions
+var TCP_CLOSED_TIMEOUT = 10 * time.Second
+
+type connState uint8
+
+const (
+	stateNew connState = iota
+	stateEstablished
+	stateHalfClosed
+	stateClosed
+)
+
+// idle timeouts of the flows according to their state, UDP and ICMP flows are stateless
+type flowTimeouts struct {
+	udp            time.Duration
+	tcpSyn         time.Duration
+	tcpEstablished time.Duration
+	tcpHalfClosed  time.Duration
+	tcpClosed      time.Duration
+}
+
+func defaultFlowTimeouts() flowTimeouts {
+	return flowTimeouts{
+		udp:            FLOW_IDLE_TIMEOUT,
+		tcpSyn:         TCP_SYN_TIMEOUT,
+		tcpEstablished: TCP_ESTABLISHED_TIMEOUT,
+		tcpHalfClosed:  TCP_HALF_CLOSED_TIMEOUT,
+		tcpClosed:      TCP_CLOSED_TIMEOUT,
+	}
+}
+
+// conntrack state of a flow
+type connTrack struct {
+	state       connState
+	seenReply   bool
+	finOriginal bool
+	finReply    bool
+}
+
+// track follows the TCP flags of a packet of the flow. original is true for packets sent by the client.
+func (ct *connTrack) track(prot iputils.TransportLayerProtocol, original bool) {
+	if prot == nil || prot.GetProtocol() != "TCP" || prot.GetTCPLayer() == nil {
+		return
+	}
+	tcp := prot.GetTCPLayer()
+	switch {
+	case tcp.RST:
+		ct.state = stateClosed
+		return
+	case tcp.SYN && !tcp.ACK && original:
+		// new connection, possibly reusing the ports of a closed one
+		*ct = connTrack{state: stateNew}
+		return
+	}
+	if !original {
+		ct.seenReply = true
+	}
+	if tcp.FIN {
+		if original {
+			ct.finOriginal = true
+		} else {
+			ct.finReply = true
+		}
+	}
+	switch {
+	case ct.finOriginal && ct.finReply:
+		ct.state = stateClosed
+	case ct.finOriginal || ct.finReply:
+		ct.state = stateHalfClosed
+	case ct.state == stateNew && ct.seenReply && original && tcp.ACK:
+		// handshake completed, or connection picked up in the middle
+		ct.state = stateEstablished
+	}
+}
+
+func (timeouts flowTimeouts) of(protocol string, state connState) time.Duration {
+	if protocol != "TCP" {
+		return timeouts.udp
+	}
+	switch state {
+	case stateEstablished:
+		return timeouts.tcpEstablished
+	case stateHalfClosed:
+		return timeouts.tcpHalfClosed
+	case stateClosed:
+		return timeouts.tcpClosed
+	default:
+		return timeouts.tcpSyn
+	}
+}
+
+// pinned flows are never re-balanced to another instance until the connection is closed
+func (entry ConversionEntry) pinned() bool {
+	return entry.protocol == "TCP" && (entry.state == stateEstablished || entry.state == stateHalfClosed)
+}
@@ -0,0 +1,283 @@
+package iputils
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/google/gopacket/layers"
+)
+
+// ICMP messages are tracked by the proxy as flows where both ports are the echo identifier.
+// ICMP errors carry the header of the packet that caused them, the flow is the one of the embedded packet, reversed.
+
+// ICMPLayerProtocol is implemented by the ICMPv4 and ICMPv6 layers
+type ICMPLayerProtocol interface {
+	TransportLayerProtocol
+	IsError() bool
+	EmbeddedProtocol() string
+	EmbeddedDestIP() net.IP
+}
+
+type ICMPv4Layer struct {
+	*layers.ICMPv4
+}
+
+type ICMPv6Layer struct {
+	*layers.ICMPv6
+}
+
+func (l ICMPv4Layer) GetSourcePort() uint16 {
+	if l.IsError() {
+		_, dstport, ok := embeddedPorts(l.Payload, 4)
+		if ok {
+			return dstport
+		}
+	}
+	return l.Id
+}
+
+func (l ICMPv4Layer) GetDestPort() uint16 {
+	if l.IsError() {
+		srcport, _, ok := embeddedPorts(l.Payload, 4)
+		if ok {
+			return srcport
+		}
+	}
+	return l.Id
+}
+
+func (l ICMPv4Layer) GetProtocol() string {
+	return "ICMP"
+}
+
+func (l ICMPv4Layer) GetUDPLayer() *layers.UDP {
+	return nil
+}
+
+func (l ICMPv4Layer) GetTCPLayer() *layers.TCP {
+	return nil
+}
+
+// IsError returns true if the message carries the header of the packet that caused it
+func (l ICMPv4Layer) IsError() bool {
+	switch l.TypeCode.Type() {
+	case layers.ICMPv4TypeDestinationUnreachable,
+		layers.ICMPv4TypeSourceQuench,
+		layers.ICMPv4TypeTimeExceeded,
+		layers.ICMPv4TypeParameterProblem:
+		return true
+	}
+	return false
+}
+
+// EmbeddedProtocol returns the protocol of the packet embedded in an ICMP error
+func (l ICMPv4Layer) EmbeddedProtocol() string {
+	return embeddedProtocol(l.Payload, 4)
+}
+
+// EmbeddedDestIP returns the destination of the packet embedded in an ICMP error, nil if truncated
+func (l ICMPv4Layer) EmbeddedDestIP() net.IP {
+	return embeddedDestIP(l.Payload, 4)
+}
+
+// echo identifier, in ICMPv6 it's part of the payload
+func (l ICMPv6Layer) identifier() uint16 {
+	if len(l.Payload) < 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(l.Payload[0:2])
+}
+
+func (l ICMPv6Layer) GetSourcePort() uint16 {
+	if l.IsError() {
+		_, dstport, ok := embeddedPorts(l.Payload[4:], 6)
+		if ok {
+			return dstport
+		}
+	}
+	return l.identifier()
+}
+
+func (l ICMPv6Layer) GetDestPort() uint16 {
+	if l.IsError() {
+		srcport, _, ok := embeddedPorts(l.Payload[4:], 6)
+		if ok {
+			return srcport
+		}
+	}
+	return l.identifier()
+}
+
+func (l ICMPv6Layer) GetProtocol() string {
+	return "ICMPv6"
+}
+
+func (l ICMPv6Layer) GetUDPLayer() *layers.UDP {
+	return nil
+}
+
+func (l ICMPv6Layer) GetTCPLayer() *layers.TCP {
+	return nil
+}
+
+// IsError returns true if the message carries the header of the packet that caused it
+func (l ICMPv6Layer) IsError() bool {
+	if len(l.Payload) < 4 {
+		return false
+	}
+	switch l.TypeCode.Type() {
+	case layers.ICMPv6TypeDestinationUnreachable,
+		layers.ICMPv6TypePacketTooBig,
+		layers.ICMPv6TypeTimeExceeded,
+		layers.ICMPv6TypeParameterProblem:
+		return true
+	}
+	return false
+}
+
+// EmbeddedProtocol returns the protocol of the packet embedded in an ICMP error
+func (l ICMPv6Layer) EmbeddedProtocol() string {
+	if len(l.Payload) < 4 {
+		return ""
+	}
+	return embeddedProtocol(l.Payload[4:], 6)
+}
+
+// EmbeddedDestIP returns the destination of the packet embedded in an ICMP error, nil if truncated
+func (l ICMPv6Layer) EmbeddedDestIP() net.IP {
+	if len(l.Payload) < 4 {
+		return nil
+	}
+	return embeddedDestIP(l.Payload[4:], 6)
+}
+
+func embeddedDestIP(embedded []byte, version uint8) net.IP {
+	if _, _, ok := embeddedTransport(embedded, version); !ok {
+		return nil
+	}
+	if version == 4 {
+		return net.IP(append(make([]byte, 0, net.IPv4len), embedded[16:20]...))
+	}
+	return net.IP(append(make([]byte, 0, net.IPv6len), embedded[24:40]...))
+}
+
+func embeddedProtocol(embedded []byte, version uint8) string {
+	_, protocol, ok := embeddedTransport(embedded, version)
+	if !ok {
+		return ""
+	}
+	switch protocol {
+	case layers.IPProtocolTCP:
+		return "TCP"
+	case layers.IPProtocolUDP:
+		return "UDP"
+	case layers.IPProtocolICMPv4:
+		return "ICMP"
+	case layers.IPProtocolICMPv6:
+		return "ICMPv6"
+	}
+	return ""
+}
+
+// returns the offset of the embedded transport header and the embedded next header
+func embeddedTransport(embedded []byte, version uint8) (int, layers.IPProtocol, bool) {
+	if version == 4 {
+		if len(embedded) < 20 {
+			return 0, 0, false
+		}
+		return int(embedded[0]&0x0f) * 4, layers.IPProtocol(embedded[9]), true
+	}
+	if len(embedded) < 40 {
+		return 0, 0, false
+	}
+	return 40, layers.IPProtocol(embedded[6]), true
+}
+
+// ports of the packet embedded in an ICMP error, the echo identifier if the embedded packet is an echo request
+func embeddedPorts(embedded []byte, version uint8) (uint16, uint16, bool) {
+	offset, protocol, ok := embeddedTransport(embedded, version)
+	if !ok || len(embedded) < offset+8 {
+		return 0, 0, false
+	}
+	switch protocol {
+	case layers.IPProtocolTCP, layers.IPProtocolUDP:
+		return binary.BigEndian.Uint16(embedded[offset:]), binary.BigEndian.Uint16(embedded[offset+2:]), true
+	case layers.IPProtocolICMPv4, layers.IPProtocolICMPv6:
+		id := binary.BigEndian.Uint16(embedded[offset+4:])
+		return id, id, true
+	}
+	return 0, 0, false
+}
+
+// rewriteEmbedded replaces the addresses of the packet embedded in an ICMP error and fixes its checksums.
+// The returned slice is a copy, the original packet is left untouched.
+func rewriteEmbedded(embedded []byte, version uint8, srcIp net.IP, dstIp net.IP) []byte {
+	result := make([]byte, len(embedded))
+	copy(result, embedded)
+	offset, protocol, ok := embeddedTransport(result, version)
+	if !ok {
+		return result
+	}
+
+	addrStart, addrLen := 12, 4
+	newAddr := append(append(make([]byte, 0, 8), srcIp.To4()...), dstIp.To4()...)
+	if version == 6 {
+		addrStart, addrLen = 8, 16
+		newAddr = append(append(make([]byte, 0, 32), srcIp.To16()...), dstIp.To16()...)
+	}
+	if len(newAddr) != 2*addrLen {
+		return result
+	}
+	oldAddr := make([]byte, 2*addrLen)
+	copy(oldAddr, result[addrStart:addrStart+2*addrLen])
+	copy(result[addrStart:], newAddr)
+
+	if version == 4 && offset <= len(result) {
+		binary.BigEndian.PutUint16(result[10:12], 0)
+		binary.BigEndian.PutUint16(result[10:12], headerChecksum(result[:offset]))
+	}
+
+	// the transport checksum covers the addresses through the pseudo header
+	checksumOffset := -1
+	switch protocol {
+	case layers.IPProtocolUDP:
+		checksumOffset = offset + 6
+	case layers.IPProtocolTCP:
+		checksumOffset = offset + 16
+	case layers.IPProtocolICMPv6:
+		checksumOffset = offset + 2
+	}
+	if checksumOffset > 0 && len(result) >= checksumOffset+2 {
+		checksum := binary.BigEndian.Uint16(result[checksumOffset:])
+		// a zero UDP checksum over IPv4 means no checksum
+		if !(protocol == layers.IPProtocolUDP && version == 4 && checksum == 0) {
+			binary.BigEndian.PutUint16(result[checksumOffset:], updateChecksum(checksum, oldAddr, newAddr))
+		}
+	}
+	return result
+}
+
+// one's complement checksum of an IPv4 header
+func headerChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// incremental checksum update, RFC 1624
+func updateChecksum(checksum uint16, oldData []byte, newData []byte) uint16 {
+	sum := uint32(^checksum)
+	for i := 0; i+1 < len(oldData) && i+1 < len(newData); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(oldData[i:]))
+		sum += uint32(binary.BigEndian.Uint16(newData[i:]))
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
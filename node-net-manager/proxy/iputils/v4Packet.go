@@ -72,6 +72,15 @@ func (packet *IPv4Packet) GetTransportLayer() TransportLayerProtocol {
 			logger.ErrorLogger().Println("Could not decode IPv4 TCP packet.")
 		}
 		return tcp
+	case layers.IPProtocolICMPv4:
+		icmplayer := packet.LayerPayload()
+		icmp := &ICMPv4Layer{&layers.ICMPv4{}}
+		err := icmp.ICMPv4.DecodeFromBytes(icmplayer, gopacket.NilDecodeFeedback)
+		if err != nil {
+			logger.ErrorLogger().Println("Could not decode IPv4 ICMP packet.")
+			return nil
+		}
+		return icmp
 	default:
 		logger.DebugLogger().Println("Could not determine TransportLayer of IPv4 Packet.")
 		return nil
@@ -94,9 +103,12 @@ func (ip *IPv4Packet) SerializePacket(dstIp net.IP, srcIp net.IP, prot Transport
 	ip.DstIP = dstIp
 	ip.SrcIP = srcIp
 
-	if prot.GetProtocol() == "TCP" {
+	switch prot.GetProtocol() {
+	case "TCP":
 		return ip.serializeTCPHeader(prot.GetTCPLayer())
-	} else {
+	case "ICMP":
+		return ip.serializeICMPHeader(prot.(*ICMPv4Layer))
+	default:
 		return ip.serializeUDPHeader(prot.GetUDPLayer())
 	}
 }
@@ -117,6 +129,15 @@ func (ip *IPv4Packet) serializeUDPHeader(udp *layers.UDP) gopacket.Packet {
 	return ip.serializeIPHeader(udp, gopacket.Payload(udp.Payload))
 }
 
+// ICMP errors embed the header of the packet that caused them, it must be translated back as well
+func (ip *IPv4Packet) serializeICMPHeader(icmp *ICMPv4Layer) gopacket.Packet {
+	payload := icmp.Payload
+	if icmp.IsError() {
+		payload = rewriteEmbedded(icmp.Payload, 4, ip.DstIP, ip.SrcIP)
+	}
+	return ip.serializeIPHeader(icmp.ICMPv4, gopacket.Payload(payload))
+}
+
 func (ip *IPv4Packet) serializeIPHeader(transportLayer gopacket.SerializableLayer, payload gopacket.SerializableLayer) gopacket.Packet {
 	newBuffer := gopacket.NewSerializeBuffer()
 	err := ip.SerializeTo(newBuffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true})
@@ -92,6 +92,15 @@ func (packet *IPv6Packet) GetTransportLayer() TransportLayerProtocol {
 			logger.ErrorLogger().Println("Could not decode IPv6 TCP packet.")
 		}
 		return tcp
+	case layers.IPProtocolICMPv6:
+		icmplayer := packet.IPv6.LayerPayload()
+		icmp := &ICMPv6Layer{&layers.ICMPv6{}}
+		err := icmp.DecodeFromBytes(icmplayer, gopacket.NilDecodeFeedback)
+		if err != nil {
+			logger.ErrorLogger().Println("Could not decode IPv6 ICMP packet.")
+			return nil
+		}
+		return icmp
 	default:
 		logger.ErrorLogger().Println("Could not determine TransportLayer of IPv6 Packet.")
 		return nil
@@ -102,9 +111,12 @@ func (ip *IPv6Packet) SerializePacket(dstIp net.IP, srcIp net.IP, prot Transport
 	ip.DstIP = dstIp
 	ip.SrcIP = srcIp
 
-	if prot.GetProtocol() == "TCP" {
+	switch prot.GetProtocol() {
+	case "TCP":
 		return ip.serializeTCPHeader(prot.GetTCPLayer())
-	} else {
+	case "ICMPv6":
+		return ip.serializeICMPHeader(prot.(*ICMPv6Layer))
+	default:
 		return ip.serializeUDPHeader(prot.GetUDPLayer())
 	}
 }
@@ -125,6 +137,20 @@ func (ip *IPv6Packet) serializeUDPHeader(udp *layers.UDP) gopacket.Packet {
 	return ip.serializeIPHeader(udp, gopacket.Payload(udp.Payload))
 }
 
+// ICMP errors embed the header of the packet that caused them, it must be translated back as well
+func (ip *IPv6Packet) serializeICMPHeader(icmp *ICMPv6Layer) gopacket.Packet {
+	err := icmp.SetNetworkLayerForChecksum(ip.IPv6)
+	if err != nil {
+		fmt.Println(err)
+	}
+	payload := icmp.Payload
+	if icmp.IsError() {
+		payload = append(append(make([]byte, 0, len(payload)), payload[:4]...),
+			rewriteEmbedded(icmp.Payload[4:], 6, ip.DstIP, ip.SrcIP)...)
+	}
+	return ip.serializeIPHeader(icmp.ICMPv6, gopacket.Payload(payload))
+}
+
 func (ip *IPv6Packet) serializeIPHeader(transportLayer gopacket.SerializableLayer, payload gopacket.SerializableLayer) gopacket.Packet {
 	newBuffer := gopacket.NewSerializeBuffer()
 	err := ip.SerializeTo(newBuffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true})
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"NetManager/TableEntryCache"
+	"NetManager/logger"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LATENCY_PROBE_INTERVAL is the period between two latency probes towards the same peer
+var LATENCY_PROBE_INTERVAL = 10 * time.Second
+
+// LATENCY_PEER_TIMEOUT is the time after which a peer that is no longer used as a balancing candidate stops being probed
+var LATENCY_PEER_TIMEOUT = 5 * time.Minute
+
+// probe packets are exchanged on the tunnel socket. The first byte can never be mistaken for an IPv4 or IPv6 header.
+// | type (1) | nonce (8) |, the reply echoes the nonce of the request.
+const (
+	probeRequest   byte = 0x01
+	probeReply     byte = 0x02
+	probePacketLen      = 9
+)
+
+type peerLatency struct {
+	addr      *net.UDPAddr
+	rtt       time.Duration
+	measured  bool
+	lastReply time.Time
+	lastUsed  time.Time
+	// random nonce of the probe waiting for a reply, 0 if none
+	probeNonce uint64
+	probeSent  time.Time
+}
+
+// LatencyStore keeps the smoothed round trip time towards every peer tunnel endpoint
+type LatencyStore struct {
+	peers  map[string]*peerLatency
+	rwlock sync.RWMutex
+}
+
+func NewLatencyStore() *LatencyStore {
+	return &LatencyStore{
+		peers:  make(map[string]*peerLatency),
+		rwlock: sync.RWMutex{},
+	}
+}
+
+func peerKey(ip net.IP, port int) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// Track marks the peer as a balancing candidate. Returns true if the peer was not tracked yet.
+func (store *LatencyStore) Track(ip net.IP, port int) bool {
+	key := peerKey(ip, port)
+	store.rwlock.Lock()
+	defer store.rwlock.Unlock()
+	peer, exist := store.peers[key]
+	if !exist {
+		store.peers[key] = &peerLatency{
+			addr:     &net.UDPAddr{IP: ip, Port: port},
+			lastUsed: time.Now(),
+		}
+		return true
+	}
+	peer.lastUsed = time.Now()
+	return false
+}
+
+// Update adds a new rtt sample for the peer using an exponentially weighted moving average
+func (store *LatencyStore) Update(ip net.IP, port int, sample time.Duration) {
+	key := peerKey(ip, port)
+	store.rwlock.Lock()
+	defer store.rwlock.Unlock()
+	peer, exist := store.peers[key]
+	if !exist {
+		// reply from a peer that is not a candidate anymore
+		return
+	}
+	if peer.measured {
+		peer.rtt = peer.rtt - peer.rtt/4 + sample/4
+	} else {
+		peer.rtt = sample
+		peer.measured = true
+	}
+	peer.lastReply = time.Now()
+}
+
+// StartProbe records a new probe towards the peer and returns its nonce. False if the peer is not tracked.
+func (store *LatencyStore) StartProbe(ip net.IP, port int) (uint64, bool) {
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return 0, false
+	}
+	store.rwlock.Lock()
+	defer store.rwlock.Unlock()
+	peer, exist := store.peers[peerKey(ip, port)]
+	if !exist {
+		return 0, false
+	}
+	// a previous probe without reply is lost
+	peer.probeNonce = binary.BigEndian.Uint64(nonce[:]) | 1
+	peer.probeSent = time.Now()
+	return peer.probeNonce, true
+}
+
+// ProbeReplied returns the rtt of the probe answered by the peer at ip:port. False if the nonce doesn't match the
+// probe sent to that peer, e.g. a spoofed or repeated reply.
+func (store *LatencyStore) ProbeReplied(ip net.IP, port int, nonce uint64) (time.Duration, bool) {
+	store.rwlock.Lock()
+	defer store.rwlock.Unlock()
+	peer, exist := store.peers[peerKey(ip, port)]
+	if !exist || peer.probeNonce == 0 || peer.probeNonce != nonce {
+		return 0, false
+	}
+	peer.probeNonce = 0
+	return time.Since(peer.probeSent), true
+}
+
+// Get returns the smoothed rtt towards the peer. False if the peer has not been measured or stopped answering.
+func (store *LatencyStore) Get(ip net.IP, port int) (time.Duration, bool) {
+	store.rwlock.RLock()
+	defer store.rwlock.RUnlock()
+	peer, exist := store.peers[peerKey(ip, port)]
+	if !exist || !peer.measured || time.Since(peer.lastReply) > 3*LATENCY_PROBE_INTERVAL {
+		return 0, false
+	}
+	return peer.rtt, true
+}
+
+// probeTargets returns the peers that must be probed and forgets the ones that are no longer used
+func (store *LatencyStore) probeTargets() []*net.UDPAddr {
+	store.rwlock.Lock()
+	defer store.rwlock.Unlock()
+	result := make([]*net.UDPAddr, 0, len(store.peers))
+	for key, peer := range store.peers {
+		if time.Since(peer.lastUsed) > LATENCY_PEER_TIMEOUT {
+			delete(store.peers, key)
+			continue
+		}
+		result = append(result, peer.addr)
+	}
+	return result
+}
+
+// periodically sends a probe to every tracked peer, or immediately if a new peer is requested
+func (proxy *GoProxyTunnel) latencyProbing() {
+	ticker := time.NewTicker(LATENCY_PROBE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case addr := <-proxy.probeChannel:
+			proxy.sendProbe(addr)
+		case <-ticker.C:
+			for _, addr := range proxy.latency.probeTargets() {
+				proxy.sendProbe(addr)
+			}
+		}
+	}
+}
+
+// requestProbe asks the prober for a measurement towards a new peer without blocking the packet path
+func (proxy *GoProxyTunnel) requestProbe(ip net.IP, port int) {
+	if !proxy.latency.Track(ip, port) {
+		return
+	}
+	select {
+	case proxy.probeChannel <- &net.UDPAddr{IP: ip, Port: port}:
+	default:
+		logger.DebugLogger().Println("Probe channel full, waiting for next probing round")
+	}
+}
+
+// probes are sent from the listening socket so that the reply comes back to udpread
+func (proxy *GoProxyTunnel) sendProbe(addr *net.UDPAddr) {
+	if proxy.listenConnection == nil || addr.Port < 1 {
+		return
+	}
+	nonce, ok := proxy.latency.StartProbe(addr.IP, addr.Port)
+	if !ok {
+		return
+	}
+	probe := make([]byte, probePacketLen)
+	probe[0] = probeRequest
+	binary.BigEndian.PutUint64(probe[1:], nonce)
+	err := proxy.writeToPeer(probe, addr, flagProbe)
+	if err != nil {
+		logger.DebugLogger().Printf("Unable to probe %s: %v\n", addr.String(), err)
+	}
+}
+
+func isProbePacket(msg []byte) bool {
+	return len(msg) == probePacketLen && (msg[0] == probeRequest || msg[0] == probeReply)
+}
+
+// handleProbe answers probe requests and records the rtt of the replies to our probes
+func (proxy *GoProxyTunnel) handleProbe(msg []byte, from *net.UDPAddr) {
+	switch msg[0] {
+	case probeRequest:
+		reply := make([]byte, probePacketLen)
+		copy(reply, msg)
+		reply[0] = probeReply
+		err := proxy.writeToPeer(reply, from, flagProbe)
+		if err != nil {
+			logger.DebugLogger().Printf("Unable to answer probe from %s: %v\n", from.String(), err)
+		}
+	case probeReply:
+		// only the reply of the probed peer carries the nonce, the replies are not authenticated otherwise
+		rtt, ok := proxy.latency.ProbeReplied(from.IP, from.Port, binary.BigEndian.Uint64(msg[1:]))
+		if !ok {
+			logger.DebugLogger().Printf("Ignored unexpected probe reply from %s\n", from.String())
+			return
+		}
+		logger.DebugLogger().Printf("Latency towards %s: %s\n", from.String(), rtt)
+		proxy.latency.Update(from.IP, from.Port, rtt)
+	}
+}
+
+// closestTableEntry picks the instance with the lowest measured latency from this node.
+// Instances deployed on this node are always the closest. Peers without a measurement are probed and,
+// if none of the candidates has been measured yet, a random instance is used in the meantime.
+func (proxy *GoProxyTunnel) closestTableEntry(tableEntryList []TableEntryCache.TableEntry) TableEntryCache.TableEntry {
+	best := -1
+	var bestRtt time.Duration
+	for i, entry := range tableEntryList {
+		if entry.Nodeip.Equal(proxy.localIP) {
+			return entry
+		}
+		rtt, measured := proxy.latency.Get(entry.Nodeip, entry.Nodeport)
+		if !measured {
+			proxy.requestProbe(entry.Nodeip, entry.Nodeport)
+			continue
+		}
+		proxy.latency.Track(entry.Nodeip, entry.Nodeport)
+		if best < 0 || rtt < bestRtt {
+			best = i
+			bestRtt = rtt
+		}
+	}
+	if best < 0 {
+		return tableEntryList[proxy.randseed.Intn(len(tableEntryList))]
+	}
+	return tableEntryList[best]
+}
@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"NetManager/logger"
+	"NetManager/proxy/iputils"
+	"encoding/binary"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// PATH_MTU_REFRESH_INTERVAL is the period after which the path MTU towards a peer is read again from the socket
+var PATH_MTU_REFRESH_INTERVAL = 30 * time.Second
+
+// ICMP errors generated by the proxy must fit the minimum MTU, the embedded packet is truncated accordingly
+const (
+	icmpv4MaxEmbedded = 576 - 20 - 8
+	icmpv6MaxEmbedded = 1280 - 40 - 8
+)
+
+type pathMTUEntry struct {
+	mtu     int
+	updated time.Time
+}
+
+// PathMTUCache keeps the underlay path MTU towards every peer node, as learned by the kernel on the peer socket
+type PathMTUCache struct {
+	entries map[string]pathMTUEntry
+	rwlock  sync.RWMutex
+}
+
+func NewPathMTUCache() *PathMTUCache {
+	return &PathMTUCache{
+		entries: make(map[string]pathMTUEntry),
+		rwlock:  sync.RWMutex{},
+	}
+}
+
+func (cache *PathMTUCache) get(hoststring string) (int, bool) {
+	cache.rwlock.RLock()
+	defer cache.rwlock.RUnlock()
+	entry, exist := cache.entries[hoststring]
+	if !exist || time.Since(entry.updated) > PATH_MTU_REFRESH_INTERVAL {
+		return 0, false
+	}
+	return entry.mtu, true
+}
+
+func (cache *PathMTUCache) set(hoststring string, mtu int) {
+	cache.rwlock.Lock()
+	defer cache.rwlock.Unlock()
+	cache.entries[hoststring] = pathMTUEntry{mtu: mtu, updated: time.Now()}
+}
+
+// enablePathMTUDiscovery lets the kernel discover the path MTU of the socket. Packets bigger than the path MTU are
+// still fragmented by the kernel, the proxy decides which inner packets can't be.
+func enablePathMTUDiscovery(conn *net.UDPConn, ipv6 bool) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if ipv6 {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_WANT)
+		} else {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_WANT)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// socketPathMTU reads the path MTU known by the kernel for a connected socket
+func socketPathMTU(conn *net.UDPConn, ipv6 bool) (int, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	mtu := 0
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if ipv6 {
+			mtu, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU)
+		} else {
+			mtu, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return mtu, sockErr
+}
+
+// tunnelOverhead is the number of bytes added to an inner packet sent to the peer
+func (proxy *GoProxyTunnel) tunnelOverhead(dstHost net.IP) int {
+	overhead := 20 + 8 + tunnelHeaderLen
+	if dstHost.To4() == nil {
+		overhead = 40 + 8 + tunnelHeaderLen
+	}
+	if proxy.crypto != nil {
+		overhead += sealedHeaderLen + 16
+	}
+	return overhead
+}
+
+// maxPacketSize returns the biggest inner packet that can be sent to the peer without fragmentation,
+// false if the path MTU is unknown
+func (proxy *GoProxyTunnel) maxPacketSize(dstHost net.IP, dstPort int) (int, bool) {
+	if dstHost.Equal(proxy.localIP) || dstPort < 1 {
+		return 0, false
+	}
+	hoststring := peerKey(dstHost, dstPort)
+	mtu, known := proxy.pathMTU.get(hoststring)
+	if !known {
+		con, err := proxy.peerConnection(hoststring)
+		if err != nil {
+			return 0, false
+		}
+		mtu, err = socketPathMTU(con, dstHost.To4() == nil)
+		if err != nil || mtu < 1 {
+			logger.DebugLogger().Printf("Unable to read path MTU towards %s: %v\n", hoststring, err)
+			return 0, false
+		}
+		proxy.pathMTU.set(hoststring, mtu)
+	}
+	return mtu - proxy.tunnelOverhead(dstHost), true
+}
+
+// checkPathMTU returns false if the packet can't reach the peer, in that case a frag-needed or packet-too-big
+// error is sent back to the sender through the TUN device so that it lowers its packet size
+func (proxy *GoProxyTunnel) checkPathMTU(msg []byte, dstHost net.IP, dstPort int) bool {
+	maxSize, known := proxy.maxPacketSize(dstHost, dstPort)
+	if !known || len(msg) <= maxSize {
+		return true
+	}
+	// IPv4 packets without the DF bit can still be fragmented by the underlay
+	if msg[0]&0xf0 == 0x40 && msg[6]&0x40 == 0 {
+		return true
+	}
+	logger.DebugLogger().Printf("Packet of %d bytes exceeds the path MTU towards %s, max %d\n", len(msg), dstHost.String(), maxSize)
+	icmp := packetTooBig(msg, maxSize)
+	if icmp != nil && proxy.ifce != nil {
+		_, err := proxy.ifce.Write(icmp)
+		if err != nil {
+			logger.ErrorLogger().Println(err)
+		}
+	}
+	return false
+}
+
+// packetTooBig builds the frag-needed or packet-too-big error for the original packet
+func packetTooBig(msg []byte, mtu int) []byte {
+	return icmpError(msg,
+		layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded),
+		layers.CreateICMPv6TypeCode(layers.ICMPv6TypePacketTooBig, 0),
+		uint32(mtu))
+}
+
+// hostUnreachable builds the host unreachable error for the original packet
+func hostUnreachable(msg []byte) []byte {
+	return icmpError(msg,
+		layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeHost),
+		layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodeAddressUnreachable),
+		0)
+}
+
+// icmpError builds the ICMP error for the original packet, sent on behalf of its destination.
+// info is the 32 bits field following the checksum, e.g. the next-hop MTU.
+func icmpError(msg []byte, v4TypeCode layers.ICMPv4TypeCode, v6TypeCode layers.ICMPv6TypeCode, info uint32) []byte {
+	if len(msg) < 1 {
+		return nil
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if msg[0]&0xf0 == 0x40 {
+		if len(msg) < 20 {
+			return nil
+		}
+		embedded := msg[:minInt(len(msg), icmpv4MaxEmbedded)]
+		ipv4 := &layers.IPv4{
+			Version:  4,
+			IHL:      5,
+			TTL:      64,
+			Protocol: layers.IPProtocolICMPv4,
+			SrcIP:    net.IP(msg[16:20]),
+			DstIP:    net.IP(msg[12:16]),
+		}
+		icmp := &layers.ICMPv4{
+			TypeCode: v4TypeCode,
+			Id:       uint16(info >> 16),
+			Seq:      uint16(info),
+		}
+		if gopacket.SerializeLayers(buffer, options, ipv4, icmp, gopacket.Payload(embedded)) != nil {
+			return nil
+		}
+		return buffer.Bytes()
+	}
+	if len(msg) < 40 {
+		return nil
+	}
+	embedded := msg[:minInt(len(msg), icmpv6MaxEmbedded)]
+	ipv6 := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolICMPv6,
+		SrcIP:      net.IP(msg[24:40]),
+		DstIP:      net.IP(msg[8:24]),
+	}
+	icmp := &layers.ICMPv6{
+		TypeCode: v6TypeCode,
+	}
+	_ = icmp.SetNetworkLayerForChecksum(ipv6)
+	payload := make([]byte, 4+len(embedded))
+	binary.BigEndian.PutUint32(payload[0:4], info)
+	copy(payload[4:], embedded)
+	if gopacket.SerializeLayers(buffer, options, ipv6, icmp, gopacket.Payload(payload)) != nil {
+		return nil
+	}
+	return buffer.Bytes()
+}
+
+// clampMSS lowers the MSS option of TCP SYN packets so that the segments of the connection fit the path MTU.
+// Returns true if the option has been changed.
+func clampMSS(prot iputils.TransportLayerProtocol, maxSize int, ipv6 bool) bool {
+	if prot == nil || prot.GetProtocol() != "TCP" || prot.GetTCPLayer() == nil || !prot.GetTCPLayer().SYN {
+		return false
+	}
+	mss := maxSize - 20 - 20
+	if ipv6 {
+		mss = maxSize - 40 - 20
+	}
+	if mss < 1 {
+		return false
+	}
+	tcp := prot.GetTCPLayer()
+	for i, option := range tcp.Options {
+		if option.OptionType == layers.TCPOptionKindMSS && len(option.OptionData) == 2 {
+			if int(binary.BigEndian.Uint16(option.OptionData)) <= mss {
+				return false
+			}
+			data := make([]byte, 2)
+			binary.BigEndian.PutUint16(data, uint16(mss))
+			tcp.Options[i].OptionData = data
+			return true
+		}
+	}
+	return false
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"NetManager/TableEntryCache"
+	"NetManager/logger"
+	"net"
+	"sync"
+	"time"
+)
+
+// PENDING_QUEUE_SIZE is the number of packets kept for each ServiceIP while its table query is running
+var PENDING_QUEUE_SIZE = 32
+
+// PENDING_TIMEOUT is the maximum time a packet waits for the resolution of its ServiceIP
+var PENDING_TIMEOUT = 6 * time.Second
+
+// PendingQueue keeps the packets towards the ServiceIPs that are being resolved
+type PendingQueue struct {
+	destinations map[[16]byte]*pendingBatch
+	maxPackets   int
+	// identifies the batches, the resolution and the timeout of a batch must not take the packets of a later one
+	generation uint64
+	lock       sync.Mutex
+}
+
+// packets waiting for the same resolution of a ServiceIP
+type pendingBatch struct {
+	packets    [][]byte
+	generation uint64
+}
+
+func NewPendingQueue() *PendingQueue {
+	return &PendingQueue{
+		destinations: make(map[[16]byte]*pendingBatch),
+		maxPackets:   PENDING_QUEUE_SIZE,
+		lock:         sync.Mutex{},
+	}
+}
+
+// Enqueue stores a copy of the packet and returns the batch it belongs to. Returns true if this is the first packet
+// of the batch, in that case the resolution must be started. Packets beyond the queue size are dropped.
+func (queue *PendingQueue) Enqueue(serviceIP net.IP, packet []byte) (uint64, bool, bool) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	key := ipKey(serviceIP)
+	batch, pending := queue.destinations[key]
+	if !pending {
+		queue.generation++
+		batch = &pendingBatch{packets: make([][]byte, 0, 1), generation: queue.generation}
+		queue.destinations[key] = batch
+	}
+	if len(batch.packets) >= queue.maxPackets {
+		return batch.generation, false, false
+	}
+	packetCopy := make([]byte, len(packet))
+	copy(packetCopy, packet)
+	batch.packets = append(batch.packets, packetCopy)
+	return batch.generation, !pending, true
+}
+
+// Take removes and returns the packets of the batch waiting for the ServiceIP, nothing if the batch is gone
+func (queue *PendingQueue) Take(serviceIP net.IP, generation uint64) [][]byte {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	key := ipKey(serviceIP)
+	batch, pending := queue.destinations[key]
+	if !pending || batch.generation != generation {
+		return nil
+	}
+	delete(queue.destinations, key)
+	return batch.packets
+}
+
+// deferPacket parks the packet until the ServiceIP is resolved, without blocking the worker
+func (proxy *GoProxyTunnel) deferPacket(serviceIP net.IP, packet []byte) {
+	batch, first, queued := proxy.pending.Enqueue(serviceIP, packet)
+	if !queued {
+		logger.DebugLogger().Println("Pending queue full, packet towards ", serviceIP.String(), " dropped")
+		return
+	}
+	if !first {
+		return
+	}
+	logger.DebugLogger().Println("Resolving ServiceIP ", serviceIP.String())
+	proxy.environment.ResolveServiceIP(serviceIP, func(entries []TableEntryCache.TableEntry) {
+		proxy.serviceResolved(serviceIP, batch, entries)
+	})
+	// the resolution may never answer, the packets can't wait forever
+	time.AfterFunc(PENDING_TIMEOUT, func() {
+		proxy.serviceResolved(serviceIP, batch, nil)
+	})
+}
+
+// serviceResolved flushes the packets of the batch waiting for the ServiceIP back to the workers. If the resolution
+// failed the senders are notified with an ICMP unreachable.
+func (proxy *GoProxyTunnel) serviceResolved(serviceIP net.IP, batch uint64, entries []TableEntryCache.TableEntry) {
+	packets := proxy.pending.Take(serviceIP, batch)
+	if len(packets) == 0 {
+		return
+	}
+	if len(entries) == 0 {
+		logger.DebugLogger().Printf("Unable to resolve ServiceIP %s, %d packets dropped\n", serviceIP.String(), len(packets))
+		for _, packet := range packets {
+			icmp := hostUnreachable(packet)
+			if icmp != nil && proxy.ifce != nil {
+				_, err := proxy.ifce.Write(icmp)
+				if err != nil {
+					logger.ErrorLogger().Println(err)
+				}
+			}
+		}
+		return
+	}
+	for i := range packets {
+		proxy.dispatchOutgoing(outgoingMessage{
+			content: &packets[i],
+		})
+	}
+}
@@ -1,113 +1,202 @@
 package proxy
 
 import (
+	"NetManager/proxy/iputils"
+	"container/list"
 	"net"
 	"sync"
 	"time"
 )
 
+// FLOW_TABLE_SIZE is the maximum number of flows tracked by the proxy, the least recently used flow is evicted first
+var FLOW_TABLE_SIZE = 65536
+
+// FLOW_IDLE_TIMEOUT is the time after which a UDP or ICMP flow without packets is removed
+var FLOW_IDLE_TIMEOUT = 2 * time.Minute
+
 type ConversionEntry struct {
+	protocol      string
 	srcip         net.IP
 	dstip         net.IP
 	dstServiceIp  net.IP
 	srcInstanceIp net.IP
+	// InstanceNumber service IP of the destination instance, the source of its replies
+	dstInstanceIp net.IP
 	srcport       int
 	dstport       int
+	// state of the connection when the entry was retrieved
+	state connState
 }
 
-type ConversionList struct {
-	nextEntry      int
-	lastUsed       int64
-	conversionList []ConversionEntry
+// flowKey identifies a flow in one direction. IPs are stored in their 16 bytes form to be comparable.
+type flowKey struct {
+	protocol string
+	srcip    [16]byte
+	srcport  int
+	dstip    [16]byte
+	dstport  int
 }
 
+type flow struct {
+	entry       ConversionEntry
+	serviceKey  flowKey
+	instanceKey flowKey
+	lastUsed    time.Time
+	conn        connTrack
+}
+
+// ProxyCache is the flow table of the proxy. Each flow is indexed both by the ServiceIP used by the client and
+// by the client address, used by the replies. Both lookups are O(1).
 type ProxyCache struct {
-	//One position for each port number. Higher mem usage but lower cpu usage
-	cache                 []ConversionList
-	conversionListMaxSize int
-	rwlock                sync.RWMutex
+	byServiceIP  map[flowKey]*list.Element
+	byInstanceIP map[flowKey]*list.Element
+	// flows ordered from the most to the least recently used
+	lru      *list.List
+	maxSize  int
+	timeouts flowTimeouts
+	rwlock   sync.RWMutex
 }
 
-func NewProxyCache() ProxyCache {
-	return ProxyCache{
-		cache:                 make([]ConversionList, 65535),
-		conversionListMaxSize: 10,
-		rwlock:                sync.RWMutex{},
+func NewProxyCache() *ProxyCache {
+	return &ProxyCache{
+		byServiceIP:  make(map[flowKey]*list.Element),
+		byInstanceIP: make(map[flowKey]*list.Element),
+		lru:          list.New(),
+		maxSize:      FLOW_TABLE_SIZE,
+		timeouts:     defaultFlowTimeouts(),
+		rwlock:       sync.RWMutex{},
 	}
 }
 
-// RetrieveByServiceIP Retrieve proxy proxycache entry based on source ip and source port and destination ServiceIP
-func (cache *ProxyCache) RetrieveByServiceIP(srcip net.IP, instanceIP net.IP, srcport int, dstServiceIp net.IP, dstport int) (ConversionEntry, bool) {
+func ipKey(ip net.IP) [16]byte {
+	var key [16]byte
+	copy(key[:], ip.To16())
+	return key
+}
+
+func serviceFlowKey(protocol string, srcip net.IP, srcport int, dstServiceIp net.IP, dstport int) flowKey {
+	return flowKey{protocol: protocol, srcip: ipKey(srcip), srcport: srcport, dstip: ipKey(dstServiceIp), dstport: dstport}
+}
+
+// replies come from the InstanceNumber service IP of the server instance, translated by the server node
+func instanceFlowKey(protocol string, srcip net.IP, srcport int, dstInstanceIp net.IP, dstport int) flowKey {
+	return flowKey{protocol: protocol, srcip: ipKey(srcip), srcport: srcport, dstip: ipKey(dstInstanceIp), dstport: dstport}
+}
+
+// RetrieveByServiceIP Retrieve proxy proxycache entry based on source ip and source port and destination ServiceIP.
+// If the packet is given, the connection state is updated with it.
+func (cache *ProxyCache) RetrieveByServiceIP(protocol string, srcip net.IP, srcport int, dstServiceIp net.IP, dstport int, packet_optional ...iputils.TransportLayerProtocol) (ConversionEntry, bool) {
+	return cache.retrieve(cache.byServiceIP, serviceFlowKey(protocol, srcip, srcport, dstServiceIp, dstport), true, packet_optional...)
+}
+
+// RetrieveByInstanceIp Retrieve proxy proxycache entry based on source ip and source port, instance ip and destination port.
+// If the packet is given, the connection state is updated with it.
+func (cache *ProxyCache) RetrieveByInstanceIp(protocol string, srcip net.IP, srcport int, dstInstanceIp net.IP, dstport int, packet_optional ...iputils.TransportLayerProtocol) (ConversionEntry, bool) {
+	return cache.retrieve(cache.byInstanceIP, instanceFlowKey(protocol, srcip, srcport, dstInstanceIp, dstport), false, packet_optional...)
+}
+
+func (cache *ProxyCache) retrieve(index map[flowKey]*list.Element, key flowKey, original bool, packet_optional ...iputils.TransportLayerProtocol) (ConversionEntry, bool) {
 	cache.rwlock.Lock()
 	defer cache.rwlock.Unlock()
 
-	elem := cache.cache[srcport]
-	elem.lastUsed = time.Now().Unix()
-	if elem.conversionList != nil {
-		for _, cacheEntry := range elem.conversionList {
-			if cacheEntry.dstport == dstport &&
-				cacheEntry.dstServiceIp.Equal(dstServiceIp) &&
-				cacheEntry.srcip.Equal(srcip) &&
-				cacheEntry.srcInstanceIp.Equal(instanceIP) {
-				return cacheEntry, true
-			}
-		}
+	elem, exist := index[key]
+	if !exist {
+		return ConversionEntry{}, false
+	}
+	current := elem.Value.(*flow)
+	if cache.expired(current) {
+		cache.remove(elem)
+		return ConversionEntry{}, false
 	}
-	return ConversionEntry{}, false
+	if len(packet_optional) > 0 {
+		current.conn.track(packet_optional[0], original)
+	}
+	current.lastUsed = time.Now()
+	cache.lru.MoveToFront(elem)
+	result := current.entry
+	result.state = current.conn.state
+	return result, true
 }
 
-// RetrieveByInstanceIp Retrieve proxy proxycache entry based on source ip and source port and destination ip
-func (cache *ProxyCache) RetrieveByInstanceIp(srcip net.IP, srcport int, dstport int) (ConversionEntry, bool) {
+// Add new conversion entry, if the flow is already present the entry is updated.
+// If the first packet of the flow is given, the connection state starts from it.
+func (cache *ProxyCache) Add(entry ConversionEntry, packet_optional ...iputils.TransportLayerProtocol) {
 	cache.rwlock.Lock()
 	defer cache.rwlock.Unlock()
 
-	elem := cache.cache[srcport]
-	elem.lastUsed = time.Now().Unix()
-	if elem.conversionList != nil {
-		for _, entry := range elem.conversionList {
-			if entry.dstport == dstport && entry.srcip.Equal(srcip) {
-				return entry, true
-			}
-		}
+	newFlow := &flow{
+		entry:       entry,
+		serviceKey:  serviceFlowKey(entry.protocol, entry.srcip, entry.srcport, entry.dstServiceIp, entry.dstport),
+		instanceKey: instanceFlowKey(entry.protocol, entry.srcip, entry.srcport, entry.dstInstanceIp, entry.dstport),
+		lastUsed:    time.Now(),
 	}
-	return ConversionEntry{}, false
+	if len(packet_optional) > 0 {
+		newFlow.conn.track(packet_optional[0], true)
+	}
+	// a new flow replaces any flow sharing one of its keys
+	if elem, exist := cache.byServiceIP[newFlow.serviceKey]; exist {
+		cache.remove(elem)
+	}
+	if elem, exist := cache.byInstanceIP[newFlow.instanceKey]; exist {
+		cache.remove(elem)
+	}
+	for cache.lru.Len() >= cache.maxSize && cache.lru.Len() > 0 {
+		cache.remove(cache.lru.Back())
+	}
+
+	elem := cache.lru.PushFront(newFlow)
+	cache.byServiceIP[newFlow.serviceKey] = elem
+	cache.byInstanceIP[newFlow.instanceKey] = elem
 }
 
-// Add new conversion entry, if srcpip && srcport already added the entry is updated
-func (cache *ProxyCache) Add(entry ConversionEntry) {
+// Sweep removes the flows idle for longer than the timeout of their state, returns the number of removed flows
+func (cache *ProxyCache) Sweep() int {
 	cache.rwlock.Lock()
 	defer cache.rwlock.Unlock()
 
-	elem := cache.cache[entry.srcport]
-	if elem.conversionList == nil || len(elem.conversionList) == 0 {
-		elem.nextEntry = 0
-		elem.conversionList = make([]ConversionEntry, cache.conversionListMaxSize)
-	}
-	cache.cache[entry.srcport] = elem
-
-	cache.addToConversionList(entry)
-}
-
-func (cache *ProxyCache) addToConversionList(entry ConversionEntry) {
-	elem := cache.cache[entry.srcport]
-	elem.lastUsed = time.Now().Unix()
-	alreadyExist := false
-	alreadyExistPosition := 0
-	//check if used port is already in proxycache
-	for i, elementry := range elem.conversionList {
-		if elementry.dstport == entry.dstport {
-			alreadyExistPosition = i
-			alreadyExist = true
-			break
+	removed := 0
+	for elem := cache.lru.Back(); elem != nil; {
+		previous := elem.Prev()
+		if cache.expired(elem.Value.(*flow)) {
+			cache.remove(elem)
+			removed++
 		}
+		elem = previous
 	}
-	if alreadyExist {
-		//if sourceport already in proxycache overwrite the proxycache entry
-		elem.conversionList[alreadyExistPosition] = entry
-
-	} else {
-		//otherwise add a new proxycache entry in the next slot available
-		elem.conversionList[elem.nextEntry] = entry
-		elem.nextEntry = (elem.nextEntry + 1) % cache.conversionListMaxSize
+	return removed
+}
+
+// RemoveByDestination removes the flows towards the given instance IP, returns the number of removed flows
+func (cache *ProxyCache) RemoveByDestination(dstip net.IP) int {
+	cache.rwlock.Lock()
+	defer cache.rwlock.Unlock()
+
+	removed := 0
+	for elem := cache.lru.Back(); elem != nil; {
+		previous := elem.Prev()
+		if elem.Value.(*flow).entry.dstip.Equal(dstip) {
+			cache.remove(elem)
+			removed++
+		}
+		elem = previous
 	}
+	return removed
+}
+
+func (cache *ProxyCache) expired(current *flow) bool {
+	return time.Since(current.lastUsed) > cache.timeouts.of(current.entry.protocol, current.conn.state)
+}
+
+// Len returns the number of tracked flows
+func (cache *ProxyCache) Len() int {
+	cache.rwlock.RLock()
+	defer cache.rwlock.RUnlock()
+	return cache.lru.Len()
+}
+
+func (cache *ProxyCache) remove(elem *list.Element) {
+	current := elem.Value.(*flow)
+	delete(cache.byServiceIP, current.serviceKey)
+	delete(cache.byInstanceIP, current.instanceKey)
+	cache.lru.Remove(elem)
 }
@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"NetManager/logger"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Sealed tunnel packet layout:
+// | sealedPacket (1) | sender key id (4) | counter (8) | ciphertext + tag |
+// The first byte can never be mistaken for an IPv4 or IPv6 header nor for a probe.
+const (
+	sealedPacket     byte = 0x03
+	sealedHeaderLen       = 13
+	replayWindowSize      = 1024
+)
+
+// TunnelCrypto holds the node key pair and the session keys derived for every peer node
+type TunnelCrypto struct {
+	privateKey []byte
+	publicKey  []byte
+	keyID      uint32
+	peers      map[string]*tunnelPeer
+	peersByID  map[uint32]*tunnelPeer
+	rwlock     sync.RWMutex
+}
+
+type tunnelPeer struct {
+	// the node that announced the key, the only one allowed to replace it
+	owner     string
+	publicKey []byte
+	keyID     uint32
+	send      cipher.AEAD
+	recv      cipher.AEAD
+	counter   uint64
+	replay    replayWindow
+	lock      sync.Mutex
+}
+
+// sliding window of the last received counters, as in RFC 6479
+type replayWindow struct {
+	last   uint64
+	bitmap [replayWindowSize / 64]uint64
+}
+
+func NewTunnelCrypto() (*TunnelCrypto, error) {
+	privateKey := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, privateKey); err != nil {
+		return nil, err
+	}
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &TunnelCrypto{
+		privateKey: privateKey,
+		publicKey:  publicKey,
+		keyID:      keyIdentifier(publicKey),
+		peers:      make(map[string]*tunnelPeer),
+		peersByID:  make(map[uint32]*tunnelPeer),
+		rwlock:     sync.RWMutex{},
+	}, nil
+}
+
+func keyIdentifier(publicKey []byte) uint32 {
+	digest := sha256.Sum256(publicKey)
+	return binary.BigEndian.Uint32(digest[:4])
+}
+
+// PublicKey returns the key that must be announced to the other nodes
+func (tc *TunnelCrypto) PublicKey() []byte {
+	return tc.publicKey
+}
+
+// AddPeer derives the session keys towards the node reachable at ip:port, with the key announced by owner.
+// A new key for the same node replaces the previous session only if announced by the same owner: the
+// announcements are not signed, the owner is the only sender identity authenticated by the broker.
+func (tc *TunnelCrypto) AddPeer(owner string, ip net.IP, port int, publicKey []byte) error {
+	if len(publicKey) != curve25519.PointSize {
+		return errors.New("invalid tunnel public key length")
+	}
+	if bytes.Equal(publicKey, tc.publicKey) {
+		return nil
+	}
+	shared, err := curve25519.X25519(tc.privateKey, publicKey)
+	if err != nil {
+		return err
+	}
+
+	// one key per direction, the node with the lower public key sends with the first one
+	info := append([]byte("oakestra tunnel"), tc.publicKey...)
+	info = append(info, publicKey...)
+	if bytes.Compare(tc.publicKey, publicKey) > 0 {
+		info = append([]byte("oakestra tunnel"), publicKey...)
+		info = append(info, tc.publicKey...)
+	}
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, nil, info), keys); err != nil {
+		return err
+	}
+	sendKey, recvKey := keys[:chacha20poly1305.KeySize], keys[chacha20poly1305.KeySize:]
+	if bytes.Compare(tc.publicKey, publicKey) > 0 {
+		sendKey, recvKey = recvKey, sendKey
+	}
+	send, err := chacha20poly1305.New(sendKey)
+	if err != nil {
+		return err
+	}
+	recv, err := chacha20poly1305.New(recvKey)
+	if err != nil {
+		return err
+	}
+
+	peer := &tunnelPeer{
+		owner:     owner,
+		publicKey: publicKey,
+		keyID:     keyIdentifier(publicKey),
+		send:      send,
+		recv:      recv,
+	}
+	key := peerKey(ip, port)
+	tc.rwlock.Lock()
+	defer tc.rwlock.Unlock()
+	old, exist := tc.peers[key]
+	if exist && bytes.Equal(old.publicKey, publicKey) {
+		return nil
+	}
+	if exist && old.owner != owner {
+		return errors.New(fmt.Sprintf("key of node %s announced by %s, refused from %s", key, old.owner, owner))
+	}
+	// a key already used by another node would reset its replay window
+	if other, used := tc.peersByID[peer.keyID]; used && other != old {
+		return errors.New(fmt.Sprintf("key already announced by %s", other.owner))
+	}
+	if exist {
+		delete(tc.peersByID, old.keyID)
+	}
+	tc.peers[key] = peer
+	tc.peersByID[peer.keyID] = peer
+	logger.InfoLogger().Printf("Tunnel key of node %s updated\n", key)
+	return nil
+}
+
+// Seal encrypts the message for the node reachable at ip:port
+func (tc *TunnelCrypto) Seal(ip net.IP, port int, msg []byte) ([]byte, error) {
+	tc.rwlock.RLock()
+	peer, exist := tc.peers[peerKey(ip, port)]
+	tc.rwlock.RUnlock()
+	if !exist {
+		return nil, errors.New(fmt.Sprintf("No tunnel key for node %s", peerKey(ip, port)))
+	}
+
+	counter := atomic.AddUint64(&peer.counter, 1)
+	sealed := make([]byte, sealedHeaderLen, sealedHeaderLen+len(msg)+peer.send.Overhead())
+	sealed[0] = sealedPacket
+	binary.BigEndian.PutUint32(sealed[1:5], tc.keyID)
+	binary.BigEndian.PutUint64(sealed[5:13], counter)
+	return peer.send.Seal(sealed, counterNonce(counter), msg, sealed[:sealedHeaderLen]), nil
+}
+
+// Open authenticates and decrypts a sealed packet. Packets from unknown nodes, forged or replayed packets return an error.
+func (tc *TunnelCrypto) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < sealedHeaderLen+chacha20poly1305.Overhead || sealed[0] != sealedPacket {
+		return nil, errors.New("not a sealed tunnel packet")
+	}
+	tc.rwlock.RLock()
+	peer, exist := tc.peersByID[binary.BigEndian.Uint32(sealed[1:5])]
+	tc.rwlock.RUnlock()
+	if !exist {
+		return nil, errors.New("unknown tunnel key")
+	}
+
+	counter := binary.BigEndian.Uint64(sealed[5:13])
+	msg, err := peer.recv.Open(nil, counterNonce(counter), sealed[sealedHeaderLen:], sealed[:sealedHeaderLen])
+	if err != nil {
+		return nil, err
+	}
+	// the counter is accepted only after authentication, otherwise forged packets could move the window
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	if !peer.replay.accept(counter) {
+		return nil, errors.New("replayed tunnel packet")
+	}
+	return msg, nil
+}
+
+func counterNonce(counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[chacha20poly1305.NonceSize-8:], counter)
+	return nonce
+}
+
+// accept returns false if the counter is too old or has already been received
+func (window *replayWindow) accept(counter uint64) bool {
+	if counter == 0 {
+		return false
+	}
+	if counter > window.last {
+		// clear the blocks that the window skipped over, the current block keeps its recent counters
+		start := window.last/64 + 1
+		end := counter / 64
+		if end >= start {
+			if end-start >= uint64(len(window.bitmap)) {
+				start = end - uint64(len(window.bitmap)) + 1
+			}
+			for block := start; block <= end; block++ {
+				window.bitmap[block%uint64(len(window.bitmap))] = 0
+			}
+		}
+		window.last = counter
+	} else if window.last-counter >= replayWindowSize-64 {
+		return false
+	}
+	block := (counter / 64) % uint64(len(window.bitmap))
+	bit := uint64(1) << (counter % 64)
+	if window.bitmap[block]&bit != 0 {
+		return false
+	}
+	window.bitmap[block] |= bit
+	return true
+}
+
+// EnableEncryption generates the node tunnel keys. From now on only the packets from the peers registered with
+// AddPeerKey are accepted. Returns the public key that must be announced to the other nodes.
+func (proxy *GoProxyTunnel) EnableEncryption() ([]byte, error) {
+	if !proxy.tunnelEncryption {
+		return nil, errors.New("tunnel encryption disabled by configuration")
+	}
+	tunnelCrypto, err := NewTunnelCrypto()
+	if err != nil {
+		return nil, err
+	}
+	proxy.crypto = tunnelCrypto
+	logger.InfoLogger().Println("Tunnel encryption enabled")
+	return tunnelCrypto.PublicKey(), nil
+}
+
+// AddPeerKey registers the tunnel key announced by the node nodeID reachable at hostIP:hostPort
+func (proxy *GoProxyTunnel) AddPeerKey(nodeID string, hostIP net.IP, hostPort int, publicKey []byte) {
+	if proxy.crypto == nil {
+		return
+	}
+	err := proxy.crypto.AddPeer(nodeID, hostIP, hostPort, publicKey)
+	if err != nil {
+		logger.ErrorLogger().Printf("Invalid tunnel key from %s: %v\n", peerKey(hostIP, hostPort), err)
+	}
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"NetManager/logger"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync"
+)
+
+// Tunnel encapsulation header:
+// | magic (2) | version (1) | flags (1) | sender node ID (4) | payload |
+// The high nibble of the magic is 0, so a framed packet can't be mistaken for a legacy IPv4 or IPv6 packet.
+// These first 8 bytes must stay the same in every future version, so that nodes can always negotiate.
+const (
+	TUNNEL_MAGIC    uint16 = 0x0A7E
+	TUNNEL_VERSION  uint8  = 1
+	legacyVersion   uint8  = 0
+	tunnelHeaderLen        = 8
+)
+
+// header flags describing the payload
+const (
+	flagSealed byte = 1 << 0
+	flagProbe  byte = 1 << 1
+)
+
+type TunnelHeader struct {
+	Version uint8
+	Flags   byte
+	NodeID  uint32
+}
+
+// NodeID derives the identifier carried in the tunnel header from the node tunnel address
+func NodeID(ip net.IP, port int) uint32 {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(peerKey(ip, port)))
+	return hash.Sum32()
+}
+
+// Encode prepends the header to the payload
+func (header TunnelHeader) Encode(payload []byte) []byte {
+	msg := make([]byte, tunnelHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(msg[0:2], TUNNEL_MAGIC)
+	msg[2] = header.Version
+	msg[3] = header.Flags
+	binary.BigEndian.PutUint32(msg[4:8], header.NodeID)
+	copy(msg[tunnelHeaderLen:], payload)
+	return msg
+}
+
+func isFramedPacket(msg []byte) bool {
+	return len(msg) >= tunnelHeaderLen && binary.BigEndian.Uint16(msg[0:2]) == TUNNEL_MAGIC
+}
+
+// DecodeTunnelHeader validates the header and returns the payload
+func DecodeTunnelHeader(msg []byte) (TunnelHeader, []byte, error) {
+	if !isFramedPacket(msg) {
+		return TunnelHeader{}, nil, errors.New("invalid tunnel header magic")
+	}
+	header := TunnelHeader{
+		Version: msg[2],
+		Flags:   msg[3],
+		NodeID:  binary.BigEndian.Uint32(msg[4:8]),
+	}
+	if header.Version == legacyVersion {
+		return header, nil, errors.New("invalid tunnel version 0")
+	}
+	return header, msg[tunnelHeaderLen:], nil
+}
+
+// PeerVersions keeps the tunnel version spoken by every peer node, indexed by ip:port of its tunnel endpoint
+type PeerVersions struct {
+	versions map[string]uint8
+	rwlock   sync.RWMutex
+}
+
+func NewPeerVersions() *PeerVersions {
+	return &PeerVersions{
+		versions: make(map[string]uint8),
+		rwlock:   sync.RWMutex{},
+	}
+}
+
+// Get returns the version to use towards the peer, false if the peer has not been heard yet
+func (pv *PeerVersions) Get(ip net.IP, port int) (uint8, bool) {
+	pv.rwlock.RLock()
+	defer pv.rwlock.RUnlock()
+	version, exist := pv.versions[peerKey(ip, port)]
+	return version, exist
+}
+
+// Learn records the version announced in a header received from the peer
+func (pv *PeerVersions) Learn(ip net.IP, port int, version uint8) {
+	pv.rwlock.Lock()
+	defer pv.rwlock.Unlock()
+	pv.versions[peerKey(ip, port)] = version
+}
+
+// encapsulate prepares a message for the peer node: sealed if the encryption is enabled and framed if the peer
+// supports the tunnel header. Until the peer version is known, legacy packets are sent and a probe is requested
+// to negotiate the version: only peers supporting the header answer to a framed probe.
+func (proxy *GoProxyTunnel) encapsulate(ip net.IP, port int, msg []byte, flags byte) ([]byte, error) {
+	if proxy.crypto != nil {
+		sealed, err := proxy.crypto.Seal(ip, port, msg)
+		if err != nil {
+			return nil, err
+		}
+		msg = sealed
+		flags |= flagSealed
+	}
+	version, known := proxy.versions.Get(ip, port)
+	if !known {
+		proxy.requestProbe(ip, port)
+		if flags&flagProbe == 0 {
+			return msg, nil
+		}
+		version = TUNNEL_VERSION
+	}
+	return TunnelHeader{Version: version, Flags: flags, NodeID: proxy.nodeID}.Encode(msg), nil
+}
+
+// decapsulate validates a message received from a peer node and returns the inner payload.
+// Foreign traffic and packets that don't match the header flags are rejected.
+func (proxy *GoProxyTunnel) decapsulate(msg []byte, from *net.UDPAddr) ([]byte, error) {
+	version := legacyVersion
+	flags := byte(0)
+	if isFramedPacket(msg) {
+		header, payload, err := DecodeTunnelHeader(msg)
+		if err != nil {
+			return nil, err
+		}
+		if header.NodeID == proxy.nodeID && !from.IP.Equal(proxy.localIP) {
+			return nil, errors.New("packet carries the local node ID")
+		}
+		// a newer peer can only negotiate with us, the reply to its probe carries our version
+		if header.Version > TUNNEL_VERSION {
+			if header.Flags&flagProbe == 0 {
+				return nil, errors.New(fmt.Sprintf("unsupported tunnel version %d", header.Version))
+			}
+			header.Version = TUNNEL_VERSION
+		}
+		version = header.Version
+		flags = header.Flags
+		msg = payload
+	} else if !isLegacyPacket(msg) {
+		return nil, errors.New("foreign traffic")
+	}
+
+	if proxy.crypto != nil {
+		if version != legacyVersion && flags&flagSealed == 0 {
+			return nil, errors.New("unsealed packet")
+		}
+		opened, err := proxy.crypto.Open(msg)
+		if err != nil {
+			return nil, err
+		}
+		msg = opened
+	}
+	if version != legacyVersion && (flags&flagProbe != 0) != isProbePacket(msg) {
+		return nil, errors.New("payload does not match the header flags")
+	}
+	// only authenticated packets teach us the peer version
+	if version != legacyVersion {
+		proxy.versions.Learn(from.IP, from.Port, version)
+	}
+	return msg, nil
+}
+
+// legacy peers send raw IP packets, probes or sealed packets without header
+func isLegacyPacket(msg []byte) bool {
+	if len(msg) == 0 {
+		return false
+	}
+	return msg[0]&0xf0 == 0x40 || msg[0]&0xf0 == 0x60 || isProbePacket(msg) || msg[0] == sealedPacket
+}
+
+// writeToPeer sends a message from the listening socket
+func (proxy *GoProxyTunnel) writeToPeer(msg []byte, addr *net.UDPAddr, flags byte) error {
+	msg, err := proxy.encapsulate(addr.IP, addr.Port, msg, flags)
+	if err != nil {
+		return err
+	}
+	if proxy.listenConnection == nil {
+		return errors.New("tunnel not listening")
+	}
+	_, err = proxy.listenConnection.WriteToUDP(msg, addr)
+	if err != nil {
+		logger.DebugLogger().Printf("Unable to write to %s: %v\n", addr.String(), err)
+	}
+	return err
+}
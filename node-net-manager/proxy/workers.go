@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+
+	"github.com/google/gopacket/layers"
+	"github.com/songgao/water"
+)
+
+// WORKER_QUEUE_SIZE is the number of packets waiting for each worker
+var WORKER_QUEUE_SIZE = 1000
+
+// flowHash assigns the packet to a worker. Packets of the same flow and direction always get the same hash,
+// so that they are processed in order.
+func flowHash(packet []byte) uint32 {
+	hash := fnv.New32a()
+	if len(packet) < 1 {
+		return 0
+	}
+	var protocol layers.IPProtocol
+	var transport []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return 0
+		}
+		protocol = layers.IPProtocol(packet[9])
+		_, _ = hash.Write(packet[9:10])
+		_, _ = hash.Write(packet[12:20])
+		headerLen := int(packet[0]&0x0f) * 4
+		// only the first fragment carries the ports
+		if fragmentOffset := binary.BigEndian.Uint16(packet[6:8]) & 0x1fff; fragmentOffset == 0 && len(packet) >= headerLen {
+			transport = packet[headerLen:]
+		}
+	case 6:
+		if len(packet) < 40 {
+			return 0
+		}
+		protocol = layers.IPProtocol(packet[6])
+		_, _ = hash.Write(packet[6:7])
+		_, _ = hash.Write(packet[8:40])
+		transport = packet[40:]
+	default:
+		return 0
+	}
+	if (protocol == layers.IPProtocolTCP || protocol == layers.IPProtocolUDP) && len(transport) >= 4 {
+		_, _ = hash.Write(transport[:4])
+	}
+	return hash.Sum32()
+}
+
+// dispatchOutgoing queues a packet read from the TUN device to the worker of its flow
+func (proxy *GoProxyTunnel) dispatchOutgoing(msg outgoingMessage) {
+	proxy.outgoingChannel[flowHash(*msg.content)%uint32(len(proxy.outgoingChannel))] <- msg
+}
+
+// dispatchIncoming queues a packet received from the tunnel to the worker of its flow
+func (proxy *GoProxyTunnel) dispatchIncoming(msg incomingMessage) {
+	proxy.incomingChannel[flowHash(*msg.content)%uint32(len(proxy.incomingChannel))] <- msg
+}
+
+func newWorkerChannels(workers int) ([]chan outgoingMessage, []chan incomingMessage) {
+	if workers < 1 {
+		workers = 1
+	}
+	outgoing := make([]chan outgoingMessage, workers)
+	incoming := make([]chan incomingMessage, workers)
+	for i := 0; i < workers; i++ {
+		outgoing[i] = make(chan outgoingMessage, WORKER_QUEUE_SIZE)
+		incoming[i] = make(chan incomingMessage, WORKER_QUEUE_SIZE)
+	}
+	return outgoing, incoming
+}
+
+// tunQueue returns the TUN queue used by the worker to write packets, queue 0 if multi-queue is disabled
+func (proxy *GoProxyTunnel) tunQueue(worker int) *water.Interface {
+	if len(proxy.tunQueues) == 0 {
+		return proxy.ifce
+	}
+	return proxy.tunQueues[worker%len(proxy.tunQueues)]
+}
+
+// lockedSource makes a rand.Rand safe for concurrent use by the workers
+type lockedSource struct {
+	source rand.Source
+	lock   sync.Mutex
+}
+
+func newLockedSource(seed int64) *lockedSource {
+	return &lockedSource{source: rand.NewSource(seed)}
+}
+
+func (source *lockedSource) Int63() int64 {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	return source.source.Int63()
+}
+
+func (source *lockedSource) Seed(seed int64) {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	source.source.Seed(seed)
+}